@@ -0,0 +1,62 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// envPrefix prefixes the config override env vars
+const envPrefix = "PHISH"
+
+// applyEnvOverrides overrides config values with env vars named after the yaml path:
+// PHISH_ + yaml keys of the nested sections, upper cased and joined with "_"
+// (rabbit.dst.dsn -> PHISH_RABBIT_DST_DSN, elastic.password -> PHISH_ELASTIC_PASSWORD).
+// String values are taken as is, anything else is parsed as yaml (durations, numbers,
+// lists like "[a, b]", maps like "{key: value}").
+func applyEnvOverrides(cfg interface{}) error {
+	return overrideStruct(reflect.ValueOf(cfg).Elem(), envPrefix)
+}
+
+func overrideStruct(val reflect.Value, prefix string) error {
+	typ := val.Type()
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		key := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+		name := prefix + "_" + strings.ToUpper(key)
+
+		fieldVal := val.Field(i)
+		if fieldVal.Kind() == reflect.Struct {
+			if err := overrideStruct(fieldVal, name); err != nil {
+				return err
+			}
+			continue
+		}
+
+		env, found := os.LookupEnv(name)
+		if !found {
+			continue
+		}
+		if fieldVal.Kind() == reflect.String {
+			fieldVal.SetString(env)
+			continue
+		}
+		// replace (not merge into) lists & maps from the file
+		fieldVal.Set(reflect.Zero(fieldVal.Type()))
+		if err := yaml.Unmarshal([]byte(env), fieldVal.Addr().Interface()); err != nil {
+			return fmt.Errorf("failed to parse env var %v: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -1,17 +1,24 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"net/http"
 	"os"
 	"os/signal"
+	"strings"
+	"sync"
 	"syscall"
-	"time"
 
 	"phish-api/internal/elastic"
+	lg "phish-api/internal/logging"
+	"phish-api/internal/publisher"
 	"phish-api/internal/rabbitmq"
 	"phish-api/internal/server"
+	"phish-api/internal/tracing"
 	"phish-api/internal/validate"
 
 	"github.com/streadway/amqp"
@@ -20,24 +27,64 @@ import (
 
 type Config struct {
 	Http       server.HttpConfig        `yaml:"http"`
+	Publisher  publisher.Config         `yaml:"publisher"`
 	Rabbit     rabbitmq.RabbitConfig    `yaml:"rabbit"`
 	Validation validate.ValidatorConfig `yaml:"validation"`
 	Elastic    elastic.ElasticConfig    `yaml:"elastic"`
+	Log        lg.LogConfig             `yaml:"log"`
+	Tracing    tracing.Config           `yaml:"tracing"`
+}
+
+// Validate checks every config section, the error lists all the problems found
+func (cfg *Config) Validate() error {
+	var errs []string
+	errs = append(errs, cfg.Http.Errors()...)
+	errs = append(errs, cfg.Publisher.Errors()...)
+	if cfg.Publisher.BackendOrDefault() == publisher.BackendRabbit {
+		errs = append(errs, cfg.Rabbit.Errors()...)
+	} else {
+		// no dst rabbit, but the consumers may still be used
+		errs = append(errs, cfg.Rabbit.Consumer.Errors()...)
+		errs = append(errs, cfg.Rabbit.Invalidation.Errors()...)
+	}
+	errs = append(errs, cfg.Validation.Errors()...)
+	errs = append(errs, cfg.Elastic.Errors()...)
+	errs = append(errs, cfg.Log.Errors()...)
+	errs = append(errs, cfg.Tracing.Errors()...)
+
+	if len(errs) > 0 {
+		return fmt.Errorf("config is invalid (%v problems):\n  %v", len(errs), strings.Join(errs, "\n  "))
+	}
+	return nil
 }
 
 func main() {
-	var configPath string
+	var configPath, hashToken, hashFormat string
 
 	flag.StringVar(&configPath, "cfg", "../../configs/config.yaml", "path to config file")
+	flag.StringVar(&hashToken, "hash-token", "", "print the auth_tokens value for the plaintext token and exit")
+	flag.StringVar(&hashFormat, "hash-format", server.TokenFormatSha256, "hash format for -hash-token: sha256 or bcrypt")
 	flag.Parse()
 
+	if hashToken != "" {
+		hash, err := server.HashToken(hashFormat, hashToken)
+		fatalOnErr(err)
+		fmt.Println(hash)
+		return
+	}
+
 	cfg, err := loadConfig(configPath)
 	fatalOnErr(err)
+	fatalOnErr(cfg.Validate())
+	fatalOnErr(lg.Init(cfg.Log))
 
-	// rabbit
-	rabbitHandler, err := rabbitmq.NewRabbitHandler(cfg.Rabbit)
+	// tracing (spans are exported only if a collector endpoint is set)
+	shutdownTracing, err := tracing.Init(cfg.Tracing)
+	fatalOnErr(err)
+
+	// message queue
+	pub, err := newPublisher(cfg)
 	fatalOnErr(err)
-	defer rabbitHandler.Close()
 
 	// validator
 	validator, err := validate.NewValidator(cfg.Validation)
@@ -46,21 +93,74 @@ func main() {
 	// elastic logger
 	logger, err := elastic.NewElastic(cfg.Elastic)
 	fatalOnErr(err)
-	defer logger.Indexer.Close()
+	// indices (rotated ones on the fly) are created by the first log, the template gives them the keyword
+	// mappings (who, referrer, source, domain, url, ...) term aggregations rely on
+	if err := logger.PutIndexTemplate(context.Background()); err != nil {
+		log.Printf("%v", err)
+	}
 
-	// monitor sys and external events
-	go monitorEvents(rabbitHandler.NewCloseCh())
+	// blacklist file reload
+	if cfg.Validation.UrlBlackListFile != "" {
+		go reloadOnHangup(validator)
+	}
+
+	// cache invalidation consumer (runs until stopped on shutdown)
+	consumersCtx, stopConsumers := context.WithCancel(context.Background())
+	var consumers sync.WaitGroup
+	if cfg.Rabbit.Invalidation.Enabled() {
+		invalidationPool, err := rabbitmq.NewConsumerPool(cfg.Rabbit.Invalidation)
+		fatalOnErr(err)
+		consumers.Add(1)
+		go func() {
+			defer consumers.Done()
+			invalidationPool.Run(consumersCtx, invalidationHandler(validator))
+		}()
+	}
 
 	// server
 	srv, err := server.NewServer(
 		cfg.Http,
-		rabbitHandler,
+		pub,
 		validator,
 		logger)
 	fatalOnErr(err)
 
 	// run server
-	log.Fatal(srv.Up())
+	go func() {
+		if err := srv.Up(); err != nil && err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	// block until a stop signal, then let in-flight requests finish before releasing resources
+	waitForStop()
+
+	if err := srv.Down(); err != nil {
+		log.Printf("http server shutdown error: %v", err)
+	}
+	stopConsumers()
+	consumers.Wait()
+	validator.Close()
+	if err := logger.Close(); err != nil {
+		log.Printf("elastic indexer close error: %v", err)
+	}
+	pub.Close()
+	if err := shutdownTracing(); err != nil {
+		log.Printf("tracing shutdown error: %v", err)
+	}
+	log.Printf("shutdown complete")
+}
+
+// newPublisher creates the message queue backend selected by the config
+func newPublisher(cfg *Config) (publisher.Publisher, error) {
+	switch cfg.Publisher.BackendOrDefault() {
+	case publisher.BackendRabbit:
+		return rabbitmq.NewRabbitHandler(cfg.Rabbit)
+	case publisher.BackendMemory:
+		log.Printf("memory publisher backend: tasks are not delivered anywhere")
+		return publisher.NewMemory(cfg.Publisher.MemoryMaxMessages), nil
+	}
+	return nil, fmt.Errorf("unknown publisher backend: %v", cfg.Publisher.Backend)
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -75,27 +175,64 @@ func loadConfig(path string) (*Config, error) {
 		return nil, fmt.Errorf("failed to parse config file content: %v", err)
 	}
 
+	if err := applyEnvOverrides(&cfg); err != nil {
+		return nil, err
+	}
+
 	return &cfg, nil
 }
 
-func monitorEvents(closeCh <-chan *amqp.Error) {
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+// InvalidationMessage lists domains/ips to be evicted from the caches
+type InvalidationMessage struct {
+	Key  string   `json:"key"`
+	Keys []string `json:"keys"`
+}
 
-	for {
-		select {
-		case sig := <-sigCh:
-			log.Fatalf("catch signal (%v)-> stop", sig)
+func invalidationHandler(validator *validate.Validator) rabbitmq.DeliveryHandler {
+	return func(delivery amqp.Delivery) error {
+		var msg InvalidationMessage
+		if err := json.Unmarshal(delivery.Body, &msg); err != nil {
+			// a malformed message will never get valid, drop it
+			lg.Warn("invalid cache invalidation message (dropped)", lg.Fields{"body": validate.TrimBytes(delivery.Body), "error": err})
+			return nil
+		}
 
-		case err := <-closeCh:
-			log.Fatalf("amqp error (closeCh): %v", err)
+		keys := msg.Keys
+		if msg.Key != "" {
+			keys = append(keys, msg.Key)
+		}
+		for _, key := range keys {
+			if _, err := validator.EvictCaches(key); err != nil {
+				lg.Warn("invalid cache invalidation key (skipped)", lg.Fields{"key": key, "error": err})
+			}
+		}
+		return nil
+	}
+}
 
-		default:
-			time.Sleep(time.Microsecond)
+// reloadOnHangup re-reads the blacklist file on every SIGHUP, a failed reload keeps the current rules
+func reloadOnHangup(validator *validate.Validator) {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGHUP)
+
+	for range sigCh {
+		if err := validator.UrlBlacklister.Reload(); err != nil {
+			log.Printf("blacklist reload fail: %v", err)
+			continue
 		}
+		log.Printf("blacklist reloaded: %v entries", validator.UrlBlacklister.Size())
 	}
 }
 
+// waitForStop blocks until a stop signal is caught (rabbit connection loss is handled by reconnecting)
+func waitForStop() {
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-sigCh
+	log.Printf("catch signal (%v)-> shutdown", sig)
+}
+
 func fatalOnErr(err error) {
 	if err != nil {
 		log.Fatalln(err)
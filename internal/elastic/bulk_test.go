@@ -0,0 +1,116 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v6"
+)
+
+// newFakeItemServer answers every bulk item with the status and error type
+func newFakeItemServer(t *testing.T, status int, errType string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+			t.Errorf("unexpected request: %v %v", r.Method, r.URL.Path)
+		}
+		item := map[string]interface{}{"status": status}
+		if errType != "" {
+			item["error"] = map[string]interface{}{"type": errType, "reason": "rejected by the test"}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"errors": errType != "",
+			"items":  []interface{}{map[string]interface{}{"index": item}},
+		})
+	}))
+}
+
+func TestIndexFailureIsNotFatal(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      int
+		errType     string
+		wantFailed  uint64
+		wantSuccess bool
+	}{
+		{name: "indexed", status: 201, wantSuccess: true},
+		{name: "rejected", status: 400, errType: "mapper_parsing_exception", wantFailed: 1},
+		{name: "server error", status: 500, errType: "es_rejected_execution_exception", wantFailed: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newFakeItemServer(t, tt.status, tt.errType)
+			defer srv.Close()
+
+			client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			el := &Elastic{Client: client, FlushInterval: time.Hour}
+			indexer, err := el.NewBulkIndexer()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			succeeded := false
+			if err := indexer.Index("logs", LogTask{URL: "http://example.com/"}, func() { succeeded = true }); err != nil {
+				t.Fatalf("Index() error = %v", err)
+			}
+			// closing flushes the pending item, a failure must only be counted
+			if err := indexer.Close(context.Background()); err != nil {
+				t.Fatalf("Close() error = %v", err)
+			}
+
+			if got := indexer.BulkStats().NumFailed; got != tt.wantFailed {
+				t.Errorf("failed = %v, want %v", got, tt.wantFailed)
+			}
+			if succeeded != tt.wantSuccess {
+				t.Errorf("success callback called = %v, want %v", succeeded, tt.wantSuccess)
+			}
+		})
+	}
+}
+
+func TestReportBulkStatsStops(t *testing.T) {
+	srv := newFakeItemServer(t, 201, "")
+	defer srv.Close()
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{srv.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	indexer, err := (&Elastic{Client: client, FlushInterval: time.Hour}).NewBulkIndexer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		indexer.reportBulkStats(ctx, time.Millisecond)
+		close(done)
+	}()
+
+	time.Sleep(5 * time.Millisecond) // a few ticks
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("reportBulkStats still running after the cancel")
+	}
+
+	// the reporter started by the constructor is stopped on close
+	if err := indexer.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-indexer.statsDone:
+	default:
+		t.Fatal("the stats reporter is still running after Close")
+	}
+}
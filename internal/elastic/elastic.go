@@ -1,85 +1,180 @@
 package elastic
 
 import (
+	"bytes"
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
+	"net/http"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	mt "phish-api/internal/metrics"
+	"phish-api/internal/tracing"
 	"phish-api/internal/validate"
 
 	"github.com/elastic/go-elasticsearch/v6"
 	"github.com/elastic/go-elasticsearch/v6/esutil"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type ElasticConfig struct {
-	Index         string        `yaml:"index"`
-	Hosts         []string      `yaml:"hosts"`
-	UserName      string        `yaml:"username"`
-	Password      string        `yaml:"password"`
-	MaxRetries    int           `yaml:"max_retries"`
-	SleepTime     time.Duration `yaml:"sleep_time"`
-	FlushInterval time.Duration `yaml:"flush_interval"`
-	Who           string        `yaml:"who"`
+	Index    string   `yaml:"index"`
+	Hosts    []string `yaml:"hosts"`
+	UserName string   `yaml:"username"`
+	Password string   `yaml:"password"`
+	// base64 encoded api key, used instead of basic auth
+	ApiKey string `yaml:"api_key"`
+	// optional pem bundle to verify https hosts against (private ca)
+	CACert             string        `yaml:"ca_cert"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	MaxRetries         int           `yaml:"max_retries"`
+	SleepTime          time.Duration `yaml:"sleep_time"`
+	FlushInterval      time.Duration `yaml:"flush_interval"`
+	Who                string        `yaml:"who"`
+
+	// optional go time layout (e.g. 2006.01.02) appended to the index name,
+	// logs are then written to time based indices like phish-api-logs-2024.06.01
+	IndexDatePattern string `yaml:"index_date_pattern"`
+
+	// bulk indexer tuning: workers default to the number of cpus, flush bytes to 5Mb
+	NumWorkers int `yaml:"num_workers"`
+	FlushBytes int `yaml:"flush_bytes"`
+
+	// max time to flush the buffered logs on shutdown, default 10s
+	CloseTimeout time.Duration `yaml:"close_timeout"`
+
+	// resubmissions of a log failed by elastic (beyond the client retries of whole requests),
+	// backoff doubles from index_retry_backoff (default 1s); 0 = failed logs are dropped right away
+	IndexRetries      int           `yaml:"index_retries"`
+	IndexRetryBackoff time.Duration `yaml:"index_retry_backoff"`
 }
 
+const (
+	defaultCloseTimeout      = 10 * time.Second
+	defaultIndexRetryBackoff = time.Second
+)
+
 func (cfg ElasticConfig) IsValid() bool {
-	valid := true
+	errs := cfg.Errors()
+	for _, err := range errs {
+		log.Printf("%v", err)
+	}
+	return len(errs) == 0
+}
+
+// Errors lists every problem of the config
+func (cfg ElasticConfig) Errors() []string {
+	var errs []string
 	part := "[elastic validation]"
 
 	if cfg.Index == "" {
-		valid = false
-		log.Printf("%v index is invalid", part)
+		errs = append(errs, fmt.Sprintf("%v index is invalid", part))
 	}
 
 	if len(cfg.Hosts) == 0 {
-		valid = false
-		log.Printf("%v hosts list is empty", part)
+		errs = append(errs, fmt.Sprintf("%v hosts list is empty", part))
 	}
 
 	for _, host := range cfg.Hosts {
 		if !validate.IsValidUrl(host) {
-			valid = false
-			log.Printf("%v host '%v' is invalid", part, host)
+			errs = append(errs, fmt.Sprintf("%v host '%v' is invalid", part, host))
+		}
+	}
+
+	// exactly one auth method: api key or username & password
+	basicAuth := cfg.UserName != "" || cfg.Password != ""
+	switch {
+	case cfg.ApiKey != "" && basicAuth:
+		errs = append(errs, fmt.Sprintf("%v both api key and username/password are set", part))
+	case cfg.ApiKey == "" && !basicAuth:
+		errs = append(errs, fmt.Sprintf("%v no auth is set (api key or username/password)", part))
+	case basicAuth && cfg.UserName == "":
+		errs = append(errs, fmt.Sprintf("%v username is empty", part))
+	case basicAuth && cfg.Password == "":
+		errs = append(errs, fmt.Sprintf("%v password is empty", part))
+	}
+
+	if cfg.CACert != "" {
+		if _, err := loadCACert(cfg.CACert); err != nil {
+			errs = append(errs, fmt.Sprintf("%v ca cert is invalid: %v", part, err))
 		}
 	}
 
 	if cfg.MaxRetries <= 1 {
-		valid = false
-		log.Printf("%v retries count is invalid", part)
+		errs = append(errs, fmt.Sprintf("%v retries count is invalid", part))
 	}
 
 	if cfg.SleepTime < time.Millisecond {
-		valid = false
-		log.Printf("%v sleep time is invalid", part)
+		errs = append(errs, fmt.Sprintf("%v sleep time is invalid", part))
 	}
 
 	if cfg.FlushInterval < time.Millisecond {
-		valid = false
-		log.Printf("%v flush interval is invalid", part)
+		errs = append(errs, fmt.Sprintf("%v flush interval is invalid", part))
 	}
 
 	if cfg.Who == "" {
-		valid = false
-		log.Printf("%v 'who' is empty", part)
+		errs = append(errs, fmt.Sprintf("%v 'who' is empty", part))
+	}
+
+	if cfg.NumWorkers < 0 {
+		errs = append(errs, fmt.Sprintf("%v num workers is invalid", part))
 	}
 
-	return valid
+	if cfg.FlushBytes < 0 {
+		errs = append(errs, fmt.Sprintf("%v flush bytes is invalid", part))
+	}
+
+	if cfg.CloseTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("%v close timeout is invalid", part))
+	}
+
+	if cfg.IndexRetries < 0 || cfg.IndexRetryBackoff < 0 {
+		errs = append(errs, fmt.Sprintf("%v index retries are invalid", part))
+	}
+
+	if cfg.IndexDatePattern != "" && (time.Time{}).Format(cfg.IndexDatePattern) == cfg.IndexDatePattern {
+		errs = append(errs, fmt.Sprintf("%v index date pattern has no time layout elements", part))
+	}
+
+	return errs
 }
 
+var tracer = otel.Tracer("phish-api/internal/elastic")
+
 type BulkIndexer struct {
 	es   *elasticsearch.Client
 	bulk esutil.BulkIndexer
+
+	// failed items resubmission
+	indexRetries int
+	retryBackoff time.Duration
+	pendingMu    sync.Mutex
+	pending      map[*indexDoc]*time.Timer // scheduled resubmissions
+	closing      bool                      // no more resubmissions are scheduled
+	dropped      int64
+	closeMu      sync.RWMutex // guards the bulk indexer against resubmissions after it's closed
+	closed       bool
+	stopStats    context.CancelFunc
+	statsDone    chan struct{}
 }
 
 func (e *Elastic) NewBulkIndexer() (*BulkIndexer, error) {
 	bulk, err := esutil.NewBulkIndexer(esutil.BulkIndexerConfig{
 		Client:        e.Client,
 		DocumentType:  "_doc",
-		NumWorkers:    2,               // default: NumCPUs
+		NumWorkers:    e.NumWorkers,
+		FlushBytes:    e.FlushBytes,    // default: 5Mb
 		FlushInterval: e.FlushInterval, // default: 30 secs
-		// FlushBytes:    1024 * 1024,     // defaul: 5Mb
 		OnError: func(ctx context.Context, err error) {
 			log.Printf("elastic error: %s", err)
 		},
@@ -88,42 +183,86 @@ func (e *Elastic) NewBulkIndexer() (*BulkIndexer, error) {
 		log.Printf("elastic new bulk indexer fail, err: %s", err)
 		return nil, err
 	}
-	return &BulkIndexer{es: e.Client, bulk: bulk}, nil
+	indexer := &BulkIndexer{
+		es:           e.Client,
+		bulk:         bulk,
+		indexRetries: e.IndexRetries,
+		retryBackoff: e.IndexRetryBackoff,
+		pending:      make(map[*indexDoc]*time.Timer),
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	indexer.stopStats, indexer.statsDone = cancel, make(chan struct{})
+	go func() {
+		defer close(indexer.statsDone)
+		indexer.reportBulkStats(ctx, bulkStatsInterval)
+	}()
+	return indexer, nil
 }
 
-func (b *BulkIndexer) Close() error {
-	return b.bulk.Close(context.Background())
+// Close resubmits the pending items without waiting for their backoff and flushes the queued ones;
+// the items failing that last flush are dropped
+func (b *BulkIndexer) Close(ctx context.Context) error {
+	for _, doc := range b.takePending() {
+		mt.ElasticResubmittedLogs.Inc()
+		if err := b.add(ctx, doc); err != nil {
+			b.drop(doc, err.Error())
+		}
+	}
+
+	b.closeMu.Lock()
+	b.closed = true
+	b.closeMu.Unlock()
+	b.stopStats()
+	<-b.statsDone
+	return b.bulk.Close(ctx)
 }
 
 func (b *BulkIndexer) BulkStats() esutil.BulkIndexerStats {
 	return b.bulk.Stats()
 }
 
-type task struct {
-	r  io.Reader
-	sf func()
+// Dropped returns the count of items given up on (out of tries, not retryable or failed on close)
+func (b *BulkIndexer) Dropped() int64 {
+	return atomic.LoadInt64(&b.dropped)
 }
 
-func (t *task) Read(p []byte) (n int, err error) {
-	return t.r.Read(p)
+// Index queues the item, onSuccess (optional) is called once it's indexed; a failed item is
+// resubmitted (see resubmit) unless the failure is permanent
+func (b *BulkIndexer) Index(index string, itm interface{}, onSuccess func()) error {
+	body, err := json.Marshal(itm)
+	if err != nil {
+		return err
+	}
+	return b.add(context.Background(), &indexDoc{index: index, body: body, onSuccess: onSuccess})
 }
 
-func (b *BulkIndexer) Index(index string, itm interface{}, onSuccess func()) error {
-	t := task{r: esutil.NewJSONReader(itm), sf: onSuccess}
+func (b *BulkIndexer) add(ctx context.Context, doc *indexDoc) error {
 	return b.bulk.Add(
-		context.Background(),
+		ctx,
 		esutil.BulkIndexerItem{
-			Index:  index,
+			Index:  doc.index,
 			Action: "index",
-			Body:   &t,
+			Body:   bytes.NewReader(doc.body),
 			OnSuccess: func(c context.Context, bii esutil.BulkIndexerItem, biri esutil.BulkIndexerResponseItem) {
-				t := bii.Body.(*task)
-				if t.sf != nil {
-					t.sf()
+				if doc.onSuccess != nil {
+					doc.onSuccess()
 				}
 			},
 			OnFailure: func(c context.Context, bii esutil.BulkIndexerItem, biri esutil.BulkIndexerResponseItem, e error) {
-				log.Fatalf("elastic: %v", biri.Error)
+				mt.IncVec(mt.Errors, "elastic index")
+				if e != nil {
+					log.Printf("elastic index fail (try %v), err: %v", doc.tries+1, e)
+					b.resubmit(doc)
+					return
+				}
+				log.Printf("elastic index fail (try %v): %v: %v", doc.tries+1, biri.Error.Type, biri.Error.Reason)
+				if !retryableStatus(biri.Status) {
+					// e.g. a mapping error, the same document would fail again
+					b.drop(doc, "not retryable")
+					return
+				}
+				b.resubmit(doc)
 			},
 		},
 	)
@@ -135,19 +274,67 @@ type Elastic struct {
 	Index         string
 	Who           string
 	FlushInterval time.Duration
+	NumWorkers    int
+	FlushBytes    int
+	// empty if indices are not rotated
+	IndexDatePattern  string
+	CloseTimeout      time.Duration
+	IndexRetries      int
+	IndexRetryBackoff time.Duration
+
+	// guards the indexer against logs added after it's closed
+	closeMu sync.RWMutex
+	closed  bool
+}
+
+// loadCACert reads a pem bundle into a cert pool
+func loadCACert(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no pem certificates found")
+	}
+	return pool, nil
+}
+
+// newTransport returns the default transport with the configured tls settings
+func newTransport(cfg ElasticConfig) (*http.Transport, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: cfg.InsecureSkipVerify}
+	if cfg.CACert != "" {
+		pool, err := loadCACert(cfg.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("elastic ca cert (%v) fail: %v", cfg.CACert, err)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return transport, nil
 }
 
 func NewElastic(cfg ElasticConfig) (*Elastic, error) {
+	transport, err := newTransport(cfg)
+	if err != nil {
+		log.Printf("elastic fail, err: %v", err)
+		return nil, err
+	}
+
 	client, err := elasticsearch.NewClient(elasticsearch.Config{
 		Addresses:            cfg.Hosts,
 		Username:             cfg.UserName,
 		Password:             cfg.Password,
+		APIKey:               cfg.ApiKey,
+		Transport:            transport,
 		EnableRetryOnTimeout: true,
 		RetryOnStatus:        []int{429, 502, 503, 504},
 		MaxRetries:           cfg.MaxRetries,
 		RetryBackoff: func(i int) time.Duration {
 			if i == cfg.MaxRetries {
-				log.Fatalf(" elastic fail: max retries have been reached: %v", cfg.MaxRetries)
+				log.Printf("elastic fail: max retries have been reached: %v", cfg.MaxRetries)
 			}
 			log.Printf("elastic - current retry: %v", i)
 			return cfg.SleepTime
@@ -158,7 +345,17 @@ func NewElastic(cfg ElasticConfig) (*Elastic, error) {
 		return nil, err
 	}
 
-	el := &Elastic{Client: client, FlushInterval: cfg.FlushInterval}
+	numWorkers := cfg.NumWorkers
+	if numWorkers == 0 {
+		numWorkers = runtime.NumCPU()
+	}
+	el := &Elastic{
+		Client: client, FlushInterval: cfg.FlushInterval, NumWorkers: numWorkers, FlushBytes: cfg.FlushBytes,
+		IndexRetries: cfg.IndexRetries, IndexRetryBackoff: cfg.IndexRetryBackoff,
+	}
+	if el.IndexRetryBackoff == 0 {
+		el.IndexRetryBackoff = defaultIndexRetryBackoff
+	}
 
 	indexer, err := el.NewBulkIndexer()
 	if err != nil {
@@ -168,26 +365,74 @@ func NewElastic(cfg ElasticConfig) (*Elastic, error) {
 
 	el.Index = cfg.Index
 	el.Who = cfg.Who
+	el.IndexDatePattern = cfg.IndexDatePattern
+	el.CloseTimeout = cfg.CloseTimeout
+	if el.CloseTimeout == 0 {
+		el.CloseTimeout = defaultCloseTimeout
+	}
 
 	return el, nil
 }
 
 type LogTask struct {
-	When      time.Time   `json:"time"`
-	Who       string      `json:"who"`
-	StartTime time.Time   `json:"-"`
-	Referrer  string      `json:"referrer"`
-	Action    string      `json:"action"`
-	Success   bool        `json:"success"`
-	Duration  float64     `json:"duration"`
-	URL       string      `json:"url"`
-	Domain    string      `json:"domain"`
-	Source    string      `json:"source"`
-	Store     bool        `json:"store"`
-	Desc      interface{} `json:"desc,omitempty"`
-}
-
-func (el *Elastic) Log(task *LogTask) {
+	When          time.Time         `json:"time"`
+	Who           string            `json:"who"`
+	StartTime     time.Time         `json:"-"`
+	Referrer      string            `json:"referrer"`
+	Action        string            `json:"action"`
+	Success       bool              `json:"success"`
+	Duration      float64           `json:"duration"`
+	URL           string            `json:"url"`
+	OriginalURL   string            `json:"original_url,omitempty"` // as submitted, if normalization changed it
+	Domain        string            `json:"domain"`
+	Source        string            `json:"source"`
+	Store         bool              `json:"store"`
+	ExpiresAt     *time.Time        `json:"expires_at,omitempty"`
+	LandingURL    string            `json:"landing_url,omitempty"`
+	Engine        string            `json:"engine,omitempty"`
+	Verdict       *validate.Verdict `json:"verdict,omitempty"`
+	CacheBypassed bool              `json:"cache_bypassed,omitempty"`
+	Exchange      string            `json:"exchange,omitempty"`
+	RoutingKey    string            `json:"routing_key,omitempty"`
+	ExchangeFrom  string            `json:"exchange_from,omitempty"` // extra (source mapping) or main (fallback)
+	RequestID     string            `json:"request_id,omitempty"`
+	TraceID       string            `json:"trace_id,omitempty"`
+	Desc          interface{}       `json:"desc,omitempty"`
+}
+
+// Ping checks the cluster is reachable
+func (el *Elastic) Ping(ctx context.Context) error {
+	res, err := el.Client.Ping(el.Client.Ping.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return fmt.Errorf("elastic ping status: %v", res.Status())
+	}
+	return nil
+}
+
+// targetIndex returns the index a log task made at the given time goes to
+func (el *Elastic) targetIndex(when time.Time) string {
+	if el.IndexDatePattern == "" {
+		return el.Index
+	}
+	return fmt.Sprintf("%v-%v", el.Index, when.UTC().Format(el.IndexDatePattern))
+}
+
+// searchIndex returns the index (or the wildcard across rotated indices) to search logs in
+func (el *Elastic) searchIndex() string {
+	if el.IndexDatePattern == "" {
+		return el.Index
+	}
+	return el.Index + "-*"
+}
+
+// Log queues the task record for bulk indexing; its span (a child of the request span in ctx)
+// covers the queueing only, the bulk request is sent later
+func (el *Elastic) Log(ctx context.Context, task *LogTask) {
 	task.When = time.Now()
 	task.Who = el.Who
 	task.Duration = time.Since(task.StartTime).Seconds()
@@ -195,8 +440,51 @@ func (el *Elastic) Log(task *LogTask) {
 		task.Desc = fmt.Sprintf("%v", task.Desc)
 	}
 
-	err := el.Indexer.Index(el.Index, task, nil)
+	index := el.targetIndex(task.When)
+	_, span := tracer.Start(ctx, "elastic log", trace.WithAttributes(attribute.String("elastic.index", index)))
+	var err error
+	defer func() { tracing.End(span, err) }()
+
+	el.closeMu.RLock()
+	defer el.closeMu.RUnlock()
+	if el.closed {
+		err = errors.New("indexer is closed")
+		mt.IncVec(mt.Errors, "elastic log")
+		log.Printf("logging to elastic fail (indexer is closed), url: %v", task.URL)
+		return
+	}
+
+	// logging is best-effort, a failure must never affect the api response
+	err = el.Indexer.Index(index, task, nil)
 	if err != nil {
-		log.Fatalf("logging to elastic fail, url: %v, error: %v", task.URL, err)
+		mt.IncVec(mt.Errors, "elastic log")
+		log.Printf("logging to elastic fail, url: %v, error: %v", task.URL, err)
+	}
+}
+
+// Close stops accepting logs and flushes the buffered ones, giving up after the close timeout;
+// the final bulk stats are logged either way
+func (el *Elastic) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), el.CloseTimeout)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		// waits for in-flight logs, the later ones are dropped
+		el.closeMu.Lock()
+		el.closed = true
+		el.closeMu.Unlock()
+
+		done <- el.Indexer.Close(ctx)
+	}()
+
+	var err error
+	select {
+	case err = <-done:
+	case <-ctx.Done():
+		err = fmt.Errorf("elastic flush timeout (%v)", el.CloseTimeout)
 	}
+
+	log.Printf("elastic indexer closed, stats: %v, dropped: %v", BulkStatsMap(el.Indexer.BulkStats()), el.Indexer.Dropped())
+	return err
 }
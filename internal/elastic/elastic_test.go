@@ -0,0 +1,75 @@
+package elastic
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogTaskRecordsRoute(t *testing.T) {
+	tests := []struct {
+		name string
+		task LogTask
+		want map[string]interface{} // route fields of the record, absent if nil
+	}{
+		{
+			name: "published",
+			task: LogTask{Exchange: "a-ex", RoutingKey: "rk", ExchangeFrom: "extra"},
+			want: map[string]interface{}{"exchange": "a-ex", "routing_key": "rk", "exchange_from": "extra"},
+		},
+		{name: "not published", task: LogTask{}, want: map[string]interface{}{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			raw, err := json.Marshal(tt.task)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var record map[string]interface{}
+			if err := json.Unmarshal(raw, &record); err != nil {
+				t.Fatal(err)
+			}
+			for _, field := range []string{"exchange", "routing_key", "exchange_from"} {
+				if got, want := record[field], tt.want[field]; got != want {
+					t.Errorf("%v = %v, want %v", field, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestElasticConfigAuth(t *testing.T) {
+	tests := []struct {
+		name     string
+		userName string
+		password string
+		apiKey   string
+		errMsg   string // empty if the auth is valid
+	}{
+		{name: "basic auth", userName: "elastic", password: "secret"},
+		{name: "api key", apiKey: "a2V5OnNlY3JldA=="},
+		{name: "none", errMsg: "no auth is set"},
+		{name: "both", userName: "elastic", password: "secret", apiKey: "a2V5OnNlY3JldA==", errMsg: "both api key and username/password are set"},
+		{name: "password only", password: "secret", errMsg: "username is empty"},
+		{name: "username only", userName: "elastic", errMsg: "password is empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := ElasticConfig{
+				Index: "logs", Hosts: []string{"http://127.0.0.1:9200"}, Who: "test",
+				MaxRetries: 3, SleepTime: time.Second, FlushInterval: time.Second,
+				UserName: tt.userName, Password: tt.password, ApiKey: tt.apiKey,
+			}
+			errs := strings.Join(cfg.Errors(), "; ")
+			if tt.errMsg == "" && errs != "" {
+				t.Fatalf("Errors() = %v, want none", errs)
+			}
+			if !strings.Contains(errs, tt.errMsg) {
+				t.Errorf("Errors() = %v, want %q", errs, tt.errMsg)
+			}
+		})
+	}
+}
@@ -23,21 +23,71 @@ PUT phish-api-logs
             "url": {
                 "type": "keyword"
             },
+            "original_url": {
+                "type": "keyword"
+            },
+            "landing_url": {
+                "type": "keyword"
+            },
             "domain": {
                 "type": "keyword"
             },
             "source": {
                 "type": "keyword"
             },
+            "exchange": {
+                "type": "keyword"
+            },
+            "routing_key": {
+                "type": "keyword"
+            },
+            "exchange_from": {
+                "type": "keyword"
+            },
+            "cache_bypassed": {
+                "type": "boolean"
+            },
             "store": {
                 "type": "boolean"
             },
+            "verdict": {
+                "properties": {
+                    "score": {
+                        "type": "float"
+                    },
+                    "decision": {
+                        "type": "keyword"
+                    },
+                    "signals": {
+                        "properties": {
+                            "name": {
+                                "type": "keyword"
+                            },
+                            "weight": {
+                                "type": "float"
+                            }
+                        }
+                    }
+                }
+            },
+            "engine": {
+                "type": "keyword"
+            },
+            "expires_at": {
+                "type": "date"
+            },
             "success": {
                 "type": "boolean"
             },
             "duration": {
                 "type": "float"
             },
+            "request_id": {
+                "type": "keyword"
+            },
+            "trace_id": {
+                "type": "keyword"
+            },
             "desc": {
                 "type": "keyword"
             }
@@ -0,0 +1,97 @@
+package elastic
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	lg "phish-api/internal/logging"
+	mt "phish-api/internal/metrics"
+)
+
+// maxPendingResubmits bounds the failed documents kept for resubmission (memory), more are dropped
+const maxPendingResubmits = 1000
+
+// indexDoc is a queued document, kept encoded so a failed one can be resubmitted
+type indexDoc struct {
+	index     string
+	body      []byte
+	tries     int // failed tries so far
+	onSuccess func()
+}
+
+// retryableStatus tells whether an item failed for a transient reason (overload, unavailable shard)
+func retryableStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= http.StatusInternalServerError
+}
+
+// resubmit queues the failed document again after a backoff (doubling per try),
+// it's dropped once out of tries, over the pending limit or if the indexer is closing
+func (b *BulkIndexer) resubmit(doc *indexDoc) {
+	doc.tries++
+	if doc.tries > b.indexRetries {
+		b.drop(doc, "out of tries")
+		return
+	}
+
+	b.pendingMu.Lock()
+	defer b.pendingMu.Unlock()
+	if b.closing {
+		b.drop(doc, "indexer is closed")
+		return
+	}
+	if len(b.pending) >= maxPendingResubmits {
+		b.drop(doc, "too many pending resubmissions")
+		return
+	}
+
+	delay := b.retryBackoff << uint(doc.tries-1)
+	b.pending[doc] = time.AfterFunc(delay, func() {
+		b.resend(doc)
+	})
+}
+
+// resend adds the pending document back to the bulk indexer, unless Close took it over
+func (b *BulkIndexer) resend(doc *indexDoc) {
+	b.pendingMu.Lock()
+	_, found := b.pending[doc]
+	delete(b.pending, doc)
+	b.pendingMu.Unlock()
+	if !found {
+		return
+	}
+
+	b.closeMu.RLock()
+	defer b.closeMu.RUnlock()
+	if b.closed {
+		b.drop(doc, "indexer is closed")
+		return
+	}
+
+	mt.ElasticResubmittedLogs.Inc()
+	if err := b.add(context.Background(), doc); err != nil {
+		b.drop(doc, err.Error())
+	}
+}
+
+// takePending stops scheduling resubmissions and returns the pending documents, cancelling their backoff
+func (b *BulkIndexer) takePending() []*indexDoc {
+	b.pendingMu.Lock()
+	defer b.pendingMu.Unlock()
+
+	b.closing = true
+	docs := make([]*indexDoc, 0, len(b.pending))
+	for doc, timer := range b.pending {
+		timer.Stop()
+		docs = append(docs, doc)
+	}
+	b.pending = make(map[*indexDoc]*time.Timer)
+	return docs
+}
+
+func (b *BulkIndexer) drop(doc *indexDoc, reason string) {
+	atomic.AddInt64(&b.dropped, 1)
+	mt.ElasticDroppedLogs.Inc()
+	lg.Warn("elastic log dropped", lg.Fields{"index": doc.index, "tries": doc.tries, "reason": reason})
+}
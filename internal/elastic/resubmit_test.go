@@ -0,0 +1,136 @@
+package elastic
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v6"
+)
+
+func TestBulkIndexerCloseResubmitsPending(t *testing.T) {
+	tests := []struct {
+		name      string
+		failures  int // bulk requests failing the items with a 429
+		indexed   bool
+		dropped   int64
+		bulkCalls int
+	}{
+		{name: "pending item resubmitted on close", failures: 1, indexed: true, bulkCalls: 2},
+		{name: "resubmitted item failing again is dropped", failures: 2, dropped: 1, bulkCalls: 2},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			es := newFakeBulkServer(t, tt.failures)
+			defer es.Close()
+
+			client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{es.URL}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			el := &Elastic{Client: client, NumWorkers: 1, FlushInterval: 10 * time.Millisecond, IndexRetries: 3, IndexRetryBackoff: time.Hour}
+			indexer, err := el.NewBulkIndexer()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			indexed := make(chan struct{})
+			if err := indexer.Index("logs", map[string]string{"url": "http://a.com"}, func() { close(indexed) }); err != nil {
+				t.Fatal(err)
+			}
+			waitForPending(t, indexer)
+
+			// the backoff is way longer than the close timeout
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := indexer.Close(ctx); err != nil {
+				t.Fatalf("close error = %v", err)
+			}
+
+			select {
+			case <-indexed:
+				if !tt.indexed {
+					t.Error("the item was indexed")
+				}
+			default:
+				if tt.indexed {
+					t.Error("the pending item wasn't indexed on close")
+				}
+			}
+			if dropped := indexer.Dropped(); dropped != tt.dropped {
+				t.Errorf("dropped = %v, want %v", dropped, tt.dropped)
+			}
+			if calls := es.calls(); calls != tt.bulkCalls {
+				t.Errorf("bulk calls = %v, want %v", calls, tt.bulkCalls)
+			}
+		})
+	}
+}
+
+// fakeBulkServer answers the bulk requests, failing every item of the first ones with a 429
+type fakeBulkServer struct {
+	*httptest.Server
+	mu       sync.Mutex
+	n        int
+	failures int
+}
+
+func newFakeBulkServer(t *testing.T, failures int) *fakeBulkServer {
+	t.Helper()
+	s := &fakeBulkServer{failures: failures}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/_bulk") {
+			http.NotFound(w, r)
+			return
+		}
+		s.mu.Lock()
+		s.n++
+		fail := s.n <= s.failures
+		s.mu.Unlock()
+
+		var items []string
+		scanner := bufio.NewScanner(r.Body)
+		for scanner.Scan() {
+			if !strings.HasPrefix(scanner.Text(), `{"index"`) {
+				continue
+			}
+			if fail {
+				items = append(items, `{"index":{"status":429,"error":{"type":"es_rejected_execution_exception","reason":"queue is full"}}}`)
+			} else {
+				items = append(items, `{"index":{"status":201,"result":"created"}}`)
+			}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"took":1,"errors":%v,"items":[%v]}`, fail, strings.Join(items, ","))
+	}))
+	return s
+}
+
+func (s *fakeBulkServer) calls() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.n
+}
+
+// waitForPending waits until a failed item is scheduled for resubmission
+func waitForPending(t *testing.T, b *BulkIndexer) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		b.pendingMu.Lock()
+		n := len(b.pending)
+		b.pendingMu.Unlock()
+		if n > 0 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Fatal("no resubmission scheduled")
+}
@@ -0,0 +1,65 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v6/esutil"
+)
+
+type searchResponse struct {
+	Hits struct {
+		Hits []struct {
+			Source LogTask `json:"_source"`
+		} `json:"hits"`
+	} `json:"hits"`
+}
+
+// FindLastLog returns the most recent log task for the url logged since the given time,
+// or nil if there is none
+func (el *Elastic) FindLastLog(ctx context.Context, url string, since time.Time) (*LogTask, error) {
+	filters := []interface{}{
+		map[string]interface{}{"term": map[string]interface{}{"url": url}},
+	}
+	if !since.IsZero() {
+		filters = append(filters, map[string]interface{}{
+			"range": map[string]interface{}{"time": map[string]interface{}{"gte": since.Format(time.RFC3339Nano)}},
+		})
+	}
+
+	query := map[string]interface{}{
+		"query": map[string]interface{}{"bool": map[string]interface{}{"filter": filters}},
+		"sort":  []interface{}{map[string]interface{}{"time": "desc"}},
+	}
+
+	res, err := el.Client.Search(
+		el.Client.Search.WithContext(ctx),
+		el.Client.Search.WithIndex(el.searchIndex()),
+		el.Client.Search.WithIgnoreUnavailable(true),
+		el.Client.Search.WithBody(esutil.NewJSONReader(query)),
+		el.Client.Search.WithSize(1),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("elastic search fail: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return nil, errors.New(strings.TrimSpace(fmt.Sprintf("elastic search fail: %v", res.String())))
+	}
+
+	var response searchResponse
+	if err := json.NewDecoder(res.Body).Decode(&response); err != nil {
+		return nil, fmt.Errorf("elastic search fail (can't parse response): %v", err)
+	}
+
+	if len(response.Hits.Hits) == 0 {
+		return nil, nil
+	}
+	task := response.Hits.Hits[0].Source
+	return &task, nil
+}
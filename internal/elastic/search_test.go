@@ -0,0 +1,100 @@
+package elastic
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/elastic/go-elasticsearch/v6"
+)
+
+// newFakeSearchServer answers searches with the logged tasks of the searched url
+// (or with the status, if set) and records the queried urls
+func newFakeSearchServer(t *testing.T, status int, logs map[string]time.Time, queried *[]string) *httptest.Server {
+	t.Helper()
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasSuffix(r.URL.Path, "/_search") {
+			t.Errorf("unexpected request: %v %v", r.Method, r.URL.Path)
+		}
+		if status != 0 {
+			w.WriteHeader(status)
+			w.Write([]byte(`{"error": "search failed"}`))
+			return
+		}
+
+		var query struct {
+			Query struct {
+				Bool struct {
+					Filter []struct {
+						Term map[string]string `json:"term"`
+					} `json:"filter"`
+				} `json:"bool"`
+			} `json:"query"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&query); err != nil {
+			t.Errorf("can't decode the query: %v", err)
+		}
+		url := query.Query.Bool.Filter[0].Term["url"]
+		*queried = append(*queried, url)
+
+		hits := []interface{}{}
+		if when, found := logs[url]; found {
+			hits = append(hits, map[string]interface{}{"_source": LogTask{URL: url, When: when}})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"hits": map[string]interface{}{"hits": hits}})
+	}))
+}
+
+func TestFindLastLog(t *testing.T) {
+	lastSeen := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+	logs := map[string]time.Time{"http://seen.com/": lastSeen}
+
+	tests := []struct {
+		name    string
+		url     string
+		status  int
+		found   bool
+		wantErr bool
+	}{
+		{name: "logged url", url: "http://seen.com/", found: true},
+		{name: "url not logged", url: "http://new.com/"},
+		{name: "search error", url: "http://seen.com/", status: http.StatusInternalServerError, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queried []string
+			es := newFakeSearchServer(t, tt.status, logs, &queried)
+			defer es.Close()
+			client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{es.URL}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			el := &Elastic{Client: client, Index: "logs"}
+
+			task, err := el.FindLastLog(context.Background(), tt.url, time.Now().Add(-time.Hour))
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("FindLastLog = %v, want an error", task)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("FindLastLog: %v", err)
+			}
+			if len(queried) != 1 || queried[0] != tt.url {
+				t.Errorf("queried urls = %v, want %v", queried, tt.url)
+			}
+			if found := task != nil; found != tt.found {
+				t.Fatalf("found = %v, want %v", found, tt.found)
+			}
+			if tt.found && !task.When.Equal(lastSeen) {
+				t.Errorf("last seen = %v, want %v", task.When, lastSeen)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package elastic
+
+import (
+	"context"
+	"time"
+
+	mt "phish-api/internal/metrics"
+
+	"github.com/elastic/go-elasticsearch/v6/esutil"
+)
+
+var bulkStatsInterval = 15 * time.Second
+
+// BulkStatsMap returns the bulk indexer counters keyed by name
+func BulkStatsMap(stats esutil.BulkIndexerStats) map[string]uint64 {
+	return map[string]uint64{
+		"added":    stats.NumAdded,
+		"flushed":  stats.NumFlushed,
+		"failed":   stats.NumFailed,
+		"indexed":  stats.NumIndexed,
+		"created":  stats.NumCreated,
+		"updated":  stats.NumUpdated,
+		"deleted":  stats.NumDeleted,
+		"requests": stats.NumRequests,
+	}
+}
+
+// reportBulkStats periodically publishes the bulk indexer counters as gauges until ctx is done
+// (the indexer is closed)
+func (b *BulkIndexer) reportBulkStats(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for name, val := range BulkStatsMap(b.BulkStats()) {
+				mt.SetGaugeVec(mt.ElasticBulkStats, name, float64(val))
+			}
+		}
+	}
+}
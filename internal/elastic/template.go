@@ -0,0 +1,43 @@
+package elastic
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/elastic/go-elasticsearch/v6/esutil"
+)
+
+// indexTemplate holds the settings and mappings shared by all (rotated) log indices,
+// keep it in sync with queries.es
+//
+//go:embed template.json
+var indexTemplate []byte
+
+// PutIndexTemplate creates (or updates) the index template matching the log index (or the rotated ones),
+// so every new index gets the same mappings; an already existing index keeps its mappings
+func (el *Elastic) PutIndexTemplate(ctx context.Context) error {
+	var body map[string]interface{}
+	if err := json.Unmarshal(indexTemplate, &body); err != nil {
+		return fmt.Errorf("elastic index template is invalid: %v", err)
+	}
+	body["index_patterns"] = []string{el.searchIndex()}
+
+	res, err := el.Client.Indices.PutTemplate(
+		el.Index,
+		esutil.NewJSONReader(body),
+		el.Client.Indices.PutTemplate.WithContext(ctx),
+	)
+	if err != nil {
+		return fmt.Errorf("elastic put index template fail: %v", err)
+	}
+	defer res.Body.Close()
+
+	if res.IsError() {
+		return errors.New(strings.TrimSpace(fmt.Sprintf("elastic put index template fail: %v", res.String())))
+	}
+	return nil
+}
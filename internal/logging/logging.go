@@ -0,0 +1,139 @@
+package lg
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name (debug, info, warn, error), empty means info
+func ParseLevel(name string) (Level, error) {
+	if name == "" {
+		return LevelInfo, nil
+	}
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level: %q", name)
+}
+
+type LogConfig struct {
+	Level string `yaml:"level"` // debug, info (default), warn or error
+}
+
+func (cfg LogConfig) IsValid() bool {
+	errs := cfg.Errors()
+	for _, err := range errs {
+		log.Printf("%v", err)
+	}
+	return len(errs) == 0
+}
+
+// Errors lists every problem of the config
+func (cfg LogConfig) Errors() []string {
+	if _, err := ParseLevel(cfg.Level); err != nil {
+		return []string{fmt.Sprintf("[log validation] %v", err)}
+	}
+	return nil
+}
+
+// Fields are the structured context of a log entry (url, domain, referrer, action, request_id, ...)
+type Fields map[string]interface{}
+
+var (
+	mu       sync.Mutex
+	out      io.Writer = os.Stderr
+	minLevel           = LevelInfo
+)
+
+// Init sets the minimal level and routes the std logger through the json output (at info level),
+// so the remaining plain log calls produce json entries too
+func Init(cfg LogConfig) error {
+	level, err := ParseLevel(cfg.Level)
+	if err != nil {
+		return err
+	}
+
+	mu.Lock()
+	minLevel = level
+	mu.Unlock()
+
+	log.SetFlags(0)
+	log.SetOutput(stdWriter{})
+	return nil
+}
+
+// stdWriter turns std logger lines into info entries
+type stdWriter struct{}
+
+func (stdWriter) Write(p []byte) (int, error) {
+	write(LevelInfo, strings.TrimSuffix(string(p), "\n"), nil)
+	return len(p), nil
+}
+
+func write(level Level, msg string, fields Fields) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	if level < minLevel {
+		return
+	}
+
+	entry := make(map[string]interface{}, len(fields)+3)
+	for key, val := range fields {
+		if err, isErr := val.(error); isErr && err != nil {
+			val = err.Error()
+		}
+		entry[key] = val
+	}
+	entry["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	entry["level"] = level.String()
+	entry["msg"] = msg
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		line, _ = json.Marshal(map[string]string{"level": level.String(), "msg": msg, "log_error": err.Error()})
+	}
+	out.Write(append(line, '\n'))
+}
+
+func Debug(msg string, fields Fields) { write(LevelDebug, msg, fields) }
+
+func Info(msg string, fields Fields) { write(LevelInfo, msg, fields) }
+
+func Warn(msg string, fields Fields) { write(LevelWarn, msg, fields) }
+
+func Error(msg string, fields Fields) { write(LevelError, msg, fields) }
+
+// Fatal logs the entry and exits
+func Fatal(msg string, fields Fields) {
+	write(LevelError, msg, fields)
+	os.Exit(1)
+}
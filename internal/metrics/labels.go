@@ -0,0 +1,79 @@
+package mt
+
+import (
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// UnmatchedRoute labels requests that didn't match any route
+	UnmatchedRoute = "unmatched"
+	// OverflowLabel replaces label values past the per metric limit (and unknown http methods)
+	OverflowLabel = "other"
+)
+
+var (
+	knownMethods = map[string]bool{
+		http.MethodGet:     true,
+		http.MethodHead:    true,
+		http.MethodPost:    true,
+		http.MethodPut:     true,
+		http.MethodPatch:   true,
+		http.MethodDelete:  true,
+		http.MethodOptions: true,
+	}
+
+	labelsMu       sync.Mutex
+	maxLabelValues int // 0 = unlimited
+	labelValues    = map[prometheus.Collector]map[string]bool{}
+)
+
+// SetMaxLabelValues limits the distinct label values kept per metric, later new values are
+// counted as OverflowLabel; a safety net against a label accidentally fed unbounded values
+func SetMaxLabelValues(max int) {
+	labelsMu.Lock()
+	defer labelsMu.Unlock()
+	maxLabelValues = max
+}
+
+// RouteLabel turns a gin route template (c.FullPath(), e.g. /v1/url/:id) into a route label,
+// so arbitrary (unmatched) paths share a single label value
+func RouteLabel(route string) string {
+	if route == "" {
+		return UnmatchedRoute
+	}
+	return route
+}
+
+// MethodLabel keeps the standard http methods, anything else is OverflowLabel
+func MethodLabel(method string) string {
+	if knownMethods[method] {
+		return method
+	}
+	return OverflowLabel
+}
+
+// limitLabel passes known values and new ones while the metric is under the limit
+func limitLabel(metric prometheus.Collector, val string) string {
+	labelsMu.Lock()
+	defer labelsMu.Unlock()
+	if maxLabelValues <= 0 {
+		return val
+	}
+
+	seen, ok := labelValues[metric]
+	if !ok {
+		seen = make(map[string]bool)
+		labelValues[metric] = seen
+	}
+	if seen[val] {
+		return val
+	}
+	if len(seen) >= maxLabelValues {
+		return OverflowLabel
+	}
+	seen[val] = true
+	return val
+}
@@ -1,29 +1,235 @@
 package mt
 
 import (
+	"sync"
+
 	"github.com/gin-gonic/gin"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
 )
 
 var (
-	registry    *prometheus.Registry
-	statusLabel = "status" // default label
-	labels      = map[*prometheus.CounterVec]string{
-		ResponseStatuses: statusLabel,
-	}
+	registry     *prometheus.Registry
+	registryOnce sync.Once
 
-	ResponseStatuses = prometheus.NewCounterVec(
+	// labels must be bounded sets (statuses, exchanges, config names, ...), never urls, domains or ids
+	statusLabel  = "status" // default label
+	workerLabel  = "worker"
+	sourceLabel  = "source"
+	cacheLabel   = "cache"
+	fncLabel     = "fnc"
+	resultLabel  = "result"
+	routeLabel   = "route"
+	methodLabel  = "method"
+	outcomeLabel = "outcome"
+	statLabel    = "stat"
+	storeLabel   = "store"
+	exchLabel    = "exchange"
+	checkLabel   = "check"
+	// label of every single label vec, filled by the constructors below
+	labels      = map[*prometheus.CounterVec]string{}
+	histLabels  = map[*prometheus.HistogramVec]string{}
+	gaugeLabels = map[*prometheus.GaugeVec]string{}
+
+	ResponseStatuses = newCounterVec(
 		prometheus.CounterOpts{
 			Name: "response_statuses",
 		},
-		[]string{statusLabel},
+		statusLabel,
+	)
+
+	Errors = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "errors",
+		},
+		fncLabel,
+	)
+
+	DnsLookupDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "dns_lookup_seconds",
+		},
+	)
+
+	DnsLookupFailures = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dns_lookup_failures",
+		},
+	)
+
+	WhitelisterCache = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "whitelister_cache",
+		},
+		resultLabel,
+	)
+
+	// whitelister lookups: white, not_white, cache_hit, error (no result / cancelled) and retry (per retried api call)
+	WhitelisterChecks = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "whitelister_checks",
+		},
+		outcomeLabel,
+	)
+
+	// whitelister api call duration by check (domain, ip, bulk, ping), failed calls included
+	WhitelisterRequestDuration = newHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "whitelister_request_seconds",
+			Buckets: prometheus.ExponentialBuckets(0.005, 2, 12),
+		},
+		checkLabel,
+	)
+
+	// blacklisted, whitelisted, no_a_record, local_ip, needs_processing or error
+	ValidationOutcomes = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "validation_outcomes",
+		},
+		outcomeLabel,
+	)
+
+	// urls that passed validation, published (store=false) or only stored (store=true)
+	AcceptedUrls = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "accepted_urls",
+		},
+		storeLabel,
+	)
+
+	// tasks published to rabbit / failed to publish, by exchange
+	PublishedMessages = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "rabbit_published_messages",
+		},
+		exchLabel,
+	)
+
+	PublishFailures = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "rabbit_publish_failures",
+		},
+		exchLabel,
+	)
+
+	// unroutable messages returned by rabbit (mandatory publish)
+	ReturnedMessages = newCounterVec(
+		prometheus.CounterOpts{
+			Name: "rabbit_returned_messages",
+		},
+		exchLabel,
+	)
+
+	ExpiredMessages = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "consumer_expired_messages",
+		},
+	)
+
+	// tasks rejected as their source has no exchange mapping (strict sources)
+	UnknownSources = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "unknown_sources",
+		},
+	)
+
+	// add url requests dropped as duplicates of a recently published url
+	DedupHits = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "dedup_hits",
+		},
+	)
+
+	// logs failed by elastic and queued again / given up on
+	ElasticResubmittedLogs = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "elastic_resubmitted_logs",
+		},
+	)
+
+	ElasticDroppedLogs = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "elastic_dropped_logs",
+		},
+	)
+
+	CacheInvalidations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "cache_invalidations",
+		},
+	)
+
+	// 0 - closed, 1 - open, 2 - half-open
+	WhitelisterBreaker = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "whitelister_breaker_state",
+		},
+	)
+
+	WhitelisterInFlight = newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "whitelister_in_flight",
+		},
+		sourceLabel,
+	)
+
+	CacheItems = newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "cache_items",
+		},
+		cacheLabel,
+	)
+
+	// bulk indexer counters (added, flushed, failed, ...), a growing added - flushed is a backlog
+	ElasticBulkStats = newGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "elastic_bulk_stats",
+		},
+		statLabel,
+	)
+
+	ConsumerLatency = newHistogramVec(
+		prometheus.HistogramOpts{
+			Name: "consumer_processing_seconds",
+		},
+		workerLabel,
+	)
+
+	// 1ms .. ~4s, validation requests are mostly served from caches
+	RequestDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "request_duration_seconds",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 13),
+		},
+		[]string{routeLabel, methodLabel},
 	)
 )
 
+// newCounterVec creates a counter vec with a single (fixed) label, IncVec fills it in
+func newCounterVec(opts prometheus.CounterOpts, label string) *prometheus.CounterVec {
+	metric := prometheus.NewCounterVec(opts, []string{label})
+	labels[metric] = label
+	return metric
+}
+
+// newGaugeVec creates a gauge vec with a single (fixed) label, *GaugeVec helpers fill it in
+func newGaugeVec(opts prometheus.GaugeOpts, label string) *prometheus.GaugeVec {
+	metric := prometheus.NewGaugeVec(opts, []string{label})
+	gaugeLabels[metric] = label
+	return metric
+}
+
+// newHistogramVec creates a histogram vec with a single (fixed) label, ObserveVec fills it in
+func newHistogramVec(opts prometheus.HistogramOpts, label string) *prometheus.HistogramVec {
+	metric := prometheus.NewHistogramVec(opts, []string{label})
+	histLabels[metric] = label
+	return metric
+}
+
 func IncVec(metric *prometheus.CounterVec, val string) {
 	label := getMetricLabel(metric)
-	metric.With(prometheus.Labels{label: val}).Inc()
+	metric.With(prometheus.Labels{label: limitLabel(metric, val)}).Inc()
 }
 
 func getMetricLabel(metric *prometheus.CounterVec) string {
@@ -34,15 +240,101 @@ func getMetricLabel(metric *prometheus.CounterVec) string {
 	return statusLabel
 }
 
+func ObserveVec(metric *prometheus.HistogramVec, val string, seconds float64) {
+	label, isInLabels := histLabels[metric]
+	if !isInLabels {
+		label = statusLabel
+	}
+	metric.With(prometheus.Labels{label: limitLabel(metric, val)}).Observe(seconds)
+}
+
+// ObserveRequest records a request duration, route must be the route template (gin FullPath),
+// not the resolved path, see RouteLabel
+func ObserveRequest(route, method string, seconds float64) {
+	RequestDuration.With(prometheus.Labels{
+		routeLabel:  limitLabel(RequestDuration, RouteLabel(route)),
+		methodLabel: MethodLabel(method),
+	}).Observe(seconds)
+}
+
+func IncGaugeVec(metric *prometheus.GaugeVec, val string) {
+	metric.With(prometheus.Labels{getGaugeLabel(metric): limitLabel(metric, val)}).Inc()
+}
+
+func DecGaugeVec(metric *prometheus.GaugeVec, val string) {
+	metric.With(prometheus.Labels{getGaugeLabel(metric): limitLabel(metric, val)}).Dec()
+}
+
+func SetGaugeVec(metric *prometheus.GaugeVec, val string, value float64) {
+	metric.With(prometheus.Labels{getGaugeLabel(metric): limitLabel(metric, val)}).Set(value)
+}
+
+func getGaugeLabel(metric *prometheus.GaugeVec) string {
+	label, isInLabels := gaugeLabels[metric]
+	if isInLabels {
+		return label
+	}
+	return statusLabel
+}
+
 func PrometheusHandler() gin.HandlerFunc {
-	registerMetrics()
+	registryOnce.Do(registerMetrics)
 	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 	return func(c *gin.Context) {
-		h.ServeHTTP(c.Writer, c.Request)
+		// optional filtering by metric family names: /metrics?name[]=a&name[]=b
+		names := c.QueryArray("name[]")
+		if len(names) == 0 {
+			h.ServeHTTP(c.Writer, c.Request)
+			return
+		}
+		promhttp.HandlerFor(filteredGatherer(names), promhttp.HandlerOpts{}).ServeHTTP(c.Writer, c.Request)
 	}
 }
 
+// filteredGatherer gathers only the metric families with the given names
+func filteredGatherer(names []string) prometheus.Gatherer {
+	wanted := make(map[string]bool, len(names))
+	for _, name := range names {
+		wanted[name] = true
+	}
+
+	return prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+		families, err := registry.Gather()
+		var filtered []*dto.MetricFamily
+		for _, family := range families {
+			if wanted[family.GetName()] {
+				filtered = append(filtered, family)
+			}
+		}
+		return filtered, err
+	})
+}
+
+// registerMetrics creates the registry, it must run exactly once (MustRegister panics on duplicates)
 func registerMetrics() {
 	registry = prometheus.NewRegistry()
 	registry.MustRegister(ResponseStatuses)
+	registry.MustRegister(RequestDuration)
+	registry.MustRegister(Errors)
+	registry.MustRegister(WhitelisterCache)
+	registry.MustRegister(WhitelisterChecks)
+	registry.MustRegister(WhitelisterRequestDuration)
+	registry.MustRegister(ValidationOutcomes)
+	registry.MustRegister(AcceptedUrls)
+	registry.MustRegister(DnsLookupDuration)
+	registry.MustRegister(DnsLookupFailures)
+	registry.MustRegister(ConsumerLatency)
+	registry.MustRegister(ExpiredMessages)
+	registry.MustRegister(ReturnedMessages)
+	registry.MustRegister(PublishedMessages)
+	registry.MustRegister(PublishFailures)
+	registry.MustRegister(WhitelisterInFlight)
+	registry.MustRegister(WhitelisterBreaker)
+	registry.MustRegister(CacheItems)
+	registry.MustRegister(ElasticBulkStats)
+	registry.MustRegister(ElasticResubmittedLogs)
+	registry.MustRegister(ElasticDroppedLogs)
+	registry.MustRegister(CacheInvalidations)
+	registry.MustRegister(DedupHits)
+	registry.MustRegister(UnknownSources)
 }
@@ -0,0 +1,83 @@
+package publisher
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+const defaultMemoryMaxMessages = 1000
+
+// Message is a task recorded by the memory publisher
+type Message struct {
+	Source     string
+	RoutingKey string
+	Headers    map[string]string
+	Body       []byte
+	Audit      bool
+	Time       time.Time
+}
+
+// Memory keeps published messages in memory (local development, handler tests),
+// only the latest maxMessages are kept
+type Memory struct {
+	sync.Mutex
+	messages    []Message
+	maxMessages int
+}
+
+var _ Publisher = (*Memory)(nil)
+
+func NewMemory(maxMessages int) *Memory {
+	if maxMessages <= 0 {
+		maxMessages = defaultMemoryMaxMessages
+	}
+	return &Memory{maxMessages: maxMessages}
+}
+
+func (m *Memory) Publish(ctx context.Context, source, routingKey string, headers map[string]string, body []byte) (Route, error) {
+	span, msgHeaders := StartSpan(ctx, BackendMemory, source, headers)
+	msgHeaders[SourceHeader] = source
+
+	m.add(Message{Source: source, RoutingKey: routingKey, Headers: msgHeaders, Body: body, Time: time.Now()})
+	route := Route{Exchange: BackendMemory, RoutingKey: routingKey, ExchangeFrom: BackendMemory}
+	EndSpan(span, route, nil)
+	return route, nil
+}
+
+func (m *Memory) PublishAudit(body []byte) {
+	m.add(Message{Body: body, Audit: true, Time: time.Now()})
+}
+
+func (m *Memory) add(msg Message) {
+	m.Lock()
+	defer m.Unlock()
+	if len(m.messages) >= m.maxMessages {
+		m.messages = append(m.messages[:0], m.messages[len(m.messages)-m.maxMessages+1:]...)
+	}
+	m.messages = append(m.messages, msg)
+}
+
+// Messages returns a copy of the recorded messages, oldest first
+func (m *Memory) Messages() []Message {
+	m.Lock()
+	defer m.Unlock()
+	return append([]Message(nil), m.messages...)
+}
+
+// Reset drops the recorded messages
+func (m *Memory) Reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.messages = nil
+}
+
+func (m *Memory) Connected() bool {
+	return true
+}
+
+func (m *Memory) Backend() string {
+	return BackendMemory
+}
+
+func (m *Memory) Close() {}
@@ -0,0 +1,74 @@
+package publisher
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// message queue backends
+const (
+	BackendRabbit string = "rabbit"
+	BackendMemory string = "memory" // kept in memory, nothing is delivered (local development, tests)
+)
+
+// message headers set by the api
+const (
+	RequestIDHeader   = "X-Request-ID" // id of the api request that published the message
+	SourceHeader      = "X-Source"     // task source
+	TraceparentHeader = "traceparent"  // w3c trace context of the publish span (see StartSpan)
+	ExpiresAtHeader   = "expires_at"   // RFC3339 expiry of the task, backends may drop it afterwards
+)
+
+var (
+	ErrNotConnected  = errors.New("publisher is not connected")
+	ErrUnknownSource = errors.New("unknown task source") // no destination is mapped to the source (strict sources)
+)
+
+// Publisher publishes add url tasks to a message queue backend (rabbit, ...)
+type Publisher interface {
+	// Publish pushes a task to the destination of the source (and routing key, if supported),
+	// headers are passed on as message headers along with the trace context of ctx
+	Publish(ctx context.Context, source, routingKey string, headers map[string]string, body []byte) (Route, error)
+	// PublishAudit publishes an audit event (best-effort, no-op if not configured)
+	PublishAudit(body []byte)
+	// Connected reports whether the backend can currently publish
+	Connected() bool
+	// Backend is the backend name (see Backend* constants)
+	Backend() string
+	Close()
+}
+
+// Route describes where a message was actually published
+type Route struct {
+	Exchange     string // exchange / topic
+	RoutingKey   string
+	ExchangeFrom string // how the exchange was picked (backend specific)
+}
+
+type Config struct {
+	// rabbit (default) or memory
+	Backend string `yaml:"backend"`
+	// messages kept by the memory backend, default: 1000
+	MemoryMaxMessages int `yaml:"memory_max_messages"`
+}
+
+func (c Config) BackendOrDefault() string {
+	if c.Backend == "" {
+		return BackendRabbit
+	}
+	return c.Backend
+}
+
+func (c Config) Errors() []string {
+	var errs []string
+	switch c.BackendOrDefault() {
+	case BackendRabbit, BackendMemory:
+	default:
+		errs = append(errs, fmt.Sprintf("publisher config invalid val: 'backend' (%v)", c.Backend))
+	}
+	if c.MemoryMaxMessages < 0 {
+		errs = append(errs, "publisher config invalid val: 'memory_max_messages'")
+	}
+	return errs
+}
@@ -0,0 +1,39 @@
+package publisher
+
+import (
+	"context"
+
+	"phish-api/internal/tracing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("phish-api/internal/publisher")
+
+// StartSpan starts the producer span of a published task and returns a copy of the headers carrying
+// its trace context (the traceparent header), so the consumers continue the trace from it
+func StartSpan(ctx context.Context, backend, source string, headers map[string]string) (trace.Span, map[string]string) {
+	ctx, span := tracer.Start(ctx, "publish", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(
+		attribute.String("messaging.system", backend),
+		attribute.String("task.source", source),
+	))
+
+	msgHeaders := make(map[string]string, len(headers)+2)
+	for key, val := range headers {
+		msgHeaders[key] = val
+	}
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(msgHeaders))
+	return span, msgHeaders
+}
+
+// EndSpan ends the publish span with the route the task went to
+func EndSpan(span trace.Span, route Route, err error) {
+	span.SetAttributes(
+		attribute.String("messaging.destination", route.Exchange),
+		attribute.String("messaging.rabbitmq.routing_key", route.RoutingKey),
+	)
+	tracing.End(span, err)
+}
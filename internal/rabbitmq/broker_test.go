@@ -0,0 +1,286 @@
+package rabbitmq
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBroker speaks just enough amqp 0-9-1 for the handler and consumer: the connection handshake,
+// channel open / close, qos, exchange declare, confirm select, consume / cancel and publishes
+// (acked in confirm mode). Publishes to an exchange in returnExchanges are returned (basic.return).
+type fakeBroker struct {
+	ln net.Listener
+
+	mu              sync.Mutex
+	opened, closed  int
+	published       []string // exchanges, in publish order
+	returnExchanges map[string]bool
+}
+
+func newFakeBroker(t *testing.T, returnExchanges ...string) *fakeBroker {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &fakeBroker{ln: ln, returnExchanges: map[string]bool{}}
+	for _, exch := range returnExchanges {
+		b.returnExchanges[exch] = true
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			b.mu.Lock()
+			b.opened++
+			b.mu.Unlock()
+			go b.serve(conn)
+		}
+	}()
+	return b
+}
+
+func (b *fakeBroker) dsn() string {
+	return fmt.Sprintf("amqp://guest:guest@%v/", b.ln.Addr())
+}
+
+// open returns the number of connections not closed yet
+func (b *fakeBroker) open() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.opened - b.closed
+}
+
+func (b *fakeBroker) publishedTo() []string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]string(nil), b.published...)
+}
+
+// waitOpen waits (up to a second) for the number of open connections to settle at want
+func (b *fakeBroker) waitOpen(t *testing.T, want int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for b.open() != want {
+		if time.Now().After(deadline) {
+			t.Fatalf("open connections = %v, want %v", b.open(), want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+const (
+	frameMethod    = 1
+	frameHeader    = 2
+	frameBody      = 3
+	frameHeartbeat = 8
+	frameEnd       = 0xCE
+)
+
+type frame struct {
+	typ     byte
+	channel uint16
+	payload []byte
+}
+
+func (b *fakeBroker) serve(conn net.Conn) {
+	defer func() {
+		conn.Close()
+		b.mu.Lock()
+		b.closed++
+		b.mu.Unlock()
+	}()
+
+	r := bufio.NewReader(conn)
+	header := make([]byte, 8) // "AMQP" 0 0 9 1
+	if _, err := io.ReadFull(r, header); err != nil {
+		return
+	}
+
+	send := func(typ byte, channel uint16, payload []byte) error {
+		buf := new(bytes.Buffer)
+		buf.WriteByte(typ)
+		binary.Write(buf, binary.BigEndian, channel)
+		binary.Write(buf, binary.BigEndian, uint32(len(payload)))
+		buf.Write(payload)
+		buf.WriteByte(frameEnd)
+		_, err := conn.Write(buf.Bytes())
+		return err
+	}
+	method := func(channel uint16, class, id uint16, args ...interface{}) error {
+		return send(frameMethod, channel, encodeMethod(class, id, args...))
+	}
+
+	if method(0, 10, 10, uint8(0), uint8(9), uint32(0), longStr("PLAIN"), longStr("en_US")) != nil { // start
+		return
+	}
+
+	confirming := map[uint16]bool{}
+	deliveryTags := map[uint16]uint64{}
+	var publishing struct {
+		channel            uint16
+		exchange, key      string
+		bodySize, received uint64
+	}
+
+	for {
+		f, err := readFrame(r)
+		if err != nil {
+			return
+		}
+
+		switch f.typ {
+		case frameHeartbeat:
+			continue
+
+		case frameHeader:
+			// class, weight, body size
+			publishing.bodySize = binary.BigEndian.Uint64(f.payload[4:12])
+			publishing.received = 0
+			if publishing.bodySize > 0 {
+				continue
+			}
+
+		case frameBody:
+			publishing.received += uint64(len(f.payload))
+			if publishing.received < publishing.bodySize {
+				continue
+			}
+
+		case frameMethod:
+			class := binary.BigEndian.Uint16(f.payload[0:2])
+			id := binary.BigEndian.Uint16(f.payload[2:4])
+			args := bytes.NewReader(f.payload[4:])
+
+			switch {
+			case class == 10 && id == 11: // start-ok
+				err = method(0, 10, 30, uint16(0), uint32(131072), uint16(0)) // tune
+			case class == 10 && id == 31: // tune-ok
+			case class == 10 && id == 40: // open
+				err = method(0, 10, 41, shortStr(""))
+			case class == 10 && id == 50: // close, the client drops the connection on close-ok
+				err = method(0, 10, 51)
+			case class == 20 && id == 10: // channel open
+				err = method(f.channel, 20, 11, longStr(""))
+			case class == 20 && id == 40: // channel close
+				err = method(f.channel, 20, 41)
+			case class == 40 && id == 10: // exchange declare
+				err = method(f.channel, 40, 11)
+			case class == 60 && id == 10: // qos
+				err = method(f.channel, 60, 11)
+			case class == 60 && id == 20: // consume
+				readShort(args)
+				readShortStr(args) // queue
+				err = method(f.channel, 60, 21, shortStr(readShortStr(args)))
+			case class == 60 && id == 30: // cancel
+				err = method(f.channel, 60, 31, shortStr(readShortStr(args)))
+			case class == 85 && id == 10: // confirm select
+				confirming[f.channel] = true
+				err = method(f.channel, 85, 11)
+			case class == 60 && id == 40: // publish, the content frames follow
+				readShort(args)
+				publishing.channel = f.channel
+				publishing.exchange = readShortStr(args)
+				publishing.key = readShortStr(args)
+				continue
+			}
+			if err != nil {
+				return
+			}
+			continue
+		}
+
+		// a complete publish
+		b.mu.Lock()
+		b.published = append(b.published, publishing.exchange)
+		returned := b.returnExchanges[publishing.exchange]
+		b.mu.Unlock()
+
+		if returned {
+			if method(publishing.channel, 60, 50, uint16(312), shortStr("NO_ROUTE"), shortStr(publishing.exchange), shortStr(publishing.key)) != nil {
+				return
+			}
+			// empty properties and body
+			if send(frameHeader, publishing.channel, encodeArgs(uint16(60), uint16(0), uint64(0), uint16(0))) != nil {
+				return
+			}
+		}
+		if confirming[publishing.channel] {
+			deliveryTags[publishing.channel]++
+			if method(publishing.channel, 60, 80, deliveryTags[publishing.channel], uint8(0)) != nil { // ack
+				return
+			}
+		}
+	}
+}
+
+func readFrame(r *bufio.Reader) (frame, error) {
+	var head [7]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil {
+		return frame{}, err
+	}
+	f := frame{typ: head[0], channel: binary.BigEndian.Uint16(head[1:3])}
+	f.payload = make([]byte, binary.BigEndian.Uint32(head[3:7]))
+	if _, err := io.ReadFull(r, f.payload); err != nil {
+		return frame{}, err
+	}
+	end, err := r.ReadByte()
+	if err != nil {
+		return frame{}, err
+	}
+	if end != frameEnd {
+		return frame{}, fmt.Errorf("bad frame end: %x", end)
+	}
+	return f, nil
+}
+
+type shortStr string
+type longStr string
+
+func encodeMethod(class, id uint16, args ...interface{}) []byte {
+	return encodeArgs(append([]interface{}{class, id}, args...)...)
+}
+
+func encodeArgs(args ...interface{}) []byte {
+	buf := new(bytes.Buffer)
+	for _, arg := range args {
+		switch v := arg.(type) {
+		case shortStr:
+			buf.WriteByte(byte(len(v)))
+			buf.WriteString(string(v))
+		case longStr:
+			binary.Write(buf, binary.BigEndian, uint32(len(v)))
+			buf.WriteString(string(v))
+		default:
+			binary.Write(buf, binary.BigEndian, v)
+		}
+	}
+	return buf.Bytes()
+}
+
+func readShort(r *bytes.Reader) uint16 {
+	var v uint16
+	binary.Read(r, binary.BigEndian, &v)
+	return v
+}
+
+func readShortStr(r *bytes.Reader) string {
+	size, err := r.ReadByte()
+	if err != nil {
+		return ""
+	}
+	s := make([]byte, size)
+	io.ReadFull(r, s)
+	return string(s)
+}
@@ -0,0 +1,271 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	lg "phish-api/internal/logging"
+	mt "phish-api/internal/metrics"
+	"phish-api/internal/publisher"
+
+	"github.com/streadway/amqp"
+)
+
+const (
+	expiresAtHeader string = publisher.ExpiresAtHeader
+	// consumer tags are per channel, a fixed one lets the shutdown cancel the consumer
+	consumerTag string = "phish-api"
+)
+
+type ConsumerConfig struct {
+	Dsn         string `yaml:"dsn"`
+	Queue       string `yaml:"queue"`
+	Prefetch    int    `yaml:"prefetch"`
+	Concurrency int    `yaml:"concurrency"`
+	// nack failed messages with requeue (default) or drop / dead-letter them
+	RequeueOnError *bool           `yaml:"requeue_on_error"`
+	Reconnect      ReconnectConfig `yaml:"reconnect"`
+}
+
+func (cfg *ConsumerConfig) requeueOnError() bool {
+	return cfg.RequeueOnError == nil || *cfg.RequeueOnError
+}
+
+// Enabled reports whether the consumer section is configured at all
+func (cfg *ConsumerConfig) Enabled() bool {
+	return cfg.Queue != ""
+}
+
+func (cfg *ConsumerConfig) IsValid() bool {
+	errs := cfg.Errors()
+	for _, err := range errs {
+		log.Printf("%v", err)
+	}
+	return len(errs) == 0
+}
+
+// Errors lists every problem of the config
+func (cfg *ConsumerConfig) Errors() []string {
+	var errs []string
+	cfgName := "consumer rabbit"
+
+	if !cfg.Enabled() {
+		return nil
+	}
+
+	if cfg.Dsn == "" {
+		errs = append(errs, fmt.Sprintf("%v dsn is invalid", cfgName))
+	}
+
+	if cfg.Prefetch < 1 {
+		errs = append(errs, fmt.Sprintf("%v prefetch is invalid (must be >= 1)", cfgName))
+	}
+
+	if cfg.Concurrency < 1 {
+		errs = append(errs, fmt.Sprintf("%v concurrency is invalid (must be >= 1)", cfgName))
+	}
+
+	if cfg.Reconnect.InitialDelay < 0 || cfg.Reconnect.MaxDelay < 0 {
+		errs = append(errs, fmt.Sprintf("%v reconnect delays are invalid", cfgName))
+	}
+	return errs
+}
+
+// DeliveryHandler processes a single delivery; a nil error acks it, otherwise it's nacked
+// (and requeued, unless disabled)
+type DeliveryHandler func(amqp.Delivery) error
+
+type ConsumerPool struct {
+	sync.Mutex  // guards the channel swap on reconnect
+	Ch          *RabbitChannel
+	Queue       string
+	Concurrency int
+
+	dsn          string
+	prefetch     int
+	requeue      bool
+	reconnectCfg ReconnectConfig
+}
+
+func NewConsumerPool(cfg ConsumerConfig) (*ConsumerPool, error) {
+	if !cfg.Enabled() || !cfg.IsValid() {
+		return nil, errors.New("rabbit consumer cfg is invalid")
+	}
+
+	ch, err := NewConsumer(cfg.Dsn, cfg.Prefetch)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := &ConsumerPool{
+		Ch:           ch,
+		Queue:        cfg.Queue,
+		Concurrency:  cfg.Concurrency,
+		dsn:          cfg.Dsn,
+		prefetch:     cfg.Prefetch,
+		requeue:      cfg.requeueOnError(),
+		reconnectCfg: cfg.Reconnect.withDefaults(),
+	}
+	return pool, nil
+}
+
+// Run consumes the queue until ctx is done, a lost channel is re-opened (with capped exponential backoff).
+// On shutdown the consumer is cancelled (no new deliveries), the workers finish (ack / nack) their current
+// messages and only then the channel is closed
+func (p *ConsumerPool) Run(ctx context.Context, handler DeliveryHandler) {
+	defer p.Close()
+
+	for {
+		p.consume(ctx, handler)
+
+		if ctx.Err() != nil {
+			lg.Info("rabbit consumer stopped", lg.Fields{"queue": p.Queue})
+			return
+		}
+		if !p.reopen(ctx) {
+			return
+		}
+	}
+}
+
+// consume runs the workers on the current channel until its deliveries stop: the channel is lost
+// or the consumer is cancelled once ctx is done
+func (p *ConsumerPool) consume(ctx context.Context, handler DeliveryHandler) {
+	ch := p.channel()
+	deliveries, err := ch.Consume(p.Queue, consumerTag)
+	if err != nil {
+		lg.Error("rabbit consumer failed to consume", lg.Fields{"queue": p.Queue, "error": err})
+		return
+	}
+
+	stopped := make(chan struct{})
+	defer close(stopped)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// the broker stops sending and the deliveries channel is closed once the cancel is confirmed
+			if err := ch.Cancel(consumerTag); err != nil {
+				lg.Warn("rabbit consumer cancel fail", lg.Fields{"queue": p.Queue, "error": err})
+			}
+		case <-stopped:
+		}
+	}()
+
+	p.runWorkers(deliveries, handler)
+}
+
+func (p *ConsumerPool) channel() *RabbitChannel {
+	p.Lock()
+	defer p.Unlock()
+	return p.Ch
+}
+
+// reopen re-dials the dsn until it succeeds (true) or ctx is done (false)
+func (p *ConsumerPool) reopen(ctx context.Context) bool {
+	delay := p.reconnectCfg.InitialDelay
+	for try := 1; ; try++ {
+		select {
+		case <-ctx.Done():
+			return false
+		case <-time.After(delay):
+		}
+
+		ch, err := NewConsumer(p.dsn, p.prefetch)
+		if err != nil {
+			lg.Warn("rabbit consumer reconnect fail", lg.Fields{"queue": p.Queue, "try": try, "next_in": delay.String(), "error": err})
+			delay *= 2
+			if delay > p.reconnectCfg.MaxDelay {
+				delay = p.reconnectCfg.MaxDelay
+			}
+			continue
+		}
+
+		// the lost channel's connection may still be open (e.g. only the channel was closed by the broker)
+		p.Lock()
+		old := p.Ch
+		p.Ch = ch
+		p.Unlock()
+		old.Close()
+
+		// shutting down meanwhile, Run closes the new channel
+		if ctx.Err() != nil {
+			return false
+		}
+		lg.Info("rabbit consumer reconnected", lg.Fields{"queue": p.Queue, "tries": try})
+		return true
+	}
+}
+
+// runWorkers starts the configured number of workers and blocks until the delivery channel is closed
+func (p *ConsumerPool) runWorkers(deliveries <-chan amqp.Delivery, handler DeliveryHandler) {
+	var wg sync.WaitGroup
+	for i := 1; i <= p.Concurrency; i++ {
+		wg.Add(1)
+		go func(worker string) {
+			defer wg.Done()
+			p.work(worker, deliveries, handler)
+		}(fmt.Sprintf("%v", i))
+	}
+	lg.Info("rabbit consumer workers started", lg.Fields{"queue": p.Queue, "workers": p.Concurrency})
+
+	wg.Wait()
+	lg.Info("rabbit consumer workers stopped", lg.Fields{"queue": p.Queue})
+}
+
+func (p *ConsumerPool) Close() {
+	p.channel().Close()
+}
+
+func (p *ConsumerPool) work(worker string, deliveries <-chan amqp.Delivery, handler DeliveryHandler) {
+	for delivery := range deliveries {
+		start := time.Now()
+
+		if isExpired(delivery) {
+			lg.Info("rabbit consumer dropped an expired message", lg.Fields{
+				"queue": p.Queue, "worker": worker, "expires_at": delivery.Headers[expiresAtHeader],
+			})
+			mt.ExpiredMessages.Inc()
+			if err := delivery.Ack(false); err != nil {
+				lg.Error("rabbit consumer failed to ack a message", lg.Fields{"queue": p.Queue, "worker": worker, "error": err})
+			}
+			continue
+		}
+
+		err := handler(delivery)
+		if err != nil {
+			lg.Warn("rabbit consumer failed to process a message", lg.Fields{
+				"queue": p.Queue, "worker": worker, "requeue": p.requeue, "error": err,
+			})
+			if err := delivery.Nack(false, p.requeue); err != nil {
+				lg.Error("rabbit consumer failed to nack a message", lg.Fields{"queue": p.Queue, "worker": worker, "error": err})
+			}
+		} else if err := delivery.Ack(false); err != nil {
+			lg.Error("rabbit consumer failed to ack a message", lg.Fields{"queue": p.Queue, "worker": worker, "error": err})
+		}
+
+		mt.ObserveVec(mt.ConsumerLatency, worker, time.Since(start).Seconds())
+	}
+}
+
+// isExpired reports whether the message carries an expires at header that is already in the past
+func isExpired(delivery amqp.Delivery) bool {
+	raw, found := delivery.Headers[expiresAtHeader]
+	if !found {
+		return false
+	}
+
+	str, ok := raw.(string)
+	if !ok {
+		return false
+	}
+
+	expiresAt, err := time.Parse(time.RFC3339Nano, str)
+	if err != nil {
+		return false
+	}
+	return !expiresAt.After(time.Now())
+}
@@ -0,0 +1,33 @@
+package rabbitmq
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestConsumerReopen(t *testing.T) {
+	b := newFakeBroker(t)
+	p, err := NewConsumerPool(ConsumerConfig{
+		Dsn:         b.dsn(),
+		Queue:       "urls",
+		Prefetch:    1,
+		Concurrency: 1,
+		Reconnect:   ReconnectConfig{InitialDelay: time.Millisecond, MaxDelay: time.Millisecond},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.waitOpen(t, 1)
+
+	// each reopen replaces the connection, it doesn't add one
+	for i := 0; i < 3; i++ {
+		if !p.reopen(context.Background()) {
+			t.Fatal("reopen() = false")
+		}
+		b.waitOpen(t, 1)
+	}
+
+	p.Close()
+	b.waitOpen(t, 0)
+}
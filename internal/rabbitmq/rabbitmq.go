@@ -1,16 +1,34 @@
 package rabbitmq
 
 import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
+	"fmt"
 	"log"
+	"sync"
 	"time"
 
+	lg "phish-api/internal/logging"
+	mt "phish-api/internal/metrics"
+	"phish-api/internal/publisher"
+
 	"github.com/streadway/amqp"
 )
 
 type RabbitChannel struct {
 	conn *amqp.Connection
 	ch   *amqp.Channel
+
+	// publisher confirms (enabled when confirms != nil)
+	confirmMu      sync.Mutex
+	confirms       <-chan amqp.Confirmation
+	confirmTimeout time.Duration
+	publishSeq     uint64
+
+	// publish with the mandatory flag, unroutable messages are returned
+	mandatory bool
 }
 
 type RabbitConfig struct {
@@ -18,45 +36,97 @@ type RabbitConfig struct {
 		Dsn       string            `yaml:"dsn"`
 		Exchange  string            `yaml:"exchange"`
 		Exchanges map[string]string `yaml:"exchanges"`
+		// optional, receives a compact event for every submission
+		AuditExchange string `yaml:"audit_exchange"`
+		// type of the exchanges declared (durable) on connect, default: direct
+		ExchangeType string `yaml:"exchange_type"`
 	} `yaml:"dst"`
+	// wait for broker ack/nack on every publish
+	ConfirmMode    bool          `yaml:"confirm_mode"`
+	ConfirmTimeout time.Duration `yaml:"confirm_timeout"`
+	// publish with mandatory=true, messages no queue is bound for are returned (logged & counted)
+	// instead of being silently dropped; optionally republished once via the main exchange
+	Mandatory            bool `yaml:"mandatory"`
+	RetryReturnedViaMain bool `yaml:"retry_returned_via_main"`
+	// reject tasks of sources missing in dst exchanges instead of publishing them to the main exchange
+	StrictSources bool `yaml:"strict_sources"`
+
+	Reconnect ReconnectConfig `yaml:"reconnect"`
+	Consumer  ConsumerConfig  `yaml:"consumer"`
+	// optional, consumes cache invalidation messages (domain/ip keys)
+	Invalidation ConsumerConfig `yaml:"invalidation"`
 }
 
 func (cfg *RabbitConfig) IsValid() bool {
-	valid := true
+	errs := cfg.Errors()
+	for _, err := range errs {
+		log.Printf("%v", err)
+	}
+	return len(errs) == 0
+}
+
+// Errors lists every problem of the config
+func (cfg *RabbitConfig) Errors() []string {
+	var errs []string
 	cfgName := "dst rabbit"
 
 	// dst rabbit
 	dstRabbit := cfg.Dst
 
 	if dstRabbit.Dsn == "" {
-		valid = false
-		log.Printf("%v dsn is invalid", cfgName)
+		errs = append(errs, fmt.Sprintf("%v dsn is invalid", cfgName))
 	}
 
 	if dstRabbit.Exchange == "" {
-		valid = false
-		log.Printf("%v exchange is invalid", cfgName)
+		errs = append(errs, fmt.Sprintf("%v exchange is invalid", cfgName))
 	}
 
 	if len(dstRabbit.Exchanges) == 0 {
-		valid = false
-		log.Printf("%v exchange list is empty", cfgName)
+		errs = append(errs, fmt.Sprintf("%v exchange list is empty", cfgName))
 	}
 
 	for key, val := range dstRabbit.Exchanges {
 		if key == "" || val == "" {
-			valid = false
-			log.Printf("%v exchange list is invalid", cfgName)
+			errs = append(errs, fmt.Sprintf("%v exchange list is invalid", cfgName))
 			break
 		}
 	}
-	return valid
+
+	if cfg.ConfirmMode && cfg.ConfirmTimeout <= 0 {
+		errs = append(errs, fmt.Sprintf("%v confirm timeout is invalid", cfgName))
+	}
+
+	if cfg.RetryReturnedViaMain && !cfg.Mandatory {
+		errs = append(errs, fmt.Sprintf("%v retry returned via main requires mandatory", cfgName))
+	}
+
+	if cfg.Reconnect.InitialDelay < 0 || cfg.Reconnect.MaxDelay < 0 {
+		errs = append(errs, fmt.Sprintf("%v reconnect delays are invalid", cfgName))
+	}
+
+	// consumers are optional
+	errs = append(errs, cfg.Consumer.Errors()...)
+	errs = append(errs, cfg.Invalidation.Errors()...)
+	return errs
 }
 
 type RabbitHandler struct {
+	sync.RWMutex   // guards the producer channel swap on reconnect
 	ProdCh         *RabbitChannel
 	MainExchange   string
 	ExtraExchanges map[string]string
+	AuditExchange  string
+
+	dsn            string
+	exchangeType   string
+	confirmTimeout time.Duration // 0 = publisher confirms are disabled
+	mandatory      bool
+	retryReturned  bool
+	strictSources  bool
+	connected      bool
+	closing        chan struct{}
+	closeOnce      sync.Once
+	reconnectCfg   ReconnectConfig
 }
 
 func NewRabbitHandler(cfg RabbitConfig) (*RabbitHandler, error) {
@@ -64,39 +134,298 @@ func NewRabbitHandler(cfg RabbitConfig) (*RabbitHandler, error) {
 		return nil, errors.New("rabbit cfg is invalid")
 	}
 
-	prodCh := newChannel(cfg.Dst.Dsn)
+	if cfg.Dst.ExchangeType == "" {
+		cfg.Dst.ExchangeType = amqp.ExchangeDirect
+	}
+
 	handler := &RabbitHandler{
-		ProdCh:         prodCh,
 		MainExchange:   cfg.Dst.Exchange,
 		ExtraExchanges: cfg.Dst.Exchanges,
+		AuditExchange:  cfg.Dst.AuditExchange,
+		dsn:            cfg.Dst.Dsn,
+		exchangeType:   cfg.Dst.ExchangeType,
+		mandatory:      cfg.Mandatory,
+		retryReturned:  cfg.RetryReturnedViaMain,
+		strictSources:  cfg.StrictSources,
+		closing:        make(chan struct{}),
+		reconnectCfg:   cfg.Reconnect.withDefaults(),
+	}
+	if cfg.ConfirmMode {
+		handler.confirmTimeout = cfg.ConfirmTimeout
+	}
+
+	prodCh, err := handler.openChannel()
+	if err != nil {
+		return nil, err
 	}
+	handler.ProdCh = prodCh
+	handler.connected = true
+
+	go handler.watch(prodCh)
 	return handler, nil
 }
 
-func (h *RabbitHandler) NewCloseCh() <-chan *amqp.Error {
-	return h.ProdCh.NotifyClose()
+// openChannel opens a producer channel (with publisher confirms if configured)
+func (h *RabbitHandler) openChannel() (*RabbitChannel, error) {
+	rc, err := newChannel(h.dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.declareExchanges(rc); err != nil {
+		rc.Close()
+		return nil, err
+	}
+
+	if h.confirmTimeout > 0 {
+		if err := rc.ch.Confirm(false); err != nil {
+			rc.Close()
+			return nil, fmt.Errorf("failed to put a rabbit channel into confirm mode, err: %s", err)
+		}
+		rc.confirms = rc.ch.NotifyPublish(make(chan amqp.Confirmation, 64))
+		rc.confirmTimeout = h.confirmTimeout
+	}
+
+	if h.mandatory {
+		rc.mandatory = true
+		// closed by the library together with the channel
+		go h.handleReturns(rc.ch.NotifyReturn(make(chan amqp.Return, 64)))
+	}
+	return rc, nil
+}
+
+// maxPendingRetries bounds the returned messages queued for a republish, more are dropped
+const maxPendingRetries = 64
+
+// handleReturns logs and counts the messages rabbit couldn't route, and republishes
+// those sent to a source exchange via the main exchange (if configured); audit messages aren't retried
+func (h *RabbitHandler) handleReturns(returns <-chan amqp.Return) {
+	var retries chan amqp.Return
+	if h.retryReturned {
+		// a single worker republishes outside of the loop, it may wait for a confirm while more returns arrive
+		retries = make(chan amqp.Return, maxPendingRetries)
+		defer close(retries)
+		go func() {
+			for ret := range retries {
+				h.republish(ret)
+			}
+		}()
+	}
+
+	for ret := range returns {
+		mt.IncVec(mt.ReturnedMessages, ret.Exchange)
+		lg.Warn("rabbit returned message", lg.Fields{
+			"exchange": ret.Exchange, "routing_key": ret.RoutingKey, "message_id": ret.MessageId,
+			"source": ret.Headers[publisher.SourceHeader], "reply_code": ret.ReplyCode, "reply_text": ret.ReplyText,
+		})
+
+		if retries == nil || !h.isSourceExchange(ret.Exchange) {
+			continue
+		}
+		select {
+		case retries <- ret:
+		default:
+			mt.IncVec(mt.Errors, "rabbit publish")
+			lg.Error("rabbit returned message retry fail", lg.Fields{"message_id": ret.MessageId, "error": "too many pending retries"})
+		}
+	}
+}
+
+// isSourceExchange reports whether the exchange is one of the source (extra) task exchanges
+func (h *RabbitHandler) isSourceExchange(exchange string) bool {
+	if exchange == h.MainExchange || exchange == h.AuditExchange {
+		return false
+	}
+	for _, exch := range h.ExtraExchanges {
+		if exch == exchange {
+			return true
+		}
+	}
+	return false
 }
 
+func (h *RabbitHandler) republish(ret amqp.Return) {
+	ch := h.channel()
+	if ch == nil {
+		lg.Error("rabbit returned message retry fail", lg.Fields{"message_id": ret.MessageId, "error": ErrNotConnected})
+		return
+	}
+
+	msg := amqp.Publishing{
+		Headers:         ret.Headers,
+		ContentType:     ret.ContentType,
+		ContentEncoding: ret.ContentEncoding,
+		DeliveryMode:    ret.DeliveryMode,
+		Priority:        ret.Priority,
+		CorrelationId:   ret.CorrelationId,
+		ReplyTo:         ret.ReplyTo,
+		Expiration:      ret.Expiration,
+		MessageId:       ret.MessageId,
+		Timestamp:       ret.Timestamp,
+		Type:            ret.Type,
+		UserId:          ret.UserId,
+		AppId:           ret.AppId,
+		Body:            ret.Body,
+	}
+	// not bound to a request, the confirm timeout bounds the wait
+	if err := ch.PublishMsg(context.Background(), h.MainExchange, ret.RoutingKey, msg); err != nil {
+		mt.IncVec(mt.Errors, "rabbit publish")
+		lg.Error("rabbit returned message retry fail", lg.Fields{"message_id": ret.MessageId, "exchange": h.MainExchange, "error": err})
+		return
+	}
+	lg.Info("rabbit returned message retried", lg.Fields{"message_id": ret.MessageId, "exchange": h.MainExchange, "routing_key": ret.RoutingKey})
+}
+
+// declareExchanges declares every configured exchange (durable), so a fresh broker works
+// and an exchange of another type fails at connect rather than dropping messages at runtime
+func (h *RabbitHandler) declareExchanges(rc *RabbitChannel) error {
+	exchanges := []string{h.MainExchange, h.AuditExchange}
+	for _, exch := range h.ExtraExchanges {
+		exchanges = append(exchanges, exch)
+	}
+
+	declared := make(map[string]bool, len(exchanges))
+	for _, exch := range exchanges {
+		if exch == "" || declared[exch] {
+			continue
+		}
+		err := rc.ch.ExchangeDeclare(
+			exch,           // name
+			h.exchangeType, // kind
+			true,           // durable
+			false,          // auto-delete
+			false,          // internal
+			false,          // no-wait
+			nil,            // args
+		)
+		if err != nil {
+			return fmt.Errorf("failed to declare rabbit exchange %v (%v), err: %s", exch, h.exchangeType, err)
+		}
+		declared[exch] = true
+	}
+	return nil
+}
+
+// Close stops reconnecting and closes the producer channel, it's safe to call more than once
 func (h *RabbitHandler) Close() {
-	h.ProdCh.Close()
+	h.closeOnce.Do(func() {
+		// under the lock, so a reconnect can't install a new channel once closed
+		h.Lock()
+		defer h.Unlock()
+
+		close(h.closing)
+		if h.connected {
+			h.ProdCh.Close()
+		}
+		h.connected = false
+	})
 }
 
-func (h *RabbitHandler) Publish(taskSource, routingKey string, message []byte) {
-	// push to particular exchange based on task source
-	exchange := h.MainExchange
+const (
+	ExchangeFromExtra string = "extra" // exchange mapped to the task source
+	ExchangeFromMain  string = "main"  // fallback for unmapped sources
+)
+
+// Route describes where a message was actually published
+type Route = publisher.Route
+
+// Backend is the publisher backend name
+func (h *RabbitHandler) Backend() string {
+	return publisher.BackendRabbit
+}
+
+// Route picks the exchange for the task source
+func (h *RabbitHandler) Route(taskSource, routingKey string) Route {
 	exch, found := h.ExtraExchanges[taskSource]
 	if found {
-		exchange = exch
+		return Route{Exchange: exch, RoutingKey: routingKey, ExchangeFrom: ExchangeFromExtra}
+	}
+	return Route{Exchange: h.MainExchange, RoutingKey: routingKey, ExchangeFrom: ExchangeFromMain}
+}
+
+var _ publisher.Publisher = (*RabbitHandler)(nil)
+
+// Publish pushes a message to the exchange matching the task source; an expires at header
+// sets the message expiration (the header is also checked by consumers)
+func (h *RabbitHandler) Publish(ctx context.Context, taskSource, routingKey string, headers map[string]string, message []byte) (Route, error) {
+	span, headers := publisher.StartSpan(ctx, publisher.BackendRabbit, taskSource, headers)
+	route, err := h.publish(ctx, taskSource, routingKey, headers, message)
+	publisher.EndSpan(span, route, err)
+	return route, err
+}
+
+func (h *RabbitHandler) publish(ctx context.Context, taskSource, routingKey string, headers map[string]string, message []byte) (Route, error) {
+	// push to particular exchange based on task source
+	route := h.Route(taskSource, routingKey)
+	if h.strictSources && route.ExchangeFrom != ExchangeFromExtra {
+		mt.UnknownSources.Inc()
+		lg.Warn("rabbit publish: unknown source rejected", lg.Fields{"source": taskSource})
+		return route, fmt.Errorf("%w: %v", publisher.ErrUnknownSource, taskSource)
+	}
+
+	msgHeaders := make(amqp.Table, len(headers)+1)
+	for key, val := range headers {
+		msgHeaders[key] = val
 	}
+	msgHeaders[publisher.SourceHeader] = taskSource
 
-	err := h.ProdCh.Publish(exchange, routingKey, message)
+	msg := newPublishing(message, msgHeaders)
+	if raw, found := headers[publisher.ExpiresAtHeader]; found {
+		expiresAt, err := time.Parse(time.RFC3339Nano, raw)
+		if err != nil {
+			return route, fmt.Errorf("invalid %v header: %v", publisher.ExpiresAtHeader, err)
+		}
+		ttl := time.Until(expiresAt).Milliseconds()
+		if ttl < 1 {
+			ttl = 1
+		}
+		msg.Expiration = fmt.Sprintf("%v", ttl)
+	}
+
+	ch := h.channel()
+	if ch == nil {
+		mt.IncVec(mt.Errors, "rabbit publish")
+		mt.IncVec(mt.PublishFailures, route.Exchange)
+		return route, ErrNotConnected
+	}
+
+	err := ch.PublishMsg(ctx, route.Exchange, route.RoutingKey, msg)
 	if err != nil {
-		log.Fatalf("failed to publish a message to rabbit, err: %v", err)
+		mt.IncVec(mt.Errors, "rabbit publish")
+		mt.IncVec(mt.PublishFailures, route.Exchange)
+		return route, fmt.Errorf("failed to publish a message to rabbit (exchange: %v), err: %v", route.Exchange, err)
 	}
+
+	mt.IncVec(mt.PublishedMessages, route.Exchange)
+	lg.Info("rabbit publish", lg.Fields{
+		"source": taskSource, "exchange": route.Exchange, "routing_key": route.RoutingKey, "exchange_from": route.ExchangeFrom,
+	})
+	return route, nil
+}
+
+// PublishAudit pushes a message to the audit exchange (if configured) in background;
+// it's best-effort, failures are only logged
+func (h *RabbitHandler) PublishAudit(message []byte) {
+	if h.AuditExchange == "" {
+		return
+	}
+
+	ch := h.channel()
+	if ch == nil {
+		lg.Warn("failed to publish an audit message to rabbit", lg.Fields{"error": ErrNotConnected})
+		return
+	}
+
+	go func() {
+		err := ch.Publish(context.Background(), h.AuditExchange, "", message)
+		if err != nil {
+			lg.Warn("failed to publish an audit message to rabbit", lg.Fields{"exchange": h.AuditExchange, "error": err})
+		}
+	}()
 }
 
 // RabbitChannel is a rabbitmq channel instance, used for consume & publish
-func newChannel(dsn string) *RabbitChannel {
+func newChannel(dsn string) (*RabbitChannel, error) {
 	heartbeat := time.Duration(time.Second * 600)
 	rc := &RabbitChannel{}
 	var err error
@@ -105,30 +434,36 @@ func newChannel(dsn string) *RabbitChannel {
 	})
 
 	if err != nil {
-		log.Fatalf("failed to connect to rabbitmq, err: %s", err)
+		return nil, fmt.Errorf("failed to connect to rabbitmq, err: %s", err)
 	}
 
 	rc.ch, err = rc.conn.Channel()
 	if err != nil {
-		log.Fatalf("failed to open a rabbit channel, err: %s", err)
+		rc.conn.Close()
+		return nil, fmt.Errorf("failed to open a rabbit channel, err: %s", err)
 	}
 
-	return rc
+	return rc, nil
 }
 
 // NewProducer creates new Producer instance
-func NewProducer(dsn string) *RabbitChannel {
+func NewProducer(dsn string) (*RabbitChannel, error) {
 	return newChannel(dsn)
 }
 
 // NewConsumer creates new Consumer instance
-func NewConsumer(dsn string, prefetch int) *RabbitChannel {
-	consumer := newChannel(dsn)
-	err := consumer.ch.Qos(prefetch, 0, false)
+func NewConsumer(dsn string, prefetch int) (*RabbitChannel, error) {
+	consumer, err := newChannel(dsn)
 	if err != nil {
-		log.Fatalf("Qos failed, err: %s", err)
+		return nil, err
 	}
-	return consumer
+
+	err = consumer.ch.Qos(prefetch, 0, false)
+	if err != nil {
+		consumer.Close()
+		return nil, fmt.Errorf("Qos failed, err: %s", err)
+	}
+	return consumer, nil
 }
 
 // Close gracefully closes rabbitmq channel and connection
@@ -137,16 +472,17 @@ func (rc *RabbitChannel) Close() {
 	rc.conn.Close()
 }
 
-// NotifyClose make error channel for signalling a transport or protocol error
+// NotifyClose make error channel for signalling a transport or protocol error; it's buffered,
+// the library blocks on sending the error and the listener may be gone (closed handler)
 func (rc *RabbitChannel) NotifyClose() <-chan *amqp.Error {
-	return rc.conn.NotifyClose(make(chan *amqp.Error))
+	return rc.conn.NotifyClose(make(chan *amqp.Error, 1))
 }
 
-// Consume return channel for consuming messages from rabbitmq
-func (rc *RabbitChannel) Consume(queue string) <-chan amqp.Delivery {
+// Consume return channel for consuming messages from rabbitmq, the tag identifies the consumer (see Cancel)
+func (rc *RabbitChannel) Consume(queue, tag string) (<-chan amqp.Delivery, error) {
 	deliveryChan, err := rc.ch.Consume(
 		queue, // queue
-		"",    // consumer
+		tag,   // consumer
 		false, // auto-ack
 		false, // exclusive
 		false, // no-local
@@ -154,26 +490,110 @@ func (rc *RabbitChannel) Consume(queue string) <-chan amqp.Delivery {
 		nil,   // args
 	)
 	if err != nil {
-		log.Fatalf("failed to consume from rabbit queue %s, err: %s", queue, err)
+		return nil, fmt.Errorf("failed to consume from rabbit queue %s, err: %s", queue, err)
 	}
 
-	return deliveryChan
+	return deliveryChan, nil
+}
+
+// Cancel stops the consumer deliveries (in-flight messages can still be acked), its delivery channel
+// is closed once the broker confirms
+func (rc *RabbitChannel) Cancel(tag string) error {
+	return rc.ch.Cancel(tag, false)
 }
 
 // Publish message to rabbitmq channel
-func (rc *RabbitChannel) Publish(exchange, routingKey string, message []byte) error {
+func (rc *RabbitChannel) Publish(ctx context.Context, exchange, routingKey string, message []byte) error {
+	return rc.PublishWithHeaders(ctx, exchange, routingKey, message, nil)
+}
+
+// PublishWithHeaders publishes a message with the given headers to rabbitmq channel
+func (rc *RabbitChannel) PublishWithHeaders(ctx context.Context, exchange, routingKey string, message []byte, headers amqp.Table) error {
+	return rc.PublishMsg(ctx, exchange, routingKey, newPublishing(message, headers))
+}
+
+// PublishMsg publishes a prepared amqp message to rabbitmq channel;
+// in confirm mode it waits for the broker ack and fails on nack, timeout or once ctx is done
+func (rc *RabbitChannel) PublishMsg(ctx context.Context, exchange, routingKey string, msg amqp.Publishing) error {
+	if rc.confirms == nil {
+		return rc.publish(exchange, routingKey, msg)
+	}
+
+	// confirmations come in publish order, so confirmed publishes are serialized
+	rc.confirmMu.Lock()
+	defer rc.confirmMu.Unlock()
+
+	if err := rc.publish(exchange, routingKey, msg); err != nil {
+		return err
+	}
+	rc.publishSeq++
+	return rc.waitConfirm(ctx, rc.publishSeq)
+}
+
+// waitConfirm waits for the confirm of the delivery tag, a confirm arriving after the wait
+// was given up is skipped by the next wait
+func (rc *RabbitChannel) waitConfirm(ctx context.Context, deliveryTag uint64) error {
+	timeout := time.After(rc.confirmTimeout)
+	for {
+		select {
+		case confirm, ok := <-rc.confirms:
+			if !ok {
+				return errors.New("rabbit channel closed while waiting for publish confirm")
+			}
+			if confirm.DeliveryTag < deliveryTag {
+				// late confirm of a message that has already timed out
+				continue
+			}
+			if !confirm.Ack {
+				return fmt.Errorf("rabbit nacked message (delivery tag: %v)", deliveryTag)
+			}
+			return nil
+
+		case <-timeout:
+			return fmt.Errorf("rabbit publish confirm timeout (%v)", rc.confirmTimeout)
+
+		case <-ctx.Done():
+			return fmt.Errorf("rabbit publish confirm wait cancelled: %w", ctx.Err())
+		}
+	}
+}
+
+func (rc *RabbitChannel) publish(exchange, routingKey string, msg amqp.Publishing) error {
 	err := rc.ch.Publish(
 		exchange,
 		routingKey,
-		false, // mandatory
+		rc.mandatory,
 		false, // immediate
-		amqp.Publishing{
-			ContentType:  "application/json",
-			DeliveryMode: amqp.Persistent,
-			Body:         message,
-		})
+		msg)
 	if err != nil {
 		return err
 	}
 	return nil
 }
+
+// newPublishing builds a persistent json message with a unique id and the publish timestamp,
+// the headers are copied
+func newPublishing(message []byte, headers amqp.Table) amqp.Publishing {
+	msgHeaders := amqp.Table{}
+	for key, val := range headers {
+		msgHeaders[key] = val
+	}
+
+	return amqp.Publishing{
+		ContentType:  "application/json",
+		DeliveryMode: amqp.Persistent,
+		MessageId:    newMessageID(),
+		Timestamp:    time.Now().UTC(),
+		Headers:      msgHeaders,
+		Body:         message,
+	}
+}
+
+// newMessageID returns a random hex id, consumers may use it to dedupe redeliveries
+func newMessageID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -0,0 +1,53 @@
+package rabbitmq
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestRoute(t *testing.T) {
+	h := &RabbitHandler{MainExchange: "main-ex", ExtraExchanges: map[string]string{"a": "a-ex"}}
+
+	tests := []struct {
+		name       string
+		source     string
+		routingKey string
+		want       Route
+	}{
+		{name: "mapped source", source: "a", want: Route{Exchange: "a-ex", ExchangeFrom: ExchangeFromExtra}},
+		{name: "unmapped source falls back to main", source: "b", want: Route{Exchange: "main-ex", ExchangeFrom: ExchangeFromMain}},
+		{name: "routing key kept", source: "a", routingKey: "rk", want: Route{Exchange: "a-ex", RoutingKey: "rk", ExchangeFrom: ExchangeFromExtra}},
+		{name: "empty source", want: Route{Exchange: "main-ex", ExchangeFrom: ExchangeFromMain}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := h.Route(tt.source, tt.routingKey); got != tt.want {
+				t.Errorf("Route(%q, %q) = %+v, want %+v", tt.source, tt.routingKey, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWaitConfirm(t *testing.T) {
+	confirms := make(chan amqp.Confirmation, 2)
+	rc := &RabbitChannel{confirms: confirms, confirmTimeout: time.Minute}
+
+	// the request is gone, not waiting for the confirm timeout
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := rc.waitConfirm(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("waitConfirm() = %v, want context.Canceled", err)
+	}
+
+	// the late confirm of the given up publish is skipped
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	if err := rc.waitConfirm(context.Background(), 2); err == nil {
+		t.Error("waitConfirm() = nil, want the nack of delivery tag 2")
+	}
+}
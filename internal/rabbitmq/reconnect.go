@@ -0,0 +1,121 @@
+package rabbitmq
+
+import (
+	"errors"
+	"time"
+
+	lg "phish-api/internal/logging"
+)
+
+var ErrNotConnected = errors.New("rabbit is not connected (reconnecting), retry later")
+
+const (
+	defaultReconnectInitialDelay = time.Second
+	defaultReconnectMaxDelay     = time.Minute
+)
+
+type ReconnectConfig struct {
+	InitialDelay time.Duration `yaml:"initial_delay"`
+	MaxDelay     time.Duration `yaml:"max_delay"`
+}
+
+func (cfg ReconnectConfig) withDefaults() ReconnectConfig {
+	if cfg.InitialDelay <= 0 {
+		cfg.InitialDelay = defaultReconnectInitialDelay
+	}
+	if cfg.MaxDelay <= 0 {
+		cfg.MaxDelay = defaultReconnectMaxDelay
+	}
+	if cfg.MaxDelay < cfg.InitialDelay {
+		cfg.MaxDelay = cfg.InitialDelay
+	}
+	return cfg
+}
+
+// Connected reports whether the producer connection is currently usable
+func (h *RabbitHandler) Connected() bool {
+	h.RLock()
+	defer h.RUnlock()
+	return h.connected
+}
+
+// channel returns the current producer channel, nil while reconnecting
+func (h *RabbitHandler) channel() *RabbitChannel {
+	h.RLock()
+	defer h.RUnlock()
+	if !h.connected {
+		return nil
+	}
+	return h.ProdCh
+}
+
+// watch waits for the channel's connection to drop and starts reconnecting
+func (h *RabbitHandler) watch(rc *RabbitChannel) {
+	closeCh := rc.NotifyClose()
+
+	select {
+	case err, ok := <-closeCh:
+		if !ok {
+			// closed by us
+			return
+		}
+		lg.Warn("rabbit connection lost", lg.Fields{"error": err})
+
+	case <-h.closing:
+		return
+	}
+
+	h.Lock()
+	h.connected = false
+	h.Unlock()
+
+	h.reconnect()
+}
+
+// reconnect re-dials the dsn with capped exponential backoff until it succeeds or the handler is closed
+func (h *RabbitHandler) reconnect() {
+	delay := h.reconnectCfg.InitialDelay
+
+	for try := 1; ; try++ {
+		select {
+		case <-h.closing:
+			return
+		case <-time.After(delay):
+		}
+
+		rc, err := h.openChannel()
+		if err != nil {
+			lg.Warn("rabbit reconnect fail", lg.Fields{"try": try, "next_in": delay.String(), "error": err})
+			delay *= 2
+			if delay > h.reconnectCfg.MaxDelay {
+				delay = h.reconnectCfg.MaxDelay
+			}
+			continue
+		}
+
+		if !h.install(rc) {
+			// closed meanwhile
+			rc.Close()
+			return
+		}
+
+		lg.Info("rabbit reconnected", lg.Fields{"tries": try})
+		go h.watch(rc)
+		return
+	}
+}
+
+// install swaps in the reconnected channel, unless the handler has been closed
+func (h *RabbitHandler) install(rc *RabbitChannel) bool {
+	h.Lock()
+	defer h.Unlock()
+
+	select {
+	case <-h.closing:
+		return false
+	default:
+	}
+	h.ProdCh = rc
+	h.connected = true
+	return true
+}
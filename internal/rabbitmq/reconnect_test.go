@@ -0,0 +1,49 @@
+package rabbitmq
+
+import (
+	"testing"
+	"time"
+)
+
+// newTestHandlerConfig returns a valid handler config for the broker
+func newTestHandlerConfig(b *fakeBroker) RabbitConfig {
+	var cfg RabbitConfig
+	cfg.Dst.Dsn = b.dsn()
+	cfg.Dst.Exchange = "main-ex"
+	cfg.Dst.Exchanges = map[string]string{"a": "a-ex"}
+	cfg.Reconnect = ReconnectConfig{InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	return cfg
+}
+
+func TestHandlerClose(t *testing.T) {
+	b := newFakeBroker(t)
+	h, err := NewRabbitHandler(newTestHandlerConfig(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.waitOpen(t, 1)
+
+	h.Close()
+	h.Close() // no panic on a double close
+	b.waitOpen(t, 0)
+	if h.Connected() {
+		t.Error("Connected() = true after Close")
+	}
+
+	// a reconnect finishing after the close must not install its channel
+	rc, err := h.openChannel()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.install(rc) {
+		t.Fatal("install() = true after Close")
+	}
+	rc.Close()
+	if h.channel() != nil {
+		t.Error("channel() != nil after Close")
+	}
+
+	// nor dial again
+	h.reconnect()
+	b.waitOpen(t, 0)
+}
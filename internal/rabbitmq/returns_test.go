@@ -0,0 +1,49 @@
+package rabbitmq
+
+import (
+	"context"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReturnsRetry(t *testing.T) {
+	b := newFakeBroker(t, "a-ex", "audit-ex")
+	cfg := newTestHandlerConfig(b)
+	cfg.Dst.AuditExchange = "audit-ex"
+	cfg.Mandatory = true
+	cfg.RetryReturnedViaMain = true
+	h, err := NewRabbitHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	h.PublishAudit([]byte("{}"))
+	if _, err := h.Publish(context.Background(), "a", "", nil, []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	// the task is republished via main, the audit event isn't
+	want := map[string]int{"a-ex": 1, "audit-ex": 1, "main-ex": 1}
+	deadline := time.Now().Add(time.Second)
+	for {
+		got := map[string]int{}
+		for _, exch := range b.publishedTo() {
+			got[exch]++
+		}
+		if reflect.DeepEqual(got, want) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("published to %v, want %v", got, want)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	// no late retry of the audit event
+	time.Sleep(50 * time.Millisecond)
+	if published := b.publishedTo(); len(published) != 3 {
+		t.Errorf("published to %v, want 3 publishes", published)
+	}
+}
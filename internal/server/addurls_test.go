@@ -0,0 +1,207 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"phish-api/internal/elastic"
+	"phish-api/internal/publisher"
+	"phish-api/internal/validate"
+
+	"github.com/elastic/go-elasticsearch/v6"
+	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
+)
+
+// stubPublisher records the published tasks
+type stubPublisher struct {
+	mu        sync.Mutex
+	published []string // sources
+}
+
+func (p *stubPublisher) Publish(ctx context.Context, source, routingKey string, headers map[string]string, body []byte) (publisher.Route, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = append(p.published, source)
+	return publisher.Route{Exchange: "main"}, nil
+}
+
+func (p *stubPublisher) PublishAudit(body []byte) {}
+func (p *stubPublisher) Connected() bool          { return true }
+func (p *stubPublisher) Backend() string          { return "stub" }
+func (p *stubPublisher) Close()                   {}
+
+// whitelistCalls counts the whitelister api calls per endpoint
+type whitelistCalls struct {
+	mu                 sync.Mutex
+	bulk, domain, ip   int
+	bulkDomainsPerCall []int
+}
+
+// newBatchTestServer returns a server whose whitelister api has a bulk endpoint (failing with bulkStatus, if set)
+func newBatchTestServer(t *testing.T, onFailure string, bulkStatus int, white ...string) (*Server, *stubPublisher, *whitelistCalls) {
+	t.Helper()
+	isWhite := make(map[string]bool, len(white))
+	for _, val := range white {
+		isWhite[val] = true
+	}
+
+	calls := &whitelistCalls{}
+	wl := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.mu.Lock()
+		defer calls.mu.Unlock()
+
+		switch r.URL.Path {
+		case "/bulk":
+			calls.bulk++
+			if bulkStatus != 0 {
+				w.WriteHeader(bulkStatus)
+				return
+			}
+			var req validate.BulkDomainWhiteListRequest
+			json.NewDecoder(r.Body).Decode(&req)
+			calls.bulkDomainsPerCall = append(calls.bulkDomainsPerCall, len(req.Domains))
+			response := validate.BulkDomainWhiteListResponse{Status: "ok"}
+			for _, domain := range req.Domains {
+				response.Results = append(response.Results, validate.DomainWhiteListResponse{Domain: domain, Result: isWhite[domain]})
+			}
+			json.NewEncoder(w).Encode(response)
+		case "/domain":
+			calls.domain++
+			fmt.Fprintf(w, `{"status": "ok", "result": %v}`, isWhite[r.URL.Query().Get("q")])
+		case "/ip":
+			calls.ip++
+			fmt.Fprintf(w, `{"status": "ok", "result": %v}`, isWhite[r.URL.Query().Get("q")])
+		}
+	}))
+	t.Cleanup(wl.Close)
+
+	blacklister, err := validate.NewBlacklister(nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	whitelister := validate.NewWhitelister(validate.WhitelisterApi{
+		CheckDomainApiUrl:     wl.URL + "/domain?q=%v",
+		CheckIpApiUrl:         wl.URL + "/ip?q=%v",
+		BulkCheckDomainApiUrl: wl.URL + "/bulk",
+		MaxTries:              1,
+		OnFailure:             onFailure,
+	})
+	t.Cleanup(whitelister.Close)
+
+	es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"errors": false, "items": []}`)
+	}))
+	t.Cleanup(es.Close)
+	client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{es.URL}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	el := &elastic.Elastic{Client: client, Index: "logs", NumWorkers: 1, CloseTimeout: time.Second}
+	if el.Indexer, err = el.NewBulkIndexer(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { el.Close() })
+
+	pub := &stubPublisher{}
+	s := &Server{
+		Publisher: pub,
+		Validator: &validate.Validator{
+			DomainCache:    cache.New(time.Hour, time.Hour),
+			UrlBlacklister: blacklister,
+			IpChecker:      validate.NewIpChecker([]string{"10.0.0.0/8"}, time.Second),
+			Whitelister:    whitelister,
+			Throttler:      validate.NewSourceThrottler(0, nil),
+			SkipDnsChecks:  true,
+		},
+		Elastic:   el,
+		TaskRules: TaskRules{}.withDefaults(),
+	}
+	return s, pub, calls
+}
+
+func TestAddUrlsChecksWhitelistOnce(t *testing.T) {
+	s, pub, calls := newBatchTestServer(t, validate.FailOpen, 0, "white.example", "1.2.3.4")
+
+	task := AddUrlTask{Source: "a", URLs: []string{
+		"http://white.example/a", "http://phish.example/b", "http://1.2.3.4/c", "http://5.6.7.8/d", "http://phish.example/e",
+	}}
+	response := addUrls(t, s, task)
+
+	want := []string{DecisionSkipped, DecisionPublished, DecisionSkipped, DecisionPublished, DecisionPublished}
+	for i, result := range response.Results {
+		if result.Decision != want[i] {
+			t.Errorf("%v: decision = %q (%v), want %q", result.URL, result.Decision, result.Error, want[i])
+		}
+	}
+	if len(pub.published) != 3 {
+		t.Errorf("published = %v, want 3 tasks", pub.published)
+	}
+
+	// one bulk call for the distinct domains, the ips are checked against the ip whitelist
+	if calls.bulk != 1 || calls.domain != 0 || calls.ip != 2 {
+		t.Errorf("whitelister calls: bulk = %v, domain = %v, ip = %v, want 1, 0, 2", calls.bulk, calls.domain, calls.ip)
+	}
+	if len(calls.bulkDomainsPerCall) == 1 && calls.bulkDomainsPerCall[0] != 2 {
+		t.Errorf("bulk call domains = %v, want 2", calls.bulkDomainsPerCall[0])
+	}
+}
+
+func TestAddUrlsWhitelistFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		onFailure string
+		decision  string
+	}{
+		{name: "fail open", onFailure: validate.FailOpen, decision: DecisionPublished},
+		{name: "fail closed", onFailure: validate.FailClosed, decision: DecisionSkipped},
+		{name: "error", onFailure: validate.FailError, decision: DecisionFailed},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _, calls := newBatchTestServer(t, tt.onFailure, http.StatusInternalServerError)
+
+			task := AddUrlTask{Source: "a", URLs: []string{"http://phish.example/a", "no url"}}
+			response := addUrls(t, s, task)
+
+			if got := response.Results[0].Decision; got != tt.decision {
+				t.Errorf("decision = %q (%v), want %q", got, response.Results[0].Error, tt.decision)
+			}
+			if got := response.Results[1].Decision; got != DecisionRejected {
+				t.Errorf("invalid url decision = %q, want %q", got, DecisionRejected)
+			}
+			if calls.bulk != 1 {
+				t.Errorf("bulk calls = %v, want 1", calls.bulk)
+			}
+		})
+	}
+}
+
+// addUrls submits the multi url task and decodes the response
+func addUrls(t *testing.T, s *Server, task AddUrlTask) AddUrlsResponse {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/add", nil)
+
+	s.addUrls(c, task, false)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %v, want %v", w.Code, http.StatusOK)
+	}
+	var response AddUrlsResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Results) != len(task.URLs) {
+		t.Fatalf("results = %v, want %v", len(response.Results), len(task.URLs))
+	}
+	return response
+}
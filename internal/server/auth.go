@@ -0,0 +1,159 @@
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const bearerPrefix = "bearer "
+
+// formats of the auth_tokens values
+const (
+	TokenFormatPlain  string = "plain"
+	TokenFormatSha256 string = "sha256" // hex encoded digest
+	TokenFormatBcrypt string = "bcrypt" // "<token id>:<bcrypt hash>"
+)
+
+// bcrypt values are prefixed with the token id (the first chars of the token sha256), so only
+// the hash of the matching token is verified: an unknown token costs a sha256, not a bcrypt per token
+const tokenIDLen = 8
+
+// verified bcrypt tokens are cached (by digest), as bcrypt is deliberately slow
+var bcryptCacheTTL = 10 * time.Minute
+
+func isKnownTokenFormat(format string) bool {
+	switch format {
+	case "", TokenFormatPlain, TokenFormatSha256, TokenFormatBcrypt:
+		return true
+	}
+	return false
+}
+
+// validTokenHash reports whether the configured value is a valid hash in the given format
+func validTokenHash(format, val string) bool {
+	switch format {
+	case TokenFormatSha256:
+		digest, err := hex.DecodeString(val)
+		return err == nil && len(digest) == sha256.Size
+	case TokenFormatBcrypt:
+		id, hash, ok := splitBcryptValue(val)
+		if !ok || len(id) != tokenIDLen {
+			return false
+		}
+		if _, err := hex.DecodeString(id); err != nil {
+			return false
+		}
+		_, err := bcrypt.Cost([]byte(hash))
+		return err == nil
+	}
+	return true
+}
+
+// splitBcryptValue splits an auth_tokens bcrypt value into the token id and the hash
+func splitBcryptValue(val string) (string, string, bool) {
+	parts := strings.SplitN(val, ":", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// tokenID is the (public) bcrypt value prefix of the token
+func tokenID(token string) string {
+	return sha256Hex(token)[:tokenIDLen]
+}
+
+// HashToken returns the auth_tokens value for the plaintext token in the given format
+func HashToken(format, token string) (string, error) {
+	switch format {
+	case TokenFormatPlain:
+		return token, nil
+	case TokenFormatSha256:
+		return sha256Hex(token), nil
+	case TokenFormatBcrypt:
+		hash, err := bcrypt.GenerateFromPassword([]byte(token), bcrypt.DefaultCost)
+		if err != nil {
+			return "", err
+		}
+		return tokenID(token) + ":" + string(hash), nil
+	}
+	return "", fmt.Errorf("unknown auth token format: %q", format)
+}
+
+func sha256Hex(token string) string {
+	digest := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(digest[:])
+}
+
+// requestToken extracts the auth token from the Authorization header: "Bearer <token>",
+// or (with legacy auth enabled) the raw header value
+func (s *Server) requestToken(c *gin.Context) (string, bool) {
+	header := strings.TrimSpace(c.GetHeader(authHeader))
+	if len(header) > len(bearerPrefix) && strings.ToLower(header[:len(bearerPrefix)]) == bearerPrefix {
+		return strings.TrimSpace(header[len(bearerPrefix):]), true
+	}
+	if s.LegacyAuth && header != "" {
+		return header, true
+	}
+	return "", false
+}
+
+// tokenOwner returns the name of the auth token matching the given one,
+// tokens (or their digests) are compared in constant time
+func (s *Server) tokenOwner(token string) (string, bool) {
+	switch s.AuthTokenFormat {
+	case TokenFormatSha256:
+		return s.matchToken(sha256Hex(token), true)
+	case TokenFormatBcrypt:
+		return s.bcryptTokenOwner(token)
+	}
+	if s.LegacyAuth {
+		// plaintext tokens used to be matched case-insensitively
+		return s.matchToken(strings.ToLower(token), true)
+	}
+	return s.matchToken(token, false)
+}
+
+// matchToken looks up the configured value equal to val, optionally ignoring case
+func (s *Server) matchToken(val string, ignoreCase bool) (string, bool) {
+	var owner string
+	found := false
+	for name, configured := range s.AuthTokens {
+		configured = strings.TrimSpace(configured)
+		if ignoreCase {
+			configured = strings.ToLower(configured)
+		}
+		if subtle.ConstantTimeCompare([]byte(configured), []byte(val)) == 1 {
+			owner, found = name, true
+		}
+	}
+	return owner, found
+}
+
+func (s *Server) bcryptTokenOwner(token string) (string, bool) {
+	key := sha256Hex(token)
+	if owner, cached := s.verifiedTokens.Get(key); cached {
+		return owner.(string), true
+	}
+
+	id := tokenID(token)
+	for name, val := range s.AuthTokens {
+		valID, hash, _ := splitBcryptValue(strings.TrimSpace(val))
+		if valID != id {
+			continue
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(token)) == nil {
+			s.verifiedTokens.Set(key, name, cache.DefaultExpiration)
+			return name, true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/patrickmn/go-cache"
+)
+
+func TestTokenOwner(t *testing.T) {
+	tokens := map[string]string{"src_1": "token-one", "src_2": "token-two"}
+
+	tests := []struct {
+		format string
+		token  string
+		owner  string // empty if the token is unknown
+	}{
+		{format: TokenFormatPlain, token: "token-one", owner: "src_1"},
+		{format: TokenFormatPlain, token: "token-three"},
+		{format: TokenFormatSha256, token: "token-two", owner: "src_2"},
+		{format: TokenFormatSha256, token: "token-three"},
+		{format: TokenFormatBcrypt, token: "token-one", owner: "src_1"},
+		{format: TokenFormatBcrypt, token: "token-two", owner: "src_2"},
+		{format: TokenFormatBcrypt, token: "token-three"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.format+"/"+tt.token, func(t *testing.T) {
+			s := newAuthServer(t, tt.format, tokens)
+			owner, found := s.tokenOwner(tt.token)
+			if found != (tt.owner != "") || owner != tt.owner {
+				t.Errorf("tokenOwner = %q, %v, want %q", owner, found, tt.owner)
+			}
+		})
+	}
+}
+
+func TestBcryptUnknownTokensSkipHashing(t *testing.T) {
+	tokens := make(map[string]string)
+	for _, name := range []string{"src_1", "src_2", "src_3", "src_4", "src_5"} {
+		tokens[name] = "token-" + name
+	}
+	s := newAuthServer(t, TokenFormatBcrypt, tokens)
+
+	start := time.Now()
+	for i := 0; i < 20; i++ {
+		if _, found := s.tokenOwner("unknown-token"); found {
+			t.Fatal("unknown token accepted")
+		}
+	}
+	// a single bcrypt comparison (default cost) takes tens of milliseconds
+	if elapsed := time.Since(start); elapsed > 20*time.Millisecond {
+		t.Errorf("20 unknown token checks took %v, the hashes were compared", elapsed)
+	}
+}
+
+func TestValidTokenHash(t *testing.T) {
+	bcryptVal, err := HashToken(TokenFormatBcrypt, "token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash := bcryptVal[tokenIDLen+1:]
+
+	tests := []struct {
+		name   string
+		format string
+		val    string
+		valid  bool
+	}{
+		{name: "sha256", format: TokenFormatSha256, val: sha256Hex("token"), valid: true},
+		{name: "sha256 too short", format: TokenFormatSha256, val: "abcd"},
+		{name: "bcrypt with token id", format: TokenFormatBcrypt, val: bcryptVal, valid: true},
+		{name: "bcrypt without token id", format: TokenFormatBcrypt, val: hash},
+		{name: "bcrypt with a bad token id", format: TokenFormatBcrypt, val: "zzzzzzzz:" + hash},
+		{name: "bcrypt with a short token id", format: TokenFormatBcrypt, val: "abcd:" + hash},
+		{name: "bcrypt not a hash", format: TokenFormatBcrypt, val: tokenID("token") + ":token"},
+		{name: "plain", format: TokenFormatPlain, val: "token", valid: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if valid := validTokenHash(tt.format, tt.val); valid != tt.valid {
+				t.Errorf("validTokenHash(%q) = %v, want %v", tt.val, valid, tt.valid)
+			}
+		})
+	}
+}
+
+// newAuthServer configures the plaintext tokens hashed in the given format
+func newAuthServer(t *testing.T, format string, tokens map[string]string) *Server {
+	t.Helper()
+	authTokens := make(map[string]string, len(tokens))
+	for name, token := range tokens {
+		val, err := HashToken(format, token)
+		if err != nil {
+			t.Fatal(err)
+		}
+		authTokens[name] = val
+	}
+	return &Server{
+		AuthTokens:      authTokens,
+		AuthTokenFormat: format,
+		verifiedTokens:  cache.New(bcryptCacheTTL, time.Minute),
+	}
+}
@@ -0,0 +1,30 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+const defaultMaxBodySize int64 = 1 << 20 // 1Mb
+
+// errBodyTooLarge is the (untyped) error returned by http.MaxBytesReader once the limit is exceeded
+const errBodyTooLarge = "http: request body too large"
+
+func isBodyTooLarge(err error) bool {
+	return err != nil && err.Error() == errBodyTooLarge
+}
+
+// bodyLimitMiddleware caps the request body size, requests declaring a larger body are rejected upfront,
+// the others fail reading past the limit
+func (s *Server) bodyLimitMiddleware(maxSize int64) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.Request.ContentLength > maxSize {
+			s.writeResponse(c, http.StatusRequestEntityTooLarge, fmt.Sprintf("request body exceeds %v bytes", maxSize))
+			return
+		}
+		c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, maxSize)
+		c.Next()
+	}
+}
@@ -0,0 +1,68 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestBodyLimitMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const maxSize = 64
+
+	s := &Server{}
+	router := gin.New()
+	router.Use(s.bodyLimitMiddleware(maxSize))
+	// binds the body like addUrl does
+	router.POST("/add", func(c *gin.Context) {
+		var task AddUrlTask
+		if err := c.ShouldBindJSON(&task); err != nil {
+			status := http.StatusBadRequest
+			if isBodyTooLarge(err) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			s.writeResponse(c, status, err.Error())
+			return
+		}
+		s.writeResponse(c, http.StatusOK, task)
+	})
+
+	small := `{"url": "http://a.com", "source": "src"}`
+	large := `{"url": "http://a.com/` + strings.Repeat("x", 2*maxSize) + `", "source": "src"}`
+
+	tests := []struct {
+		name    string
+		body    string
+		chunked bool // no content length, the limit is hit while reading
+		status  int
+	}{
+		{name: "within the limit", body: small, status: http.StatusOK},
+		{name: "declared oversized body", body: large, status: http.StatusRequestEntityTooLarge},
+		{name: "chunked oversized body", body: large, chunked: true, status: http.StatusRequestEntityTooLarge},
+		{name: "chunked body within the limit", body: small, chunked: true, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var body io.Reader = strings.NewReader(tt.body)
+			if tt.chunked {
+				body = io.MultiReader(body) // hides the length from NewRequest
+			}
+			req := httptest.NewRequest(http.MethodPost, "/add", body)
+			req.Header.Set("Content-Type", "application/json")
+			if !tt.chunked && req.ContentLength != int64(len(tt.body)) {
+				t.Fatalf("content length = %v, want %v", req.ContentLength, len(tt.body))
+			}
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status = %v, want %v (body: %v)", rec.Code, tt.status, rec.Body.String())
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CorsConfig lets browser clients (from the allowed origins only) call the api,
+// cors is disabled while allowed_origins is empty
+type CorsConfig struct {
+	AllowedOrigins []string      `yaml:"allowed_origins"` // e.g. https://ui.example.com, no wildcards
+	AllowedMethods []string      `yaml:"allowed_methods"` // default: GET, POST
+	AllowedHeaders []string      `yaml:"allowed_headers"` // default: Authorization, Content-Type, X-Request-ID, X-No-Cache, traceparent
+	MaxAge         time.Duration `yaml:"max_age"`         // preflight cache time, default: 10m
+}
+
+var (
+	defaultCorsMethods = []string{http.MethodGet, http.MethodPost}
+	defaultCorsHeaders = []string{authHeader, "Content-Type", requestIDHeader, noCacheHeader, traceparentHeader}
+	defaultCorsMaxAge  = 10 * time.Minute
+)
+
+func (c CorsConfig) Enabled() bool {
+	return len(c.AllowedOrigins) > 0
+}
+
+func (c CorsConfig) errors(cfgName string) []string {
+	var errs []string
+	for _, origin := range c.AllowedOrigins {
+		parsed, err := url.Parse(origin)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" || strings.Contains(origin, "*") ||
+			strings.TrimSuffix(parsed.Path, "/") != "" {
+			errs = append(errs, fmt.Sprintf("%v invalid val: 'cors.allowed_origins' (%v, expected scheme://host[:port])", cfgName, origin))
+		}
+	}
+	if c.MaxAge < 0 {
+		errs = append(errs, fmt.Sprintf("%v invalid val: 'cors.max_age'", cfgName))
+	}
+	return errs
+}
+
+// corsMiddleware sets the cors headers for allowed origins and answers preflight requests,
+// requests from other origins get no cors headers (so browsers block them)
+func corsMiddleware(cfg CorsConfig) gin.HandlerFunc {
+	origins := make(map[string]bool, len(cfg.AllowedOrigins))
+	for _, origin := range cfg.AllowedOrigins {
+		origins[strings.TrimSuffix(origin, "/")] = true
+	}
+
+	methods := cfg.AllowedMethods
+	if len(methods) == 0 {
+		methods = defaultCorsMethods
+	}
+	headers := cfg.AllowedHeaders
+	if len(headers) == 0 {
+		headers = defaultCorsHeaders
+	}
+	maxAge := cfg.MaxAge
+	if maxAge == 0 {
+		maxAge = defaultCorsMaxAge
+	}
+
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+	maxAgeSecs := strconv.Itoa(int(maxAge.Seconds()))
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" {
+			c.Next()
+			return
+		}
+
+		c.Writer.Header().Add("Vary", "Origin")
+		if !origins[origin] {
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", origin)
+		c.Header("Access-Control-Expose-Headers", requestIDHeader+", "+traceparentHeader)
+
+		if c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != "" {
+			c.Header("Access-Control-Allow-Methods", allowMethods)
+			c.Header("Access-Control-Allow-Headers", allowHeaders)
+			c.Header("Access-Control-Max-Age", maxAgeSecs)
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"time"
+
+	mt "phish-api/internal/metrics"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// DedupConfig drops resubmissions of a (normalized) url published within the window,
+// it's an in-memory, per instance check (unlike the elastic based resubmit check)
+type DedupConfig struct {
+	Window time.Duration `yaml:"window"` // 0 = disabled
+}
+
+func newDedupCache(cfg DedupConfig) *cache.Cache {
+	if cfg.Window <= 0 {
+		return nil
+	}
+	return cache.New(cfg.Window, time.Minute)
+}
+
+// claimUrl reserves the url for publishing, false means it was published (or is being published)
+// within the dedup window
+func (s *Server) claimUrl(url string) bool {
+	if s.recentUrls == nil {
+		return true
+	}
+	if err := s.recentUrls.Add(url, time.Now(), cache.DefaultExpiration); err != nil {
+		mt.DedupHits.Inc()
+		return false
+	}
+	return true
+}
+
+// releaseUrl drops the claim of a url which ended up not being published
+func (s *Server) releaseUrl(url string) {
+	if s.recentUrls != nil {
+		s.recentUrls.Delete(url)
+	}
+}
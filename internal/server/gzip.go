@@ -0,0 +1,108 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	defaultGzipMinSize int = 1024
+)
+
+// gzipWriter buffers the response body so the middleware can decide whether it's worth compressing
+type gzipWriter struct {
+	gin.ResponseWriter
+	buf bytes.Buffer
+}
+
+func (w *gzipWriter) Write(data []byte) (int, error) {
+	return w.buf.Write(data)
+}
+
+func (w *gzipWriter) WriteString(s string) (int, error) {
+	return w.buf.WriteString(s)
+}
+
+// gzipMiddleware compresses responses of at least minSize bytes for clients accepting gzip
+func gzipMiddleware(minSize int) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if !acceptsGzip(c.GetHeader("Accept-Encoding")) {
+			c.Next()
+			return
+		}
+
+		original := c.Writer
+		writer := &gzipWriter{ResponseWriter: original}
+		c.Writer = writer
+		c.Next()
+		c.Writer = original
+
+		body := writer.buf.Bytes()
+		header := original.Header()
+		header.Add("Vary", "Accept-Encoding")
+
+		// too small or already encoded by the handler (e.g. promhttp) -> write as is
+		if len(body) < minSize || header.Get("Content-Encoding") != "" {
+			original.Write(body)
+			return
+		}
+
+		var compressed bytes.Buffer
+		gz := gzip.NewWriter(&compressed)
+		if _, err := gz.Write(body); err != nil {
+			original.Write(body)
+			return
+		}
+		if err := gz.Close(); err != nil {
+			original.Write(body)
+			return
+		}
+
+		header.Set("Content-Encoding", "gzip")
+		header.Set("Content-Length", fmt.Sprintf("%v", compressed.Len()))
+		original.Write(compressed.Bytes())
+	}
+}
+
+// acceptsGzip reports whether the Accept-Encoding list allows gzip: listed (or matched by "*")
+// with a non-zero q value. Only the "gzip" token is recognized, not the legacy "x-gzip"
+func acceptsGzip(header string) bool {
+	gzipQ, wildcardQ := -1.0, -1.0
+	for _, part := range strings.Split(header, ",") {
+		params := strings.Split(part, ";")
+		coding := strings.ToLower(strings.TrimSpace(params[0]))
+		if coding != "gzip" && coding != "*" {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			if len(kv) != 2 || strings.ToLower(strings.TrimSpace(kv[0])) != "q" {
+				continue
+			}
+			parsed, err := strconv.ParseFloat(strings.TrimSpace(kv[1]), 64)
+			if err != nil || parsed < 0 || parsed > 1 {
+				parsed = 0 // malformed q -> not acceptable
+			}
+			q = parsed
+		}
+
+		if coding == "gzip" {
+			gzipQ = q
+		} else {
+			wildcardQ = q
+		}
+	}
+
+	// an explicit gzip entry wins over the wildcard
+	if gzipQ >= 0 {
+		return gzipQ > 0
+	}
+	return wildcardQ > 0
+}
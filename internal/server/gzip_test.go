@@ -0,0 +1,79 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{header: "", want: false},
+		{header: "gzip", want: true},
+		{header: "GZIP", want: true},
+		{header: "deflate, gzip;q=0.5", want: true},
+		{header: "gzip;q=0", want: false},
+		{header: "gzip; q=0.0", want: false},
+		{header: "gzip;q=0.001", want: true},
+		{header: "gzip;q=abc", want: false},
+		{header: "x-gzip", want: false},
+		{header: "br, x-gzip;q=1", want: false},
+		{header: "notgzip", want: false},
+		{header: "*", want: true},
+		{header: "*;q=0", want: false},
+		{header: "gzip;q=0, *", want: false},
+		{header: "*;q=0, gzip", want: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.header, func(t *testing.T) {
+			if got := acceptsGzip(tt.header); got != tt.want {
+				t.Errorf("acceptsGzip(%q) = %v, want %v", tt.header, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestGzipMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const minSize = 16
+
+	router := gin.New()
+	router.Use(gzipMiddleware(minSize))
+	router.GET("/large", func(c *gin.Context) { c.String(http.StatusOK, strings.Repeat("x", 2*minSize)) })
+	router.GET("/small", func(c *gin.Context) { c.String(http.StatusOK, "x") })
+
+	tests := []struct {
+		name           string
+		path           string
+		acceptEncoding string
+		wantGzip       bool
+	}{
+		{name: "large body", path: "/large", acceptEncoding: "gzip", wantGzip: true},
+		{name: "small body", path: "/small", acceptEncoding: "gzip"},
+		{name: "gzip refused", path: "/large", acceptEncoding: "gzip;q=0"},
+		{name: "x-gzip only", path: "/large", acceptEncoding: "x-gzip"},
+		{name: "no accept encoding", path: "/large"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, tt.path, nil)
+			if tt.acceptEncoding != "" {
+				req.Header.Set("Accept-Encoding", tt.acceptEncoding)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+
+			if gzipped := w.Header().Get("Content-Encoding") == "gzip"; gzipped != tt.wantGzip {
+				t.Errorf("gzipped = %v, want %v", gzipped, tt.wantGzip)
+			}
+		})
+	}
+}
@@ -0,0 +1,17 @@
+package server
+
+import (
+	"time"
+
+	mt "phish-api/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// latencyMiddleware records the request duration by route template (not the resolved path) and method
+func latencyMiddleware(c *gin.Context) {
+	start := time.Now()
+	c.Next()
+
+	mt.ObserveRequest(c.FullPath(), c.Request.Method, time.Since(start).Seconds())
+}
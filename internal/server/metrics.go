@@ -0,0 +1,87 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	lg "phish-api/internal/logging"
+	mt "phish-api/internal/metrics"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MetricsConfig isolates /metrics: a separate (internal) listener and/or the api auth
+type MetricsConfig struct {
+	// port or host:port (see listen) of a separate metrics listener, empty = served by the api listener
+	Listen string `yaml:"listen"`
+	// require an api auth token
+	Auth bool `yaml:"auth"`
+	// distinct values kept per metric label, later new values are counted as "other", 0 = unlimited
+	MaxLabelValues int `yaml:"max_label_values"`
+}
+
+func (c MetricsConfig) errors(cfgName string) []string {
+	var errs []string
+	if c.Listen != "" {
+		if _, err := listenAddr(c.Listen); err != nil {
+			errs = append(errs, fmt.Sprintf("%v invalid val: 'metrics.listen' (%v)", cfgName, err))
+		}
+	}
+	if c.MaxLabelValues < 0 {
+		errs = append(errs, fmt.Sprintf("%v invalid val: 'metrics.max_label_values'", cfgName))
+	}
+	return errs
+}
+
+// registerMetrics serves /metrics on the api router, or on a separate listener if configured
+func (s *Server) registerMetrics(router *gin.Engine, cfg MetricsConfig) error {
+	mt.SetMaxLabelValues(cfg.MaxLabelValues)
+
+	handlers := []gin.HandlerFunc{mt.PrometheusHandler()}
+	if cfg.Auth {
+		handlers = append([]gin.HandlerFunc{s.middlewareHandler}, handlers...)
+	}
+
+	if cfg.Listen == "" {
+		router.GET("/metrics", handlers...)
+		return nil
+	}
+
+	addr, err := listenAddr(cfg.Listen)
+	if err != nil {
+		return err
+	}
+	metricsRouter := gin.New()
+	metricsRouter.Use(gin.Recovery())
+	metricsRouter.GET("/metrics", handlers...)
+
+	s.MetricsSrv = &http.Server{
+		Addr:              addr,
+		Handler:           metricsRouter,
+		ReadHeaderTimeout: defaultReadHeaderTimeout,
+	}
+	return nil
+}
+
+// upMetrics runs the separate metrics listener (if any) in background
+func (s *Server) upMetrics() {
+	if s.MetricsSrv == nil {
+		return
+	}
+	lg.Info("starting up metrics http server", lg.Fields{"addr": s.MetricsSrv.Addr})
+	go func() {
+		if err := s.MetricsSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			lg.Error("metrics http server fail", lg.Fields{"addr": s.MetricsSrv.Addr, "error": err})
+		}
+	}()
+}
+
+func (s *Server) downMetrics(ctx context.Context) {
+	if s.MetricsSrv == nil {
+		return
+	}
+	if err := s.MetricsSrv.Shutdown(ctx); err != nil {
+		lg.Warn("metrics http server shutdown error", lg.Fields{"error": err})
+	}
+}
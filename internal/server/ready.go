@@ -0,0 +1,48 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"phish-api/internal/publisher"
+
+	"github.com/gin-gonic/gin"
+)
+
+// readyTimeout bounds every dependency probe of the readiness check
+const readyTimeout = 3 * time.Second
+
+// ready checks the downstream dependencies, responds 503 with a per dependency breakdown
+// if any of them is down (unlike /status, which is a cheap liveness check)
+func (s *Server) ready(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readyTimeout)
+	defer cancel()
+
+	checks := gin.H{}
+	healthy := true
+	check := func(name string, err error) {
+		if err != nil {
+			healthy = false
+			checks[name] = err.Error()
+			return
+		}
+		checks[name] = "ok"
+	}
+
+	if s.Publisher.Connected() {
+		check(s.Publisher.Backend(), nil)
+	} else {
+		check(s.Publisher.Backend(), publisher.ErrNotConnected)
+	}
+	check("elastic", s.Elastic.Ping(ctx))
+	if s.ReadyCheckWhitelister {
+		check("whitelister", s.Validator.Whitelister.Ping(ctx))
+	}
+
+	status := http.StatusOK
+	if !healthy {
+		status = http.StatusServiceUnavailable
+	}
+	c.JSON(status, gin.H{"ready": healthy, "checks": checks})
+}
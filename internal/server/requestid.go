@@ -0,0 +1,42 @@
+package server
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestIDKey is the gin context key of the request id
+const requestIDKey = "request_id"
+
+// maxRequestIDLength caps client supplied ids (they end up in logs, elastic and rabbit headers)
+const maxRequestIDLength = 128
+
+// requestIDMiddleware takes the request id from the X-Request-ID header or generates one,
+// and echoes it in the response header
+func requestIDMiddleware(c *gin.Context) {
+	requestID := c.GetHeader(requestIDHeader)
+	if requestID == "" || len(requestID) > maxRequestIDLength {
+		requestID = newRequestID()
+	}
+	c.Set(requestIDKey, requestID)
+	c.Header(requestIDHeader, requestID)
+	c.Next()
+}
+
+// requestID returns the id of the request (set by the request id middleware)
+func requestID(c *gin.Context) string {
+	return c.GetString(requestIDKey)
+}
+
+// newRequestID returns a random (version 4) uuid
+func newRequestID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return ""
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"phish-api/internal/elastic"
+
+	"github.com/elastic/go-elasticsearch/v6"
+	"github.com/gin-gonic/gin"
+)
+
+func TestFindRecentSubmission(t *testing.T) {
+	lastSeen := time.Date(2021, 10, 1, 12, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		check    ResubmitCheckConfig
+		source   string
+		status   int // of the search, 0 = the url was logged
+		seen     bool
+		searches int
+	}{
+		{name: "disabled", check: ResubmitCheckConfig{Lookback: time.Hour}, source: "a"},
+		{name: "all sources", check: ResubmitCheckConfig{Enabled: true, Lookback: time.Hour}, source: "a", seen: true, searches: 1},
+		{name: "listed source", check: ResubmitCheckConfig{Enabled: true, Lookback: time.Hour, Sources: []string{"a"}}, source: "a", seen: true, searches: 1},
+		{name: "unlisted source", check: ResubmitCheckConfig{Enabled: true, Lookback: time.Hour, Sources: []string{"a"}}, source: "b"},
+		{
+			name: "search error doesn't block the submission", check: ResubmitCheckConfig{Enabled: true, Lookback: time.Hour},
+			source: "a", status: http.StatusInternalServerError, searches: 1,
+		},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			searches := 0
+			es := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				searches++
+				if tt.status != 0 {
+					w.WriteHeader(tt.status)
+					return
+				}
+				fmt.Fprintf(w, `{"hits": {"hits": [{"_source": {"url": "http://a.com/", "time": %q}}]}}`, lastSeen.Format(time.RFC3339))
+			}))
+			defer es.Close()
+			client, err := elasticsearch.NewClient(elasticsearch.Config{Addresses: []string{es.URL}})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s := &Server{Elastic: &elastic.Elastic{Client: client, Index: "logs"}, ResubmitCheck: tt.check}
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/add", nil)
+
+			found := s.findRecentSubmission(c, AddUrlTask{URL: "http://a.com/", Source: tt.source})
+			if searches != tt.searches {
+				t.Errorf("searches = %v, want %v", searches, tt.searches)
+			}
+			if seen := found != nil; seen != tt.seen {
+				t.Fatalf("seen = %v, want %v", seen, tt.seen)
+			}
+			if tt.seen && !found.When.Equal(lastSeen) {
+				t.Errorf("last seen = %v, want %v", found.When, lastSeen)
+			}
+		})
+	}
+}
@@ -2,42 +2,106 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"reflect"
+	"strconv"
 	"strings"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
 	"phish-api/internal/elastic"
+	lg "phish-api/internal/logging"
 	mt "phish-api/internal/metrics"
-	"phish-api/internal/rabbitmq"
+	"phish-api/internal/publisher"
 	"phish-api/internal/validate"
 
 	"github.com/gin-gonic/gin"
+	"github.com/patrickmn/go-cache"
 )
 
 const (
-	authHeader string = "Authorization"
+	authHeader      string = "Authorization"
+	requestIDHeader string = "X-Request-ID"
+	noCacheHeader   string = "X-No-Cache"
 )
 
 var (
 	ok_statuses = []int{200, 201, 204, 301, 302, 304}
+
+	defaultShutdownTimeout   = 15 * time.Second
+	defaultReadTimeout       = 30 * time.Second
+	defaultReadHeaderTimeout = 10 * time.Second
+	defaultWriteTimeout      = 60 * time.Second // covers the whitelister retries of add url
+	defaultIdleTimeout       = 2 * time.Minute
+	defaultAddUrlTimeout     = 30 * time.Second // below the write timeout, so the 504 reaches the client
+
+	urlStatusCacheTTL = 10 * time.Second
 )
 
 type AddUrlTask struct {
-	Source string `json:"source"`
-	Store  bool   `json:"store,omitempty"`
-	URL    string `json:"url"`
+	Source    string            `json:"source"`
+	Store     bool              `json:"store,omitempty"` // record (log) the url without publishing it, skipped urls are never stored
+	URL       string            `json:"url"`
+	URLs      []string          `json:"urls,omitempty"`       // instead of url: several urls sharing the other fields
+	ExpiresAt *time.Time        `json:"expires_at,omitempty"` // the url is not worth processing after this moment
+	Metadata  map[string]string `json:"metadata,omitempty"`
+	Engine    string            `json:"engine,omitempty"` // preferred scanning engine hint
+	// routing key the task is published with (topic exchanges), empty by default
+	RoutingKey string `json:"routing_key,omitempty"`
+}
+
+const (
+	DecisionPublished = "published" // queued to rabbit
+	DecisionStored    = "stored"    // store task, logged only
+	DecisionSkipped   = "skipped"   // does not need processing, see the reason
+	DecisionDuplicate = "duplicate" // published within the dedup window
+	DecisionRejected  = "rejected"  // invalid url (multi url tasks only, see the error)
+	DecisionFailed    = "failed"    // the url could not be checked / queued (multi url tasks only, see the error)
+)
+
+// AddUrlResponse is the outcome of an accepted add url request (bad input gets a 4xx error instead)
+type AddUrlResponse struct {
+	Decision  string            `json:"decision"`
+	Reason    string            `json:"reason,omitempty"`
+	URL       string            `json:"url"`
+	Domain    string            `json:"domain,omitempty"`
+	RequestID string            `json:"request_id,omitempty"`
+	LastSeen  *time.Time        `json:"last_seen,omitempty"` // previous submission (already_submitted)
+	Verdict   *validate.Verdict `json:"verdict,omitempty"`
+	Error     string            `json:"error,omitempty"` // rejected / failed urls of multi url tasks
+}
+
+// AddUrlsResponse is the outcome of a multi url task: a result per url (in the task order)
+// and the number of urls per decision
+type AddUrlsResponse struct {
+	Results   []*AddUrlResponse `json:"results"`
+	Summary   map[string]int    `json:"summary"`
+	RequestID string            `json:"request_id,omitempty"`
+}
+
+func (s *Server) newAddUrlResponse(c *gin.Context, task AddUrlTask, decision, reason string) *AddUrlResponse {
+	return &AddUrlResponse{
+		Decision:  decision,
+		Reason:    reason,
+		URL:       task.URL,
+		Domain:    s.getDomain(task.URL),
+		RequestID: requestID(c),
+	}
 }
 
 func (t AddUrlTask) String() string {
-	return fmt.Sprintf("src: %v, store: %v, url: %v", t.Source, t.Store, t.URL)
+	return fmt.Sprintf("src: %v, store: %v, url: %v, expires at: %v", t.Source, t.Store, t.URL, t.ExpiresAt)
 }
 
-func (t AddUrlTask) Validate() (bool, error) {
+// Validate checks the task, schemeAllowed tells the url schemes accepted by the validator
+func (t AddUrlTask) Validate(rules TaskRules, schemeAllowed func(string) bool) (bool, error) {
 	var errs []string
 	valid := true
 
@@ -46,67 +110,386 @@ func (t AddUrlTask) Validate() (bool, error) {
 		errs = append(errs, "source is empty")
 	}
 
-	if t.URL == "" {
+	// the urls of multi url tasks are validated one by one (an invalid one doesn't reject the others)
+	if len(t.URLs) > 0 {
+		if t.URL != "" {
+			valid = false
+			errs = append(errs, "url and urls are mutually exclusive")
+		}
+		if len(t.URLs) > rules.MaxUrls {
+			valid = false
+			errs = append(errs, fmt.Sprintf("too many urls: %v (max: %v)", len(t.URLs), rules.MaxUrls))
+		}
+
+	} else if err := validateTaskUrl(t.URL, rules, schemeAllowed); err != nil {
 		valid = false
-		errs = append(errs, "url is empty")
+		errs = append(errs, err.Error())
+	}
 
-	} else {
-		parsed, err := url.Parse(t.URL)
-		if err != nil {
+	if t.ExpiresAt != nil && !t.ExpiresAt.After(time.Now()) {
+		valid = false
+		errs = append(errs, fmt.Sprintf("expires_at is not in the future: %v", t.ExpiresAt))
+	}
+
+	if t.RoutingKey != "" && !validRoutingKey(t.RoutingKey) {
+		valid = false
+		errs = append(errs, fmt.Sprintf("invalid routing_key: '%v' (dot separated words of letters, digits, '-' and '_', max length: %v)",
+			t.RoutingKey, maxRoutingKeyLength))
+	}
+
+	if t.Engine != "" && !rules.isKnownEngine(t.Engine) {
+		valid = false
+		errs = append(errs, fmt.Sprintf("unknown engine: %v", t.Engine))
+	}
+
+	if len(t.Metadata) > rules.MetadataMaxKeys {
+		valid = false
+		errs = append(errs, fmt.Sprintf("too many metadata keys: %v (max: %v)", len(t.Metadata), rules.MetadataMaxKeys))
+	}
+
+	valuesSize := 0
+	for key, val := range t.Metadata {
+		if len(key) > rules.MetadataMaxKeyLength {
 			valid = false
-			errs = append(errs, fmt.Sprintf("invalid url (can't parse): %v", err))
+			errs = append(errs, fmt.Sprintf("metadata key is too long: %v... (max length: %v)",
+				truncateUtf8(key, rules.MetadataMaxKeyLength), rules.MetadataMaxKeyLength))
+		}
+		valuesSize += len(val)
+	}
 
-		} else {
-			scheme := parsed.Scheme
-			if scheme != "http" && scheme != "https" {
-				valid = false
-				errs = append(errs, fmt.Sprintf("invalid scheme in url: %v", scheme))
+	if valuesSize > rules.MetadataMaxValuesSize {
+		valid = false
+		errs = append(errs, fmt.Sprintf("metadata values are too large: %v bytes (max: %v)", valuesSize, rules.MetadataMaxValuesSize))
+	}
+
+	return valid, errors.New(strings.Join(errs, ", "))
+}
+
+// truncateUtf8 cuts s to at most n bytes without splitting a multi-byte rune
+func truncateUtf8(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// maxRoutingKeyLength is the amqp limit (short string)
+const maxRoutingKeyLength = 255
+
+// validRoutingKey accepts dot separated words (e.g. "src_1.phishing") without the binding wildcards (* and #)
+func validRoutingKey(key string) bool {
+	if len(key) > maxRoutingKeyLength {
+		return false
+	}
+	for _, word := range strings.Split(key, ".") {
+		if word == "" {
+			return false
+		}
+		for _, r := range word {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_') {
+				return false
 			}
 		}
 	}
+	return true
+}
 
-	return valid, errors.New(strings.Join(errs, ", "))
+// validateTaskUrl checks a submitted url fits the max length, can be parsed, has an allowed scheme
+// and a valid host
+func validateTaskUrl(rawUrl string, rules TaskRules, schemeAllowed func(string) bool) error {
+	if rawUrl == "" {
+		return errors.New("url is empty")
+	}
+	if len(rawUrl) > rules.MaxUrlLength {
+		return fmt.Errorf("url is too long: %v chars (max: %v)", len(rawUrl), rules.MaxUrlLength)
+	}
+	for _, r := range rawUrl {
+		if unicode.IsControl(r) {
+			return fmt.Errorf("url contains a control character: %q", r)
+		}
+	}
+
+	parsed, err := url.Parse(rawUrl)
+	if err != nil {
+		return fmt.Errorf("invalid url (can't parse): %v", err)
+	}
+	if parsed.Scheme == "" {
+		return errors.New("url has no scheme (scheme-relative urls are not accepted)")
+	}
+	if !schemeAllowed(parsed.Scheme) {
+		return fmt.Errorf("invalid scheme in url: %v", parsed.Scheme)
+	}
+	if err := validate.CheckHostname(parsed.Hostname()); err != nil {
+		return err
+	}
+	return nil
+}
+
+// TaskRules bounds the size and allowed values of submitted tasks
+type TaskRules struct {
+	MaxUrls               int `yaml:"max_urls"`       // urls of a multi url task
+	MaxUrlLength          int `yaml:"max_url_length"` // default: 2048
+	MetadataMaxKeys       int `yaml:"metadata_max_keys"`
+	MetadataMaxKeyLength  int `yaml:"metadata_max_key_length"`
+	MetadataMaxValuesSize int `yaml:"metadata_max_values_size"` // total size (bytes) of all metadata values
+
+	Engines []string `yaml:"engines"` // known scanning engines a task may hint at
+}
+
+func (r TaskRules) isKnownEngine(engine string) bool {
+	for _, val := range r.Engines {
+		if val == engine {
+			return true
+		}
+	}
+	return false
+}
+
+// taskRules returns the configured task rules, falling back to the deprecated task_limits key
+func (c *HttpConfig) taskRules() TaskRules {
+	if c.TaskLimits != nil {
+		return *c.TaskLimits
+	}
+	return c.TaskRules
+}
+
+// withDefaults fills unset limits with defaults
+func (r TaskRules) withDefaults() TaskRules {
+	if r.MaxUrls == 0 {
+		r.MaxUrls = 100
+	}
+	if r.MaxUrlLength == 0 {
+		r.MaxUrlLength = 2048
+	}
+	if r.MetadataMaxKeys == 0 {
+		r.MetadataMaxKeys = 20
+	}
+	if r.MetadataMaxKeyLength == 0 {
+		r.MetadataMaxKeyLength = 64
+	}
+	if r.MetadataMaxValuesSize == 0 {
+		r.MetadataMaxValuesSize = 4096
+	}
+	return r
+}
+
+// AuditEvent is a compact submission event published to the audit exchange
+type AuditEvent struct {
+	URL       string    `json:"url"`
+	Source    string    `json:"source"`
+	Verdict   string    `json:"verdict"`
+	Timestamp time.Time `json:"timestamp"`
+	RequestID string    `json:"request_id,omitempty"`
 }
 
 type HttpConfig struct {
+	// port ("8000", all interfaces) or host:port ("127.0.0.1:8000", ":8000")
 	Listen     string            `yaml:"listen"`
 	AuthTokens map[string]string `yaml:"auth_tokens"`
+	// names of auth tokens allowed to use admin features (e.g. cache bypass)
+	AdminTokens []string `yaml:"admin_tokens"`
+	// source applied when a request omits it, keyed by auth token name
+	DefaultSources map[string]string `yaml:"default_sources"`
+	Gzip           bool              `yaml:"gzip"`
+	GzipMinSize    int               `yaml:"gzip_min_size"` // responses below this size (bytes) are not compressed
+
+	// task sources accepted (403 otherwise), default: any
+	Sources SourcesConfig `yaml:"sources"`
+
+	ResubmitCheck ResubmitCheckConfig `yaml:"resubmit_check"`
+	Dedup         DedupConfig         `yaml:"dedup"`
+	TaskRules     TaskRules           `yaml:"task_rules"`
+	TaskLimits    *TaskRules          `yaml:"task_limits"` // deprecated: former name of task_rules
+
+	// grace period for in-flight requests on shutdown
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// connection timeouts (defaults are used when unset)
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"` // slow clients sending headers (slow-loris)
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	// deadline of a whole add url request (dns, whitelister retries, publishing), 504 once exceeded
+	AddUrlTimeout time.Duration `yaml:"add_url_timeout"`
+
+	// serve https when both are set (pem encoded)
+	CertFile string `yaml:"cert_file"`
+	KeyFile  string `yaml:"key_file"`
+
+	// whether /ready also probes the whitelister api
+	ReadyCheckWhitelister bool `yaml:"ready_check_whitelister"`
+
+	// also accept the raw token (without the bearer scheme) in the auth header
+	LegacyAuth bool `yaml:"legacy_auth"`
+	// browser clients, disabled by default
+	Cors CorsConfig `yaml:"cors"`
+
+	// /metrics listener & auth, default: the api listener, no auth
+	Metrics MetricsConfig `yaml:"metrics"`
+
+	// request body size limit (bytes), default 1Mb
+	MaxBodySize int64 `yaml:"max_body_size"`
+
+	// format of the auth_tokens values: plain (default), sha256 (hex) or bcrypt ("<token id>:<hash>"),
+	// hashes are generated with the -hash-token flag
+	AuthTokenFormat string `yaml:"auth_token_format"`
+}
+
+// ResubmitCheckConfig makes add url look up (in elastic) whether the url was already submitted
+// within the lookback window, in which case it is not published again
+type ResubmitCheckConfig struct {
+	Enabled  bool          `yaml:"enabled"`
+	Lookback time.Duration `yaml:"lookback"`
+	Sources  []string      `yaml:"sources"` // empty list means all sources
+}
+
+func (c ResubmitCheckConfig) appliesTo(source string) bool {
+	if !c.Enabled {
+		return false
+	}
+	if len(c.Sources) == 0 {
+		return true
+	}
+	for _, val := range c.Sources {
+		if val == source {
+			return true
+		}
+	}
+	return false
 }
 
 func (c *HttpConfig) IsValid() bool {
-	var (
-		valid = true
-		errs  []string
-	)
+	errs := c.Errors()
+	if len(errs) > 0 {
+		lg.Error("http config is invalid", lg.Fields{"errors": errs})
+	}
+	return len(errs) == 0
+}
+
+// Errors lists every problem of the config
+func (c *HttpConfig) Errors() []string {
+	var errs []string
 
 	cfgName := "http"
 	if c.Listen == "" {
-		valid = false
 		errs = append(errs, fmt.Sprintf("%v empty val: 'listen'", cfgName))
+	} else if _, err := listenAddr(c.Listen); err != nil {
+		errs = append(errs, fmt.Sprintf("%v invalid val: 'listen' (%v)", cfgName, err))
 	}
 
 	if len(c.AuthTokens) == 0 {
 		errs = append(errs, fmt.Sprintf("%v empty val: 'auth_tokens'", cfgName))
 	}
 
-	if len(errs) > 0 {
-		log.Printf("config is invalid; errors: %v", strings.Join(errs, ", "))
+	if !isKnownTokenFormat(c.AuthTokenFormat) {
+		errs = append(errs, fmt.Sprintf("%v invalid val: 'auth_token_format'", cfgName))
+	} else {
+		for name, val := range c.AuthTokens {
+			if !validTokenHash(c.AuthTokenFormat, strings.TrimSpace(val)) {
+				errs = append(errs, fmt.Sprintf("%v invalid val: 'auth_tokens.%v' (not a %v hash)", cfgName, name, c.AuthTokenFormat))
+			}
+		}
+	}
+
+	if c.Dedup.Window < 0 {
+		errs = append(errs, fmt.Sprintf("%v invalid val: 'dedup.window'", cfgName))
+	}
+
+	if c.ResubmitCheck.Enabled && c.ResubmitCheck.Lookback <= 0 {
+		errs = append(errs, fmt.Sprintf("%v invalid val: 'resubmit_check.lookback'", cfgName))
+	}
+
+	for _, name := range c.AdminTokens {
+		if _, found := c.AuthTokens[name]; !found {
+			errs = append(errs, fmt.Sprintf("%v invalid val: 'admin_tokens' (unknown token: %v)", cfgName, name))
+		}
+	}
+
+	for name, source := range c.DefaultSources {
+		if _, found := c.AuthTokens[name]; !found || source == "" {
+			errs = append(errs, fmt.Sprintf("%v invalid val: 'default_sources.%v'", cfgName, name))
+		}
+	}
+
+	if c.TaskLimits != nil && !reflect.DeepEqual(c.TaskRules, TaskRules{}) {
+		errs = append(errs, fmt.Sprintf("%v invalid val: both 'task_rules' and (deprecated) 'task_limits' are set", cfgName))
 	}
-	return valid
+
+	rules := c.taskRules()
+	if rules.MaxUrls < 0 || rules.MaxUrlLength < 0 || rules.MetadataMaxKeys < 0 || rules.MetadataMaxKeyLength < 0 ||
+		rules.MetadataMaxValuesSize < 0 {
+		errs = append(errs, fmt.Sprintf("%v invalid val: 'task_rules'", cfgName))
+	}
+
+	if c.ShutdownTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("%v invalid val: 'shutdown_timeout'", cfgName))
+	}
+
+	if c.ReadTimeout < 0 || c.ReadHeaderTimeout < 0 || c.WriteTimeout < 0 || c.IdleTimeout < 0 ||
+		c.AddUrlTimeout < 0 {
+		errs = append(errs, fmt.Sprintf("%v invalid val: '*_timeout' (negative)", cfgName))
+	}
+
+	// the 504 of a timed out add url must be written before the connection is cut
+	addUrlTimeout := durationOrDefault(c.AddUrlTimeout, defaultAddUrlTimeout)
+	writeTimeout := durationOrDefault(c.WriteTimeout, defaultWriteTimeout)
+	if addUrlTimeout >= writeTimeout {
+		errs = append(errs, fmt.Sprintf("%v invalid val: 'add_url_timeout' (%v) must be below 'write_timeout' (%v)", cfgName, addUrlTimeout, writeTimeout))
+	}
+
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		errs = append(errs, fmt.Sprintf("%v invalid val: 'cert_file' and 'key_file' must be set together", cfgName))
+	} else if c.CertFile != "" {
+		if _, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile); err != nil {
+			errs = append(errs, fmt.Sprintf("%v invalid val: 'cert_file' / 'key_file' (%v)", cfgName, err))
+		}
+	}
+
+	errs = append(errs, c.Cors.errors(cfgName)...)
+	errs = append(errs, c.Sources.errors(cfgName, c.DefaultSources)...)
+	errs = append(errs, c.Metrics.errors(cfgName)...)
+
+	if c.MaxBodySize < 0 {
+		errs = append(errs, fmt.Sprintf("%v invalid val: 'max_body_size'", cfgName))
+	}
+
+	if c.GzipMinSize < 0 {
+		errs = append(errs, fmt.Sprintf("%v invalid val: 'gzip_min_size'", cfgName))
+	}
+
+	return errs
 }
 
 type Server struct {
-	Srv           *http.Server
-	RabbitHandler *rabbitmq.RabbitHandler
-	Validator     *validate.Validator
-	AuthTokens    map[string]string
-	AddUrlTaskCh  chan *AddUrlTask
-	Elastic       *elastic.Elastic
+	Srv             *http.Server
+	MetricsSrv      *http.Server // separate metrics listener, nil if not configured
+	Publisher       publisher.Publisher
+	Validator       *validate.Validator
+	AuthTokens      map[string]string
+	DefaultSources  map[string]string
+	sources         sourcePolicy
+	AdminTokens     []string
+	Elastic         *elastic.Elastic
+	ResubmitCheck   ResubmitCheckConfig
+	TaskRules       TaskRules
+	StatusCache     *cache.Cache // short-lived url status lookups
+	recentUrls      *cache.Cache // recently published urls (dedup), nil when disabled
+	ShutdownTimeout time.Duration
+	AddUrlTimeout   time.Duration
+	CertFile        string
+	KeyFile         string
+
+	ReadyCheckWhitelister bool
+	LegacyAuth            bool
+	AuthTokenFormat       string
+	verifiedTokens        *cache.Cache
 }
 
 func NewServer(
 	cfg HttpConfig,
-	rabbitHandler *rabbitmq.RabbitHandler,
+	pub publisher.Publisher,
 	validator *validate.Validator,
 	elastic *elastic.Elastic) (*Server, error) {
 
@@ -116,43 +499,146 @@ func NewServer(
 		return nil, errors.New("http config is invalid")
 	}
 
+	addr, err := listenAddr(cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.TaskLimits != nil {
+		lg.Warn("http config: 'task_limits' is deprecated, rename it to 'task_rules'", nil)
+	}
+
+	shutdownTimeout := cfg.ShutdownTimeout
+	if shutdownTimeout == 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+
 	router := gin.Default()
+	if cfg.Cors.Enabled() {
+		// router level, so preflight requests (no OPTIONS routes) are answered before auth
+		router.Use(corsMiddleware(cfg.Cors))
+	}
+	router.Use(requestIDMiddleware)
+	router.Use(tracingMiddleware())
+	router.Use(traceMiddleware)
+	router.Use(latencyMiddleware)
+	if cfg.Gzip {
+		minSize := cfg.GzipMinSize
+		if minSize == 0 {
+			minSize = defaultGzipMinSize
+		}
+		router.Use(gzipMiddleware(minSize))
+	}
+
 	server := &Server{
-		AuthTokens:    cfg.AuthTokens,
-		AddUrlTaskCh:  make(chan *AddUrlTask),
-		RabbitHandler: rabbitHandler,
-		Validator:     validator,
-		Elastic:       elastic,
+		AuthTokens:      cfg.AuthTokens,
+		DefaultSources:  cfg.DefaultSources,
+		sources:         newSourcePolicy(cfg.Sources),
+		AdminTokens:     cfg.AdminTokens,
+		Publisher:       pub,
+		Validator:       validator,
+		Elastic:         elastic,
+		ResubmitCheck:   cfg.ResubmitCheck,
+		TaskRules:       cfg.taskRules().withDefaults(),
+		StatusCache:     cache.New(urlStatusCacheTTL, time.Minute),
+		recentUrls:      newDedupCache(cfg.Dedup),
+		ShutdownTimeout: shutdownTimeout,
+		AddUrlTimeout:   durationOrDefault(cfg.AddUrlTimeout, defaultAddUrlTimeout),
+		CertFile:        cfg.CertFile,
+		KeyFile:         cfg.KeyFile,
+
+		ReadyCheckWhitelister: cfg.ReadyCheckWhitelister,
+		LegacyAuth:            cfg.LegacyAuth,
+		AuthTokenFormat:       cfg.AuthTokenFormat,
+		verifiedTokens:        cache.New(bcryptCacheTTL, time.Minute),
 
 		Srv: &http.Server{
-			Addr:    fmt.Sprintf(":%v", cfg.Listen),
-			Handler: router,
+			Addr:              addr,
+			Handler:           router,
+			ReadTimeout:       durationOrDefault(cfg.ReadTimeout, defaultReadTimeout),
+			ReadHeaderTimeout: durationOrDefault(cfg.ReadHeaderTimeout, defaultReadHeaderTimeout),
+			WriteTimeout:      durationOrDefault(cfg.WriteTimeout, defaultWriteTimeout),
+			IdleTimeout:       durationOrDefault(cfg.IdleTimeout, defaultIdleTimeout),
 		},
 	}
 
 	router.GET("/status", server.status)
-	router.GET("/metrics", mt.PrometheusHandler())
+	router.GET("/ready", server.ready)
+	if err := server.registerMetrics(router, cfg.Metrics); err != nil {
+		return nil, err
+	}
 
 	// api main group
 	api := router.Group("/v1")
 	api.Use(server.middlewareHandler)
 
+	maxBodySize := cfg.MaxBodySize
+	if maxBodySize == 0 {
+		maxBodySize = defaultMaxBodySize
+	}
+	api.Use(server.bodyLimitMiddleware(maxBodySize))
+
 	// url group within api
 	url := api.Group("/url")
 	url.POST("/add", server.addUrl)
 	url.GET("/status", server.getUrlStatus)
+	url.GET("/check", server.checkUrl)
+
+	// admin group within api
+	admin := api.Group("/admin")
+	admin.Use(server.adminMiddleware)
+	admin.GET("/elastic/stats", server.elasticStats)
+	admin.GET("/cache/stats", server.cacheStats)
+	admin.DELETE("/cache/:domain", server.evictCache)
 
 	return server, nil
 }
 
 func (s *Server) Up() error {
-	log.Printf("starting up http server on %v ...", s.Srv.Addr)
+	tlsEnabled := s.CertFile != ""
+	lg.Info("starting up http server", lg.Fields{"addr": s.Srv.Addr, "tls": tlsEnabled})
+	s.upMetrics()
+	if tlsEnabled {
+		return s.Srv.ListenAndServeTLS(s.CertFile, s.KeyFile)
+	}
 	return s.Srv.ListenAndServe()
 }
 
+// listenAddr turns the listen value into the server address: a bare port listens on all
+// interfaces, host:port is used as is; a host without a port is rejected
+func listenAddr(listen string) (string, error) {
+	addr, port := ":"+listen, listen
+	if strings.Contains(listen, ":") {
+		var err error
+		if _, port, err = net.SplitHostPort(listen); err != nil {
+			return "", fmt.Errorf("expected a port or host:port, got: '%v'", listen)
+		}
+		addr = listen
+	}
+
+	num, err := strconv.Atoi(port)
+	if err != nil || num < 1 || num > 65535 {
+		return "", fmt.Errorf("expected a port (1..65535) or host:port, got: '%v'", listen)
+	}
+	return addr, nil
+}
+
+func durationOrDefault(val, def time.Duration) time.Duration {
+	if val == 0 {
+		return def
+	}
+	return val
+}
+
+// Down stops accepting requests and waits (up to the shutdown timeout) for in-flight ones to finish
 func (s *Server) Down() error {
-	log.Printf("shutting down http server on %v ...", s.Srv.Addr)
-	return s.Srv.Shutdown(context.Background())
+	lg.Info("shutting down http server", lg.Fields{"addr": s.Srv.Addr, "timeout": s.ShutdownTimeout.String()})
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+
+	err := s.Srv.Shutdown(ctx)
+	s.downMetrics(ctx)
+	return err
 }
 
 func (s *Server) middlewareHandler(c *gin.Context) {
@@ -166,23 +652,42 @@ func (s *Server) middlewareHandler(c *gin.Context) {
 }
 
 func (s *Server) parseRequestReferrer(c *gin.Context) string {
-	requestAuthHeader := c.GetHeader(authHeader)
-	for k, v := range s.AuthTokens {
-		if v == requestAuthHeader {
-			return k
+	token, found := s.requestToken(c)
+	if !found {
+		return ""
+	}
+	owner, _ := s.tokenOwner(token)
+	return owner
+}
+
+// isAdminRequest reports whether the request is authenticated with an admin-scoped token
+func (s *Server) isAdminRequest(c *gin.Context) bool {
+	referrer := s.parseRequestReferrer(c)
+	for _, name := range s.AdminTokens {
+		if name == referrer {
+			return true
 		}
 	}
-	return ""
+	return false
+}
+
+// adminMiddleware only lets requests authenticated with an admin-scoped token through
+func (s *Server) adminMiddleware(c *gin.Context) {
+	if !s.isAdminRequest(c) {
+		s.writeResponse(c, http.StatusForbidden, "admin token is required")
+		return
+	}
+	c.Next()
 }
 
 func (s *Server) validateRequestAuthentication(c *gin.Context) (bool, string) {
-	requestAuthHeader := c.GetHeader(authHeader)
-	if requestAuthHeader == "" {
+	token, found := s.requestToken(c)
+	if !found {
 		return false, fmt.Sprintf("auth token '%v' is missing or empty", authHeader)
 
 	}
 
-	if !s.isValidAuthToken(requestAuthHeader) {
+	if !s.isValidAuthToken(token) {
 		return false, fmt.Sprintf("auth token '%v' is invalid", authHeader)
 	}
 
@@ -199,13 +704,8 @@ func (s *Server) writeResponse(c *gin.Context, status int, message interface{})
 }
 
 func (s *Server) isValidAuthToken(token string) bool {
-	token = strings.ToLower(strings.TrimSpace(token))
-	for _, val := range s.AuthTokens {
-		if strings.ToLower(strings.TrimSpace(val)) == token {
-			return true
-		}
-	}
-	return false
+	_, found := s.tokenOwner(token)
+	return found
 }
 
 func isOkStatus(status int) bool {
@@ -222,48 +722,255 @@ func (s *Server) status(c *gin.Context) {
 	s.writeResponse(c, http.StatusOK, gin.H{"status": "ok"})
 }
 
+// elasticStats returns the bulk indexer counters (added, flushed, failed, ...)
+func (s *Server) elasticStats(c *gin.Context) {
+	s.writeResponse(c, http.StatusOK, elastic.BulkStatsMap(s.Elastic.Indexer.BulkStats()))
+}
+
+// cacheStats returns the domain and whitelister cache sizes and hit rates
+func (s *Server) cacheStats(c *gin.Context) {
+	s.writeResponse(c, http.StatusOK, s.Validator.CacheStats())
+}
+
+// evictCache removes a domain (or ip) from the domain and whitelister caches, so it's checked again
+func (s *Server) evictCache(c *gin.Context) {
+	key, err := s.Validator.EvictCaches(c.Param("domain"))
+	if err != nil {
+		s.writeResponse(c, http.StatusBadRequest, fmt.Sprintf("invalid domain: '%v'", c.Param("domain")))
+		return
+	}
+	lg.Info("cache entry evicted by admin", s.logFields(c, lg.Fields{"key": key}))
+	s.writeResponse(c, http.StatusOK, gin.H{"evicted": key})
+}
+
 func (s *Server) addUrl(c *gin.Context) {
 	var task AddUrlTask
 	var errMsg string
 	errPrfx := "invalid add url task"
 	action := "add url"
 
-	log.Printf("received a new task: %v", action)
-	if err := c.BindJSON(&task); err != nil {
+	lg.Debug("received a new task", s.logFields(c, lg.Fields{"action": action}))
+
+	// validation & publishing share the request deadline
+	ctx, cancel := context.WithTimeout(c.Request.Context(), s.AddUrlTimeout)
+	defer cancel()
+	c.Request = c.Request.WithContext(ctx)
+
+	if err := c.ShouldBindJSON(&task); err != nil {
+		status := http.StatusBadRequest
+		if isBodyTooLarge(err) {
+			status = http.StatusRequestEntityTooLarge
+		}
 		errMsg = fmt.Sprintf("%v: can't parse json: %v", errPrfx, err)
-		s.writeResponse(c, http.StatusBadRequest, errMsg)
+		s.writeResponse(c, status, errMsg)
 		return
 	}
 
-	valid, err := task.Validate()
+	s.applyDefaultSource(c, &task)
+
+	valid, err := task.Validate(s.TaskRules, s.Validator.SchemeIsAllowed)
 	if !valid {
 		errMsg = fmt.Sprintf("%v: %v", errPrfx, err)
 		s.writeResponse(c, http.StatusBadRequest, errMsg)
 		return
 	}
 
-	mustAddUrl, err := s.Validator.UrlRequiresProcessing(task.URL)
-	if err != nil {
-		errMsg = fmt.Sprintf("failed to check url: %v", err)
-		s.writeResponse(c, http.StatusInternalServerError, errMsg)
+	if !s.sources.allows(task.Source) {
+		lg.Warn("task source is not allowed", s.logFields(c, lg.Fields{"action": action, "source": task.Source}))
+		s.writeResponse(c, http.StatusForbidden, fmt.Sprintf("source is not allowed: %v", task.Source))
 		return
 	}
 
-	if !mustAddUrl {
-		msg := fmt.Sprintf("url does not need to be added into the phishing system: %v", task.URL)
-		s.writeResponse(c, http.StatusOK, msg)
+	bypassCache := strings.EqualFold(c.GetHeader(noCacheHeader), "true")
+	if bypassCache && !s.isAdminRequest(c) {
+		errMsg = fmt.Sprintf("'%v' header requires an admin token", noCacheHeader)
+		s.writeResponse(c, http.StatusForbidden, errMsg)
+		return
+	}
+
+	if len(task.URLs) > 0 {
+		s.addUrls(c, task, bypassCache)
 		return
 	}
 
-	bytes, err := json.Marshal(task)
+	response, fail := s.submitUrl(c, task, bypassCache)
+	if fail != nil {
+		s.writeResponse(c, fail.status, fail.message)
+		return
+	}
+	s.writeResponse(c, http.StatusOK, response)
+}
+
+// addUrls submits every url of a multi url task separately, responding with the outcome per url
+func (s *Server) addUrls(c *gin.Context, task AddUrlTask, bypassCache bool) {
+	response := &AddUrlsResponse{
+		Results:   make([]*AddUrlResponse, 0, len(task.URLs)),
+		Summary:   make(map[string]int),
+		RequestID: requestID(c),
+	}
+
+	// the hosts are checked against the whitelist in one go (the url checks use its results),
+	// a failed check fails every valid url
+	valid := make([]string, 0, len(task.URLs))
+	for _, rawUrl := range task.URLs {
+		if validateTaskUrl(rawUrl, s.TaskRules, s.Validator.SchemeIsAllowed) != nil {
+			continue
+		}
+		if normalized, err := s.Validator.NormalizeURL(rawUrl); err == nil {
+			valid = append(valid, normalized)
+		}
+	}
+	ctx, wlErr := s.Validator.PrecheckWhitelist(c.Request.Context(), valid, task.Source, bypassCache)
+	if wlErr != nil {
+		lg.Error("batch whitelist check fail", s.logFields(c, lg.Fields{"urls": len(valid), "error": wlErr}))
+	}
+	c.Request = c.Request.WithContext(ctx)
+
+	for _, rawUrl := range task.URLs {
+		urlTask := task
+		urlTask.URL, urlTask.URLs = rawUrl, nil
+
+		var result *AddUrlResponse
+		if err := validateTaskUrl(rawUrl, s.TaskRules, s.Validator.SchemeIsAllowed); err != nil {
+			result = &AddUrlResponse{Decision: DecisionRejected, URL: rawUrl, Error: err.Error()}
+		} else if wlErr != nil {
+			result = &AddUrlResponse{Decision: DecisionFailed, URL: rawUrl, Error: fmt.Sprintf("failed to check url: %v", wlErr)}
+		} else if urlResult, fail := s.submitUrl(c, urlTask, bypassCache); fail != nil {
+			decision := DecisionFailed
+			if fail.status == http.StatusBadRequest {
+				decision = DecisionRejected
+			}
+			result = &AddUrlResponse{Decision: decision, URL: rawUrl, Error: fail.message}
+		} else {
+			result = urlResult
+		}
+
+		result.RequestID = ""
+		response.Results = append(response.Results, result)
+		response.Summary[result.Decision]++
+	}
+	s.writeResponse(c, http.StatusOK, response)
+}
+
+// submitFailure is an add url error response (status & message)
+type submitFailure struct {
+	status  int
+	message string
+}
+
+// deadlineFailure returns the 504 response once the add url deadline is exceeded, nil otherwise
+func (s *Server) deadlineFailure(c *gin.Context) *submitFailure {
+	if !errors.Is(c.Request.Context().Err(), context.DeadlineExceeded) {
+		return nil
+	}
+	lg.Warn("add url deadline exceeded", s.logFields(c, lg.Fields{"action": "add url"}))
+	return &submitFailure{http.StatusGatewayTimeout, "add url timed out, try again later"}
+}
+
+// submitUrl normalizes, deduplicates, validates and publishes (or stores) a single url task
+func (s *Server) submitUrl(c *gin.Context, task AddUrlTask, bypassCache bool) (*AddUrlResponse, *submitFailure) {
+	errPrfx := "invalid add url task"
+	action := "add url"
+
+	// the normalized url is validated and published, the original one is kept for auditing
+	originalURL := task.URL
+	normalized, err := s.Validator.NormalizeURL(task.URL)
+	if err != nil {
+		return nil, &submitFailure{http.StatusBadRequest, fmt.Sprintf("%v: can't normalize url: %v", errPrfx, err)}
+	}
+	task.URL = normalized
+
+	// store tasks are never published, so they're not deduplicated
+	published := false
+	if !task.Store {
+		if !s.claimUrl(task.URL) {
+			lg.Info("url was published within the dedup window (not published again)", s.logFields(c, lg.Fields{
+				"action": action, "url": task.URL,
+			}))
+			return s.newAddUrlResponse(c, task, DecisionDuplicate, ""), nil
+		}
+		defer func() {
+			if !published {
+				s.releaseUrl(task.URL)
+			}
+		}()
+	}
+
+	if lastSeen := s.findRecentSubmission(c, task); lastSeen != nil {
+		s.audit(c, task, "already_submitted")
+		lg.Info("url was already submitted (not published again)", s.logFields(c, lg.Fields{
+			"action": action, "url": task.URL, "last_seen": lastSeen.When,
+		}))
+		response := s.newAddUrlResponse(c, task, DecisionSkipped, "already_submitted")
+		response.LastSeen = &lastSeen.When
+		return response, nil
+	}
+
+	mustAddUrl, reason, err := s.Validator.UrlRequiresProcessing(c.Request.Context(), task.URL, task.Source, bypassCache)
+	if fail := s.deadlineFailure(c); fail != nil {
+		return nil, fail
+	}
 	if err != nil {
-		errMsg = fmt.Sprintf("failed to marshal an 'add url' task to json, err: %v", err)
-		s.writeResponse(c, http.StatusInternalServerError, errMsg)
-		log.Fatal(errMsg)
+		return nil, &submitFailure{checkFailureStatus(err), fmt.Sprintf("failed to check url: %v", err)}
+	}
+
+	var probe *validate.ProbeResult
+	if mustAddUrl {
+		probe = s.probe(c.Request.Context(), task.URL)
+		if fail := s.deadlineFailure(c); fail != nil {
+			return nil, fail
+		}
 	}
 
-	s.RabbitHandler.Publish(task.Source, "", bytes)
-	log.Printf("pushed task (%v) to dst rabbit: %v", action, task)
+	var verdict *validate.Verdict
+	if s.Validator.VerdictScorer != nil {
+		verdict = s.Validator.VerdictScorer.Score(mustAddUrl, reason, probe)
+		mustAddUrl = verdict.Decision == validate.DecisionQueue
+	}
+
+	if !mustAddUrl {
+		s.audit(c, task, fmt.Sprintf("skipped: %v", reason))
+		lg.Info("url does not need to be added into the phishing system", s.logFields(c, lg.Fields{
+			"action": action, "url": task.URL, "reason": reason,
+		}))
+		response := s.newAddUrlResponse(c, task, DecisionSkipped, string(reason))
+		response.Verdict = verdict
+		return response, nil
+	}
+
+	// store only tasks pass the same validation, but are just logged
+	var route publisher.Route
+	if task.Store {
+		action = "store url"
+		lg.Info("url is stored (not published)", s.logFields(c, lg.Fields{"action": action, "url": task.URL, "source": task.Source}))
+		s.audit(c, task, "stored")
+	} else {
+		bytes, err := json.Marshal(task)
+		if err != nil {
+			lg.Error("failed to marshal an 'add url' task to json", s.logFields(c, lg.Fields{"action": action, "url": task.URL, "error": err}))
+			return nil, &submitFailure{http.StatusInternalServerError, "failed to queue the url"}
+		}
+
+		headers := map[string]string{publisher.RequestIDHeader: requestID(c)}
+		if task.ExpiresAt != nil {
+			headers[publisher.ExpiresAtHeader] = task.ExpiresAt.UTC().Format(time.RFC3339Nano)
+		}
+		route, err = s.Publisher.Publish(c.Request.Context(), task.Source, task.RoutingKey, headers, bytes)
+		if errors.Is(err, publisher.ErrUnknownSource) {
+			s.audit(c, task, "unknown_source")
+			return nil, &submitFailure{http.StatusBadRequest, fmt.Sprintf("%v: unknown source: %v", errPrfx, task.Source)}
+		}
+		if err != nil {
+			lg.Error("publish fail", s.logFields(c, lg.Fields{"action": action, "url": task.URL, "error": err}))
+			return nil, &submitFailure{http.StatusServiceUnavailable, "failed to queue the url, try again later"}
+		}
+		lg.Info("pushed task to dst queue", s.logFields(c, lg.Fields{
+			"action": action, "url": task.URL, "source": task.Source, "exchange": route.Exchange,
+		}))
+		s.audit(c, task, "published")
+		published = true
+	}
+	mt.IncVec(mt.AcceptedUrls, strconv.FormatBool(task.Store))
 
 	// log to elastic
 	log := &elastic.LogTask{
@@ -275,18 +982,211 @@ func (s *Server) addUrl(c *gin.Context) {
 		Domain:    s.getDomain(task.URL),
 		Source:    task.Source,
 		Store:     task.Store,
+		ExpiresAt: task.ExpiresAt,
+		Engine:    task.Engine,
+		Verdict:   verdict,
+		RequestID: requestID(c),
+		TraceID:   traceID(c),
+
+		CacheBypassed: bypassCache,
+		Exchange:      route.Exchange,
+		RoutingKey:    route.RoutingKey,
+		ExchangeFrom:  route.ExchangeFrom,
+	}
+	if originalURL != task.URL {
+		log.OriginalURL = originalURL
 	}
-	go s.Elastic.Log(log)
+	if probe != nil {
+		if probe.Err != nil {
+			log.Desc = fmt.Sprintf("probe fail: %v", probe.Err)
+		}
+		log.LandingURL = probe.LandingURL
+	}
+	go s.Elastic.Log(c.Request.Context(), log)
+
+	decision := DecisionPublished
+	if task.Store {
+		decision = DecisionStored
+	}
+	response := s.newAddUrlResponse(c, task, decision, "")
+	response.Verdict = verdict
+	return response, nil
+}
 
-	s.writeResponse(c, http.StatusOK, gin.H{"result": "ok"})
+// UrlStatus is the latest known state of a url (from elastic logs)
+type UrlStatus struct {
+	URL     string    `json:"url"`
+	Action  string    `json:"action"`
+	Success bool      `json:"success"`
+	Time    time.Time `json:"time"`
+	Source  string    `json:"source"`
+	Domain  string    `json:"domain"`
+}
+
+// checkUrl explains the validation decision for the url, nothing is published or logged to elastic
+func (s *Server) checkUrl(c *gin.Context) {
+	rawUrl := c.Query("url")
+	if rawUrl == "" {
+		s.writeResponse(c, http.StatusBadRequest, "url param is missing or empty")
+		return
+	}
+
+	normalized, err := s.Validator.NormalizeURL(rawUrl)
+	if err != nil {
+		s.writeResponse(c, http.StatusBadRequest, fmt.Sprintf("invalid url (can't normalize): %v", err))
+		return
+	}
+
+	check, err := s.Validator.CheckUrl(c.Request.Context(), normalized, c.Query("source"))
+	if err != nil {
+		s.writeResponse(c, checkFailureStatus(err), fmt.Sprintf("failed to check url: %v", err))
+		return
+	}
+	s.writeResponse(c, http.StatusOK, check)
+}
+
+// checkFailureStatus maps a validation error to the response status: 400 for an invalid url / host,
+// 503 for transient failures (worth a retry), 500 otherwise
+func checkFailureStatus(err error) int {
+	switch {
+	case errors.Is(err, validate.ErrInvalidUrl):
+		return http.StatusBadRequest
+	case errors.Is(err, validate.ErrTransient):
+		return http.StatusServiceUnavailable
+	default:
+		return http.StatusInternalServerError
+	}
 }
 
 func (s *Server) getUrlStatus(c *gin.Context) {
-	s.writeResponse(c, http.StatusOK, gin.H{"to do": "get url status"})
+	rawUrl := c.Query("url")
+	if rawUrl == "" {
+		s.writeResponse(c, http.StatusBadRequest, "url param is missing or empty")
+		return
+	}
+
+	if _, err := url.ParseRequestURI(rawUrl); err != nil {
+		s.writeResponse(c, http.StatusBadRequest, fmt.Sprintf("invalid url (can't parse): %v", err))
+		return
+	}
+
+	// urls are logged in their normalized form
+	rawUrl, err := s.Validator.NormalizeURL(rawUrl)
+	if err != nil {
+		s.writeResponse(c, http.StatusBadRequest, fmt.Sprintf("invalid url (can't normalize): %v", err))
+		return
+	}
+
+	// nil status (not found) is cached as well, so polling an unknown url doesn't hit elastic every time
+	itf, cached := s.StatusCache.Get(rawUrl)
+	if !cached {
+		lastLog, err := s.Elastic.FindLastLog(c.Request.Context(), rawUrl, time.Time{})
+		if err != nil {
+			s.writeResponse(c, http.StatusInternalServerError, fmt.Sprintf("failed to get url status: %v", err))
+			return
+		}
+
+		var status *UrlStatus
+		if lastLog != nil {
+			status = &UrlStatus{
+				URL:     lastLog.URL,
+				Action:  lastLog.Action,
+				Success: lastLog.Success,
+				Time:    lastLog.When,
+				Source:  lastLog.Source,
+				Domain:  lastLog.Domain,
+			}
+		}
+		s.StatusCache.SetDefault(rawUrl, status)
+		itf = status
+	}
+
+	status := itf.(*UrlStatus)
+	if status == nil {
+		s.writeResponse(c, http.StatusNotFound, fmt.Sprintf("no status found for url: %v", rawUrl))
+		return
+	}
+	s.writeResponse(c, http.StatusOK, status)
+}
+
+// logFields adds the request context (referrer, request id) to the log fields
+func (s *Server) logFields(c *gin.Context, fields lg.Fields) lg.Fields {
+	fields["referrer"] = s.parseRequestReferrer(c)
+	if requestID := requestID(c); requestID != "" {
+		fields["request_id"] = requestID
+	}
+	if traceID := traceID(c); traceID != "" {
+		fields["trace_id"] = traceID
+	}
+	return fields
+}
+
+// applyDefaultSource sets the token's default source on a task submitted without one
+func (s *Server) applyDefaultSource(c *gin.Context, task *AddUrlTask) {
+	if task.Source != "" {
+		return
+	}
+
+	referrer := s.parseRequestReferrer(c)
+	source, found := s.DefaultSources[referrer]
+	if !found {
+		return
+	}
+
+	task.Source = source
+	lg.Debug("applied default source", lg.Fields{"source": source, "referrer": referrer})
+}
+
+// audit publishes a submission event to the audit exchange (best-effort)
+func (s *Server) audit(c *gin.Context, task AddUrlTask, verdict string) {
+	event := AuditEvent{
+		URL:       task.URL,
+		Source:    task.Source,
+		Verdict:   verdict,
+		Timestamp: time.Now(),
+		RequestID: requestID(c),
+	}
+
+	bytes, err := json.Marshal(event)
+	if err != nil {
+		lg.Error("failed to marshal an audit event to json", s.logFields(c, lg.Fields{"url": task.URL, "error": err}))
+		return
+	}
+	s.Publisher.PublishAudit(bytes)
+}
+
+// findRecentSubmission returns the last log of the url within the resubmit lookback window (if enabled for the source)
+func (s *Server) findRecentSubmission(c *gin.Context, task AddUrlTask) *elastic.LogTask {
+	if !s.ResubmitCheck.appliesTo(task.Source) {
+		return nil
+	}
+
+	since := time.Now().Add(-s.ResubmitCheck.Lookback)
+	lastSeen, err := s.Elastic.FindLastLog(c.Request.Context(), task.URL, since)
+	if err != nil {
+		// don't block submissions because of elastic
+		lg.Warn("resubmit check fail (url will be processed)", s.logFields(c, lg.Fields{"url": task.URL, "error": err}))
+		return nil
+	}
+	return lastSeen
+}
+
+// probe checks where the url lands, returns nil when probing is disabled
+func (s *Server) probe(ctx context.Context, url string) *validate.ProbeResult {
+	if s.Validator.Prober == nil {
+		return nil
+	}
+	// other allowed schemes (e.g. ftp) can't be fetched over http
+	if !strings.HasPrefix(url, "http://") && !strings.HasPrefix(url, "https://") {
+		return nil
+	}
+
+	landingURL, err := s.Validator.Prober.Probe(ctx, url)
+	return &validate.ProbeResult{LandingURL: landingURL, Err: err}
 }
 
 func (s *Server) getDomain(url string) string {
-	_, domain, err := s.Validator.ParseDomain(url)
+	_, domain, _, err := s.Validator.ParseDomain(url)
 	if err != nil {
 		return ""
 	}
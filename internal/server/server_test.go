@@ -0,0 +1,288 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"phish-api/internal/validate"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v2"
+)
+
+func TestAddUrlTaskMetadataLimits(t *testing.T) {
+	rules := TaskRules{MetadataMaxKeys: 2, MetadataMaxKeyLength: 3, MetadataMaxValuesSize: 4}.withDefaults()
+
+	tests := []struct {
+		name     string
+		metadata map[string]string
+		errMsg   string // empty if the task is valid
+	}{
+		{name: "no metadata"},
+		{name: "at the limits", metadata: map[string]string{"abc": "12", "de": "34"}},
+		{name: "too many keys", metadata: map[string]string{"a": "", "b": "", "c": ""}, errMsg: "too many metadata keys: 3 (max: 2)"},
+		{name: "key too long", metadata: map[string]string{"abcd": "1"}, errMsg: "metadata key is too long: abc... (max length: 3)"},
+		{name: "multi-byte key too long", metadata: map[string]string{"abé": "1"}, errMsg: "metadata key is too long: ab... (max length: 3)"},
+		{name: "values too large", metadata: map[string]string{"a": "123", "b": "45"}, errMsg: "metadata values are too large: 5 bytes (max: 4)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			task := AddUrlTask{Source: "src", URL: "http://example.com/", Metadata: tt.metadata}
+
+			valid, err := task.Validate(rules, (&validate.Validator{}).SchemeIsAllowed)
+			if tt.errMsg == "" {
+				if !valid {
+					t.Fatalf("Validate() = %v, want a valid task", err)
+				}
+				return
+			}
+			if valid || !strings.Contains(err.Error(), tt.errMsg) {
+				t.Errorf("Validate() = %v, %v, want an invalid task: %q", valid, err, tt.errMsg)
+			}
+		})
+	}
+}
+
+func TestTruncateUtf8(t *testing.T) {
+	tests := []struct {
+		s    string
+		n    int
+		want string
+	}{
+		{s: "abc", n: 5, want: "abc"},
+		{s: "abc", n: 3, want: "abc"},
+		{s: "abcd", n: 3, want: "abc"},
+		{s: "abé", n: 3, want: "ab"},
+		{s: "abé", n: 4, want: "abé"},
+		{s: "ключ", n: 3, want: "к"},
+		{s: "😀x", n: 3, want: ""},
+		{s: "abc", n: 0, want: ""},
+	}
+
+	for _, tt := range tests {
+		if got := truncateUtf8(tt.s, tt.n); got != tt.want {
+			t.Errorf("truncateUtf8(%q, %v) = %q, want %q", tt.s, tt.n, got, tt.want)
+		}
+	}
+}
+
+func TestTaskRulesDefaults(t *testing.T) {
+	got := TaskRules{MetadataMaxKeys: 5}.withDefaults()
+	want := TaskRules{MaxUrls: 100, MaxUrlLength: 2048, MetadataMaxKeys: 5, MetadataMaxKeyLength: 64, MetadataMaxValuesSize: 4096}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("withDefaults() = %+v, want %+v", got, want)
+	}
+}
+
+func TestApplyDefaultSource(t *testing.T) {
+	tests := []struct {
+		name   string
+		token  string
+		source string
+		want   string
+	}{
+		{name: "source kept", token: "secret-a", source: "own", want: "own"},
+		{name: "default applied", token: "secret-a", want: "src-a"},
+		{name: "token without a default", token: "secret-b", want: ""},
+		{name: "unknown token", token: "nope", want: ""},
+	}
+
+	gin.SetMode(gin.TestMode)
+	s := &Server{
+		AuthTokens:     map[string]string{"a": "secret-a", "b": "secret-b"},
+		DefaultSources: map[string]string{"a": "src-a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/add", nil)
+			if tt.token != "" {
+				c.Request.Header.Set(authHeader, "Bearer "+tt.token)
+			}
+
+			task := AddUrlTask{URL: "http://example.com/", Source: tt.source}
+			s.applyDefaultSource(c, &task)
+			if task.Source != tt.want {
+				t.Errorf("source = %q, want %q", task.Source, tt.want)
+			}
+		})
+	}
+}
+
+func TestHttpConfigDefaultSources(t *testing.T) {
+	tests := []struct {
+		name           string
+		defaultSources map[string]string
+		valid          bool
+	}{
+		{name: "none", valid: true},
+		{name: "known token", defaultSources: map[string]string{"a": "src-a"}, valid: true},
+		{name: "unknown token", defaultSources: map[string]string{"z": "src-z"}},
+		{name: "empty source", defaultSources: map[string]string{"a": ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := HttpConfig{Listen: "8080", AuthTokens: map[string]string{"a": "secret-a"}, DefaultSources: tt.defaultSources}
+			if valid := cfg.IsValid(); valid != tt.valid {
+				t.Errorf("IsValid() = %v, want %v", valid, tt.valid)
+			}
+		})
+	}
+}
+
+func TestIsAdminRequest(t *testing.T) {
+	tests := []struct {
+		name  string
+		token string
+		admin bool
+	}{
+		{name: "admin token", token: "secret-admin", admin: true},
+		{name: "other token", token: "secret-a"},
+		{name: "no token"},
+	}
+
+	gin.SetMode(gin.TestMode)
+	s := &Server{
+		AuthTokens:  map[string]string{"admin": "secret-admin", "a": "secret-a"},
+		AdminTokens: []string{"admin"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest(http.MethodPost, "/add", nil)
+			if tt.token != "" {
+				c.Request.Header.Set(authHeader, "Bearer "+tt.token)
+			}
+
+			if admin := s.isAdminRequest(c); admin != tt.admin {
+				t.Errorf("isAdminRequest() = %v, want %v", admin, tt.admin)
+			}
+		})
+	}
+}
+
+func TestNewServerTimeouts(t *testing.T) {
+	tests := []struct {
+		name    string
+		cfg     HttpConfig
+		want    [4]time.Duration // read, read header, write, idle
+		wantErr bool
+	}{
+		{
+			name: "defaults",
+			want: [4]time.Duration{defaultReadTimeout, defaultReadHeaderTimeout, defaultWriteTimeout, defaultIdleTimeout},
+		},
+		{
+			name: "configured",
+			cfg: HttpConfig{
+				ReadTimeout: time.Second, ReadHeaderTimeout: 2 * time.Second, WriteTimeout: 3 * time.Second, IdleTimeout: 4 * time.Second,
+				AddUrlTimeout: 2 * time.Second,
+			},
+			want: [4]time.Duration{time.Second, 2 * time.Second, 3 * time.Second, 4 * time.Second},
+		},
+		{
+			name: "read header only",
+			cfg:  HttpConfig{ReadHeaderTimeout: time.Second},
+			want: [4]time.Duration{defaultReadTimeout, time.Second, defaultWriteTimeout, defaultIdleTimeout},
+		},
+		{name: "negative", cfg: HttpConfig{ReadHeaderTimeout: -time.Second}, wantErr: true},
+		{name: "add url timeout at the write timeout", cfg: HttpConfig{WriteTimeout: time.Second, AddUrlTimeout: time.Second}, wantErr: true},
+		{name: "write timeout below the default add url timeout", cfg: HttpConfig{WriteTimeout: time.Second}, wantErr: true},
+	}
+
+	gin.SetMode(gin.TestMode)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := tt.cfg
+			cfg.Listen, cfg.AuthTokens = "8080", map[string]string{"a": "secret-a"}
+
+			s, err := NewServer(cfg, nil, nil, nil)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("NewServer() error = nil, want an invalid config error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("NewServer() error = %v", err)
+			}
+			got := [4]time.Duration{s.Srv.ReadTimeout, s.Srv.ReadHeaderTimeout, s.Srv.WriteTimeout, s.Srv.IdleTimeout}
+			if got != tt.want {
+				t.Errorf("timeouts = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestHttpConfigTaskLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     string
+		want    TaskRules
+		wantErr bool
+	}{
+		{
+			name: "task_rules",
+			raw:  "task_rules: {metadata_max_keys: 3}",
+			want: TaskRules{MetadataMaxKeys: 3},
+		},
+		{
+			name: "deprecated task_limits",
+			raw:  "task_limits: {metadata_max_keys: 3, metadata_max_key_length: 8}",
+			want: TaskRules{MetadataMaxKeys: 3, MetadataMaxKeyLength: 8},
+		},
+		{
+			name:    "both",
+			raw:     "task_rules: {metadata_max_keys: 3}\ntask_limits: {metadata_max_keys: 4}",
+			wantErr: true,
+		},
+		{name: "invalid task_limits", raw: "task_limits: {metadata_max_keys: -1}", wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var cfg HttpConfig
+			if err := yaml.UnmarshalStrict([]byte(tt.raw), &cfg); err != nil {
+				t.Fatal(err)
+			}
+			cfg.Listen, cfg.AuthTokens = "8080", map[string]string{"a": "secret-a"}
+
+			if valid := cfg.IsValid(); valid == tt.wantErr {
+				t.Fatalf("IsValid() = %v, want %v", valid, !tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if got := cfg.taskRules(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("taskRules() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCheckFailureStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{name: "invalid url", err: fmt.Errorf("%w: parsed empty domain from url", validate.ErrInvalidUrl), status: http.StatusBadRequest},
+		{name: "transient", err: fmt.Errorf("%w: a-record lookup of a.com: timeout", validate.ErrTransient), status: http.StatusServiceUnavailable},
+		{name: "other", err: validate.ErrBreakerOpen, status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := checkFailureStatus(tt.err); status != tt.status {
+				t.Errorf("checkFailureStatus(%v) = %v, want %v", tt.err, status, tt.status)
+			}
+		})
+	}
+}
@@ -0,0 +1,56 @@
+package server
+
+import (
+	"fmt"
+)
+
+// SourcesConfig restricts the task sources accepted (regardless of the auth token),
+// both lists are optional: empty allowed = any source not denied
+type SourcesConfig struct {
+	Allowed []string `yaml:"allowed"`
+	Denied  []string `yaml:"denied"`
+}
+
+func (c SourcesConfig) errors(cfgName string, defaultSources map[string]string) []string {
+	var errs []string
+	for _, source := range append(append([]string{}, c.Allowed...), c.Denied...) {
+		if source == "" {
+			errs = append(errs, fmt.Sprintf("%v invalid val: 'sources' (empty source name)", cfgName))
+			break
+		}
+	}
+
+	policy := newSourcePolicy(c)
+	for name, source := range defaultSources {
+		if !policy.allows(source) {
+			errs = append(errs, fmt.Sprintf("%v invalid val: 'default_sources.%v' (source '%v' is not allowed)", cfgName, name, source))
+		}
+	}
+	return errs
+}
+
+type sourcePolicy struct {
+	allowed map[string]bool // nil = any
+	denied  map[string]bool
+}
+
+func newSourcePolicy(cfg SourcesConfig) sourcePolicy {
+	policy := sourcePolicy{denied: make(map[string]bool, len(cfg.Denied))}
+	if len(cfg.Allowed) > 0 {
+		policy.allowed = make(map[string]bool, len(cfg.Allowed))
+		for _, source := range cfg.Allowed {
+			policy.allowed[source] = true
+		}
+	}
+	for _, source := range cfg.Denied {
+		policy.denied[source] = true
+	}
+	return policy
+}
+
+func (p sourcePolicy) allows(source string) bool {
+	if p.denied[source] {
+		return false
+	}
+	return p.allowed == nil || p.allowed[source]
+}
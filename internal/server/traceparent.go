@@ -0,0 +1,42 @@
+package server
+
+import (
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// W3C trace context (https://www.w3.org/TR/trace-context/): the api joins the caller's trace
+// (or starts one), so its logs and published tasks correlate with the tracing backend spans
+const (
+	traceparentHeader = "traceparent"
+	traceIDKey        = "trace_id"
+
+	// server name of the api request spans
+	tracingServerName = "phish-api"
+)
+
+// tracingMiddleware starts the api request span (see tracing.Init), a child of the span
+// in the caller's traceparent header if any
+func tracingMiddleware() gin.HandlerFunc {
+	return otelgin.Middleware(tracingServerName)
+}
+
+// traceMiddleware keeps the trace id of the api request span for the logs and elastic records
+// and echoes the span traceparent in the response
+func traceMiddleware(c *gin.Context) {
+	ctx := c.Request.Context()
+	spanCtx := trace.SpanContextFromContext(ctx)
+	if spanCtx.IsValid() {
+		c.Set(traceIDKey, spanCtx.TraceID().String())
+		otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(c.Writer.Header()))
+	}
+	c.Next()
+}
+
+// traceID returns the trace id of the request (set by the trace middleware)
+func traceID(c *gin.Context) string {
+	return c.GetString(traceIDKey)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"phish-api/internal/publisher"
+
+	"github.com/gin-gonic/gin"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+func TestTraceMiddleware(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	otel.SetTracerProvider(sdktrace.NewTracerProvider())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	const callerTraceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	const callerParent = "00f067aa0ba902b7"
+
+	tests := []struct {
+		name        string
+		traceparent string
+		joined      bool // the api span joins the caller's trace
+	}{
+		{name: "caller trace", traceparent: "00-" + callerTraceID + "-" + callerParent + "-01", joined: true},
+		{name: "no traceparent"},
+		{name: "invalid traceparent", traceparent: "00-" + callerTraceID + "-zz-01"},
+		{name: "all zero trace id", traceparent: "00-" + strings.Repeat("0", 32) + "-" + callerParent + "-01"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pub := publisher.NewMemory(10)
+			var traceIDKept string
+			router := gin.New()
+			router.Use(tracingMiddleware(), traceMiddleware)
+			router.POST("/add", func(c *gin.Context) {
+				traceIDKept = traceID(c)
+				_, err := pub.Publish(c.Request.Context(), "src", "", nil, []byte("{}"))
+				if err != nil {
+					t.Error(err)
+				}
+			})
+
+			req := httptest.NewRequest(http.MethodPost, "/add", nil)
+			if tt.traceparent != "" {
+				req.Header.Set(traceparentHeader, tt.traceparent)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			echoed := strings.Split(rec.Header().Get(traceparentHeader), "-")
+			if len(echoed) != 4 {
+				t.Fatalf("echoed traceparent = %q", rec.Header().Get(traceparentHeader))
+			}
+			if joined := echoed[1] == callerTraceID; joined != tt.joined {
+				t.Errorf("joined the caller trace = %v, want %v", joined, tt.joined)
+			}
+			if echoed[2] == callerParent {
+				t.Error("the api echoed the caller span instead of its own")
+			}
+			if traceIDKept != echoed[1] {
+				t.Errorf("trace id = %q, want the echoed %q", traceIDKept, echoed[1])
+			}
+
+			// the published task carries the publish span, a child in the same trace
+			messages := pub.Messages()
+			if len(messages) != 1 {
+				t.Fatalf("published = %v, want 1", len(messages))
+			}
+			published := strings.Split(messages[0].Headers[publisher.TraceparentHeader], "-")
+			if len(published) != 4 || published[1] != echoed[1] || published[2] == echoed[2] {
+				t.Errorf("published traceparent = %q, want a child of %q",
+					messages[0].Headers[publisher.TraceparentHeader], rec.Header().Get(traceparentHeader))
+			}
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.10.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	defaultServiceName   = "phish-api"
+	defaultExportTimeout = 10 * time.Second
+)
+
+// Config of the OpenTelemetry tracing: spans are always created (so the trace context is propagated
+// and logged), they are exported to an OTLP/HTTP collector only if its endpoint is set
+type Config struct {
+	Endpoint    string            `yaml:"endpoint"`     // collector host:port, e.g. localhost:4318
+	Insecure    bool              `yaml:"insecure"`     // plain http to the collector
+	Headers     map[string]string `yaml:"headers"`      // sent with every export, e.g. the collector auth
+	ServiceName string            `yaml:"service_name"` // default: phish-api
+	Timeout     time.Duration     `yaml:"timeout"`      // of an export, default: 10s
+}
+
+func (cfg Config) IsValid() bool {
+	errs := cfg.Errors()
+	for _, err := range errs {
+		log.Printf("%v", err)
+	}
+	return len(errs) == 0
+}
+
+// Errors lists every problem of the config
+func (cfg Config) Errors() []string {
+	var errs []string
+	part := "[tracing validation]"
+
+	if strings.Contains(cfg.Endpoint, "://") || strings.Contains(cfg.Endpoint, "/") {
+		errs = append(errs, fmt.Sprintf("%v endpoint must be host:port (no scheme or path): %v", part, cfg.Endpoint))
+	}
+
+	if cfg.Timeout < 0 {
+		errs = append(errs, fmt.Sprintf("%v timeout is invalid", part))
+	}
+
+	return errs
+}
+
+func (cfg Config) serviceName() string {
+	if cfg.ServiceName == "" {
+		return defaultServiceName
+	}
+	return cfg.ServiceName
+}
+
+// Init sets the global tracer provider and the W3C trace context propagator,
+// the returned func flushes the buffered spans (within the export timeout) and stops the exporter
+func Init(cfg Config) (func() error, error) {
+	opts := []sdktrace.TracerProviderOption{
+		sdktrace.WithResource(resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceNameKey.String(cfg.serviceName()))),
+	}
+
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultExportTimeout
+	}
+	if cfg.Endpoint != "" {
+		clientOpts := []otlptracehttp.Option{
+			otlptracehttp.WithEndpoint(cfg.Endpoint),
+			otlptracehttp.WithHeaders(cfg.Headers),
+			otlptracehttp.WithTimeout(timeout),
+		}
+		if cfg.Insecure {
+			clientOpts = append(clientOpts, otlptracehttp.WithInsecure())
+		}
+
+		exporter, err := otlptracehttp.New(context.Background(), clientOpts...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create the otlp trace exporter: %v", err)
+		}
+		opts = append(opts, sdktrace.WithBatcher(exporter))
+		log.Printf("tracing: spans are exported to %v", cfg.Endpoint)
+	}
+
+	provider := sdktrace.NewTracerProvider(opts...)
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	shutdown := func() error {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		return provider.Shutdown(ctx)
+	}
+	return shutdown, nil
+}
+
+// End records the error (if any) on the span and ends it
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
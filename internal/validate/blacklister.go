@@ -1,26 +1,164 @@
 package validate
 
 import (
+	"bufio"
+	"fmt"
+	"net/url"
+	"os"
 	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
 )
 
+// blacklist entry prefixes, entries without a prefix are regexps
+const (
+	exactEntryPrefix    = "domain:" // domain:example.com matches the domain only
+	wildcardEntryPrefix = "*."      // *.example.com matches any subdomain (not example.com itself)
+)
+
+// blacklistRules is a compiled rule set
+type blacklistRules struct {
+	regexps  []*regexp.Regexp
+	exact    map[string]bool
+	suffixes []string // with the leading dot
+}
+
 type UrlBlacklister struct {
-	Regexps []*regexp.Regexp
+	reloadMu sync.Mutex
+	rules    atomic.Value // *blacklistRules, swapped as a whole on reload
+
+	inline []string // patterns from config
+	file   string   // optional patterns file, re-read on reload
+}
+
+// NewBlacklister compiles the inline patterns and the ones from the file (if set)
+func NewBlacklister(rawRegexps []string, file string) (*UrlBlacklister, error) {
+	checker := &UrlBlacklister{inline: rawRegexps, file: file}
+	if err := checker.Reload(); err != nil {
+		return nil, err
+	}
+	return checker, nil
+}
+
+// Reload re-reads the patterns file and swaps in the new rule set,
+// the current one is kept if any pattern is invalid
+func (checker *UrlBlacklister) Reload() error {
+	raw := checker.inline
+	if checker.file != "" {
+		filePatterns, err := readPatternsFile(checker.file)
+		if err != nil {
+			return err
+		}
+		raw = append(append([]string{}, checker.inline...), filePatterns...)
+	}
+	return checker.SetRegexps(raw)
+}
+
+// SetRegexps compiles a new rule set and swaps it in; concurrent reloads are serialized,
+// in-flight matches keep using the rule set they started with
+func (checker *UrlBlacklister) SetRegexps(entries []string) error {
+	checker.reloadMu.Lock()
+	defer checker.reloadMu.Unlock()
+
+	rules, err := compileBlacklist(entries)
+	if err != nil {
+		return err
+	}
+	checker.rules.Store(rules)
+	return nil
+}
+
+// compileBlacklist sorts the entries out by type: exact domain, wildcard (domain suffix) or regexp
+func compileBlacklist(entries []string) (*blacklistRules, error) {
+	rules := &blacklistRules{exact: make(map[string]bool)}
+	for _, entry := range entries {
+		switch {
+		case strings.HasPrefix(entry, exactEntryPrefix):
+			domain := normalizeBlacklistDomain(strings.TrimPrefix(entry, exactEntryPrefix))
+			if domain == "" {
+				return nil, fmt.Errorf("invalid blacklist entry '%v': empty domain", entry)
+			}
+			rules.exact[domain] = true
+
+		case strings.HasPrefix(entry, wildcardEntryPrefix):
+			domain := normalizeBlacklistDomain(strings.TrimPrefix(entry, wildcardEntryPrefix))
+			if domain == "" {
+				return nil, fmt.Errorf("invalid blacklist entry '%v': empty domain", entry)
+			}
+			rules.suffixes = append(rules.suffixes, "."+domain)
+
+		default:
+			re, err := regexp.Compile(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid blacklist regexp '%v': %v", entry, err)
+			}
+			rules.regexps = append(rules.regexps, re)
+		}
+	}
+	return rules, nil
+}
+
+func normalizeBlacklistDomain(domain string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(domain)), ".")
 }
 
-func NewBlacklister(rawRegexps []string) *UrlBlacklister {
-	checker := &UrlBlacklister{}
-	var compiled []*regexp.Regexp
-	for _, exp := range rawRegexps {
-		compiled = append(compiled, regexp.MustCompile(exp))
+// readPatternsFile reads one pattern per line, skipping empty lines and # comments
+func readPatternsFile(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("can't open blacklist file: %v", err)
 	}
-	checker.Regexps = compiled
-	return checker
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("can't read blacklist file: %v", err)
+	}
+	return patterns, nil
 }
 
-func (checker *UrlBlacklister) UrlIsBlack(url string) bool {
-	for _, re := range checker.Regexps {
-		if re.MatchString(url) {
+func (checker *UrlBlacklister) getRules() *blacklistRules {
+	return checker.rules.Load().(*blacklistRules)
+}
+
+func (checker *UrlBlacklister) Regexps() []*regexp.Regexp {
+	return checker.getRules().regexps
+}
+
+// Size returns the number of blacklist entries of every type
+func (checker *UrlBlacklister) Size() int {
+	rules := checker.getRules()
+	return len(rules.regexps) + len(rules.exact) + len(rules.suffixes)
+}
+
+func (checker *UrlBlacklister) UrlIsBlack(rawUrl string) bool {
+	rules := checker.getRules()
+
+	if len(rules.exact) > 0 || len(rules.suffixes) > 0 {
+		if parsed, err := url.Parse(rawUrl); err == nil {
+			domain := normalizeBlacklistDomain(parsed.Hostname())
+			if rules.exact[domain] {
+				return true
+			}
+			for _, suffix := range rules.suffixes {
+				if strings.HasSuffix(domain, suffix) {
+					return true
+				}
+			}
+		}
+	}
+
+	for _, re := range rules.regexps {
+		if re.MatchString(rawUrl) {
 			return true
 		}
 	}
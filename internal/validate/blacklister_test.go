@@ -0,0 +1,111 @@
+package validate
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// TestBlacklisterConcurrentReloads swaps rule sets (SetRegexps and file reloads) while matching,
+// run with -race; every match must see one whole rule set, never a mix of two
+func TestBlacklisterConcurrentReloads(t *testing.T) {
+	ruleSets := []struct {
+		entries []string
+		black   string // blacklisted by every entry of the set
+		white   string // blacklisted by the other set only
+	}{
+		{entries: []string{"domain:a.com", "*.a.com", `^https?://a\.com/`}, black: "http://a.com/x", white: "http://b.com/x"},
+		{entries: []string{"domain:b.com", "*.b.com", `^https?://b\.com/`}, black: "http://b.com/x", white: "http://a.com/x"},
+	}
+
+	file := filepath.Join(t.TempDir(), "blacklist.txt")
+	// written to a temp file and renamed, so a reload never reads a partially written file
+	writeRules := func(entries []string) {
+		tmp := file + ".tmp"
+		if err := os.WriteFile(tmp, []byte(strings.Join(entries, "\n")), 0o600); err != nil {
+			t.Error(err)
+			return
+		}
+		if err := os.Rename(tmp, file); err != nil {
+			t.Error(err)
+		}
+	}
+	writeRules(ruleSets[0].entries)
+
+	checker, err := NewBlacklister(nil, file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const reloads, matches = 200, 2000
+	var wg sync.WaitGroup
+
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < reloads; i++ {
+			if err := checker.SetRegexps(ruleSets[i%2].entries); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < reloads; i++ {
+			writeRules(ruleSets[i%2].entries)
+			if err := checker.Reload(); err != nil {
+				t.Error(err)
+			}
+		}
+	}()
+
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < matches; i++ {
+				rules := checker.getRules()
+				set := 0
+				if rules.exact["b.com"] {
+					set = 1
+				}
+				if len(rules.regexps) != 1 || !rules.regexps[0].MatchString(ruleSets[set].black) ||
+					len(rules.suffixes) != 1 || rules.suffixes[0] != "."+strings.TrimPrefix(ruleSets[set].entries[1], "*.") {
+					t.Errorf("inconsistent rule set: exact %v, suffixes %v, regexps %v", rules.exact, rules.suffixes, rules.regexps)
+					return
+				}
+				checker.UrlIsBlack(ruleSets[i%2].black)
+				checker.UrlIsBlack(ruleSets[i%2].white)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestBlacklisterReloadKeepsRulesOnError(t *testing.T) {
+	checker, err := NewBlacklister([]string{"domain:a.com"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		entries []string
+	}{
+		{name: "invalid regexp", entries: []string{"domain:b.com", "(unclosed"}},
+		{name: "empty domain", entries: []string{"domain:"}},
+		{name: "empty wildcard", entries: []string{"*."}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := checker.SetRegexps(tt.entries); err == nil {
+				t.Fatal("expected an error")
+			}
+			if !checker.UrlIsBlack("http://a.com/") || checker.UrlIsBlack("http://b.com/") {
+				t.Error("the rule set was replaced")
+			}
+		})
+	}
+}
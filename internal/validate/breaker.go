@@ -0,0 +1,137 @@
+package validate
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	lg "phish-api/internal/logging"
+	mt "phish-api/internal/metrics"
+)
+
+// BreakerConfig stops calling the whitelister api after consecutive failed checks,
+// checks then fail right away (resolved by the failure policy) until the cooldown passes
+type BreakerConfig struct {
+	Failures int           `yaml:"failures"` // consecutive failed checks opening the breaker, 0 = disabled
+	Cooldown time.Duration `yaml:"cooldown"` // default 30s
+}
+
+const defaultBreakerCooldown = 30 * time.Second
+
+// ErrBreakerOpen is the error of checks short-circuited by the open breaker
+var ErrBreakerOpen = errors.New("whitelister api circuit breaker is open")
+
+// breaker states, also the values of the state gauge
+const (
+	breakerClosed   = 0
+	breakerOpen     = 1
+	breakerHalfOpen = 2 // cooldown passed, a single probe check is let through
+)
+
+type breaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     int
+	failures  int
+	openedAt  time.Time
+	probing   bool
+	now       func() time.Time // the clock, replaced in tests
+}
+
+// newBreaker returns nil when the breaker is disabled, a nil breaker lets every check through
+func newBreaker(cfg BreakerConfig) *breaker {
+	if cfg.Failures <= 0 {
+		return nil
+	}
+	cooldown := cfg.Cooldown
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	mt.WhitelisterBreaker.Set(breakerClosed)
+	return &breaker{threshold: cfg.Failures, cooldown: cooldown, now: time.Now}
+}
+
+// run calls the check unless the breaker is open, failed checks (no result) count towards opening it,
+// other errors (e.g. a cancelled request) say nothing about the api
+func (b *breaker) run(check func() (bool, error)) (bool, error) {
+	if b == nil {
+		return check()
+	}
+	if !b.allow() {
+		return false, &NoResultError{Err: ErrBreakerOpen}
+	}
+
+	isWhite, err := check()
+	var noResult *NoResultError
+	switch {
+	case err == nil:
+		b.success()
+	case errors.As(err, &noResult):
+		b.failure()
+	default:
+		b.cancel()
+	}
+	return isWhite, err
+}
+
+func (b *breaker) allow() bool {
+	b.Lock()
+	defer b.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if b.now().Sub(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.setState(breakerHalfOpen)
+		b.probing = true
+		return true
+	case breakerHalfOpen:
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+func (b *breaker) success() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	if b.state != breakerClosed {
+		lg.Info("whitelister api circuit breaker closed", nil)
+		b.setState(breakerClosed)
+	}
+}
+
+func (b *breaker) failure() {
+	b.Lock()
+	defer b.Unlock()
+
+	b.failures++
+	b.probing = false
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			lg.Warn("whitelister api circuit breaker opened", lg.Fields{"failures": b.failures, "cooldown": b.cooldown.String()})
+		}
+		b.openedAt = b.now()
+		b.setState(breakerOpen)
+	}
+}
+
+// cancel releases the probe slot of an aborted check
+func (b *breaker) cancel() {
+	b.Lock()
+	defer b.Unlock()
+	b.probing = false
+}
+
+func (b *breaker) setState(state int) {
+	b.state = state
+	mt.WhitelisterBreaker.Set(float64(state))
+}
@@ -0,0 +1,100 @@
+package validate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	clock := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBreaker(BreakerConfig{Failures: 2, Cooldown: time.Minute})
+	b.now = func() time.Time { return clock }
+
+	calls := 0
+	fail := func() (bool, error) {
+		calls++
+		return false, &NoResultError{Err: errors.New("api is down")}
+	}
+	succeed := func() (bool, error) {
+		calls++
+		return true, nil
+	}
+	run := func(check func() (bool, error)) error {
+		_, err := b.run(check)
+		return err
+	}
+
+	// closed: failures below the threshold are let through
+	run(fail)
+	if b.state != breakerClosed || calls != 1 {
+		t.Fatalf("state = %v, calls = %v after 1 failure, want closed, 1", b.state, calls)
+	}
+	run(fail)
+	if b.state != breakerOpen {
+		t.Fatalf("state = %v after 2 failures, want open", b.state)
+	}
+
+	// open: checks fail right away until the cooldown passes
+	clock = clock.Add(time.Minute - time.Second)
+	if err := run(succeed); !errors.Is(err, ErrBreakerOpen) || calls != 2 {
+		t.Fatalf("run() = %v (calls: %v), want ErrBreakerOpen without a call", err, calls)
+	}
+
+	// half-open: a failed probe opens it again, for another cooldown
+	clock = clock.Add(time.Second)
+	run(fail)
+	if b.state != breakerOpen || calls != 3 {
+		t.Fatalf("state = %v, calls = %v after a failed probe, want open, 3", b.state, calls)
+	}
+	if err := run(succeed); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("run() = %v right after a failed probe, want ErrBreakerOpen", err)
+	}
+
+	// half-open: a single probe at a time, a successful one closes it
+	clock = clock.Add(time.Minute)
+	if !b.allow() || b.state != breakerHalfOpen {
+		t.Fatalf("state = %v after the cooldown, want half-open", b.state)
+	}
+	if err := run(succeed); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("run() = %v during a probe, want ErrBreakerOpen", err)
+	}
+	b.success()
+	if b.state != breakerClosed {
+		t.Fatalf("state = %v after a successful probe, want closed", b.state)
+	}
+
+	// closed: the failure count starts over
+	run(fail)
+	if b.state != breakerClosed {
+		t.Errorf("state = %v after 1 failure, want closed", b.state)
+	}
+}
+
+// TestBreakerCancel checks an aborted probe neither closes nor opens the breaker, but frees the probe slot
+func TestBreakerCancel(t *testing.T) {
+	clock := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := newBreaker(BreakerConfig{Failures: 1, Cooldown: time.Minute})
+	b.now = func() time.Time { return clock }
+
+	b.run(func() (bool, error) { return false, &NoResultError{Err: errors.New("api is down")} })
+	clock = clock.Add(time.Minute)
+	b.run(func() (bool, error) { return false, context.Canceled })
+	if b.state != breakerHalfOpen {
+		t.Fatalf("state = %v after an aborted probe, want half-open", b.state)
+	}
+	if _, err := b.run(func() (bool, error) { return true, nil }); err != nil || b.state != breakerClosed {
+		t.Errorf("run() = %v, state = %v, want the next probe to close it", err, b.state)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	if b := newBreaker(BreakerConfig{}); b != nil {
+		t.Fatal("newBreaker() != nil with no failures threshold")
+	}
+	var b *breaker
+	if isWhite, err := b.run(func() (bool, error) { return true, nil }); !isWhite || err != nil {
+		t.Errorf("nil breaker run() = %v, %v, want the check result", isWhite, err)
+	}
+}
@@ -0,0 +1,110 @@
+package validate
+
+import (
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	mt "phish-api/internal/metrics"
+
+	"github.com/patrickmn/go-cache"
+)
+
+type CacheMonitorConfig struct {
+	Interval time.Duration `yaml:"interval"`  // 0 disables the monitor
+	MaxItems int           `yaml:"max_items"` // per cache, 0 means unbounded
+}
+
+// monitorCaches periodically reports cache sizes and keeps them under the configured max
+func (v *Validator) monitorCaches(cfg CacheMonitorConfig) {
+	caches := map[string]Cache{
+		"domain":      v.DomainCache,
+		"whitelister": v.Whitelister.memcache,
+	}
+
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-v.closing:
+			return
+		}
+
+		for name, itf := range caches {
+			count := itf.ItemCount()
+			// lru caches are bounded by themselves
+			c, isGoCache := itf.(*cache.Cache)
+			if isGoCache && cfg.MaxItems > 0 && count > cfg.MaxItems {
+				c.DeleteExpired()
+				evictOldest(c, c.ItemCount()-cfg.MaxItems)
+				log.Printf("%v cache is over the limit (%v > %v), evicted: %v", name, count, cfg.MaxItems, count-c.ItemCount())
+				count = c.ItemCount()
+			}
+
+			log.Printf("%v cache size: %v", name, count)
+			mt.SetGaugeVec(mt.CacheItems, name, float64(count))
+		}
+	}
+}
+
+// evictOldest deletes n items expiring soonest (the oldest ones, as every item gets the same ttl)
+func evictOldest(c *cache.Cache, n int) {
+	if n <= 0 {
+		return
+	}
+
+	items := c.Items()
+	keys := make([]string, 0, len(items))
+	for key := range items {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		return items[keys[i]].Expiration < items[keys[j]].Expiration
+	})
+
+	if n > len(keys) {
+		n = len(keys)
+	}
+	for _, key := range keys[:n] {
+		c.Delete(key)
+	}
+}
+
+// CacheStat is a cache size and its hit counters (since start)
+type CacheStat struct {
+	Items   int     `json:"items"`
+	Hits    uint64  `json:"hits"`
+	Misses  uint64  `json:"misses"`
+	HitRate float64 `json:"hit_rate"`
+}
+
+type hitCounter struct {
+	hits   uint64
+	misses uint64
+}
+
+func (h *hitCounter) record(hit bool) {
+	if hit {
+		atomic.AddUint64(&h.hits, 1)
+	} else {
+		atomic.AddUint64(&h.misses, 1)
+	}
+}
+
+func (h *hitCounter) stat(items int) CacheStat {
+	stat := CacheStat{Items: items, Hits: atomic.LoadUint64(&h.hits), Misses: atomic.LoadUint64(&h.misses)}
+	if total := stat.Hits + stat.Misses; total > 0 {
+		stat.HitRate = float64(stat.Hits) / float64(total)
+	}
+	return stat
+}
+
+// CacheStats returns the domain and whitelister cache stats
+func (v *Validator) CacheStats() map[string]CacheStat {
+	return map[string]CacheStat{
+		"domain":      v.domainCacheHits.stat(v.DomainCache.ItemCount()),
+		"whitelister": v.Whitelister.cacheHits.stat(v.Whitelister.memcache.ItemCount()),
+	}
+}
@@ -0,0 +1,120 @@
+package validate
+
+import (
+	"context"
+	"fmt"
+)
+
+// UrlCheck breaks the validation of a url down to the individual checks
+type UrlCheck struct {
+	URL         string   `json:"url"`
+	Domain      string   `json:"domain"`
+	IsIP        bool     `json:"is_ip"`
+	Blacklisted bool     `json:"blacklisted"`
+	IsLocal     *bool    `json:"is_local,omitempty"` // ips and resolved domains
+	Whitelisted bool     `json:"whitelisted"`
+	HasARecord  *bool    `json:"has_a_record,omitempty"` // domains only
+	CNAME       string   `json:"cname,omitempty"`
+	MX          []string `json:"mx,omitempty"`
+	DnsErrors   []string `json:"dns_errors,omitempty"` // transient lookup failures
+
+	// final decision, as made for submitted urls
+	RequiresProcessing bool       `json:"requires_processing"`
+	Reason             SkipReason `json:"reason,omitempty"`
+
+	hasCNAME, hasMX             bool
+	aRecordErr, cnameErr, mxErr error
+}
+
+// CheckUrl runs every validation check of the url once and derives the decision from their results,
+// the way submitted urls are decided (without the caches and without counting it as a validation outcome),
+// to explain why a url is or isn't processed. Invalid urls fail with ErrInvalidUrl, a failed lookup
+// the decision depends on with its error (ErrTransient if temporary)
+func (v *Validator) CheckUrl(ctx context.Context, url, source string) (*UrlCheck, error) {
+	_, domain, isIP, err := v.ParseDomain(url)
+	if err != nil {
+		return nil, err
+	}
+
+	check := &UrlCheck{
+		URL:         url,
+		Domain:      domain,
+		IsIP:        isIP,
+		Blacklisted: v.urlIsBlack(ctx, url),
+	}
+
+	if isIP {
+		isLocal := v.IpChecker.IsLocalIP(v.IpChecker.GetNetIP(domain))
+		check.IsLocal = &isLocal
+	} else {
+		ips, hasARecord, err := v.resolveDomain(ctx, domain)
+		if err != nil {
+			check.aRecordErr = err
+			check.DnsErrors = append(check.DnsErrors, fmt.Sprintf("a: %v", err))
+		} else {
+			check.HasARecord = &hasARecord
+		}
+		if len(ips) > 0 {
+			isLocal := v.IpChecker.FirstLocalIP(ips) != ""
+			check.IsLocal = &isLocal
+		}
+
+		if check.CNAME, check.hasCNAME, err = v.IpChecker.GetDomainCNAME(ctx, domain); err != nil {
+			check.cnameErr = lookupError("cname", domain, err)
+			check.DnsErrors = append(check.DnsErrors, fmt.Sprintf("cname: %v", err))
+		}
+		if check.MX, check.hasMX, err = v.IpChecker.GetDomainMX(ctx, domain); err != nil {
+			check.mxErr = lookupError("mx", domain, err)
+			check.DnsErrors = append(check.DnsErrors, fmt.Sprintf("mx: %v", err))
+		}
+	}
+
+	release, err := v.Throttler.Acquire(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	check.Whitelisted, err = v.DomainIsWhiteListed(ctx, domain)
+	release()
+	if err != nil {
+		return nil, err
+	}
+
+	if check.RequiresProcessing, check.Reason, err = v.decide(check); err != nil {
+		return nil, err
+	}
+	return check, nil
+}
+
+// decide applies the checks in the order of urlRequiresProcessing / domainRequiresProcessing
+func (v *Validator) decide(check *UrlCheck) (bool, SkipReason, error) {
+	switch {
+	case check.Blacklisted:
+		return false, ReasonBlacklisted, nil
+
+	case check.IsIP && check.IsLocal != nil && *check.IsLocal:
+		return false, ReasonLocalIP, nil
+	case check.IsIP && check.Whitelisted:
+		return false, ReasonWhitelistedIP, nil
+	case check.IsIP:
+		return true, ReasonNone, nil
+
+	case check.Whitelisted:
+		return false, ReasonWhitelistedDomain, nil
+	case check.aRecordErr != nil:
+		return false, ReasonNone, check.aRecordErr
+	case check.IsLocal != nil && *check.IsLocal:
+		return false, ReasonLocalIP, nil
+	case !*check.HasARecord && v.CnameCountsAsRecord && check.cnameErr != nil:
+		return false, ReasonNone, check.cnameErr
+	case !*check.HasARecord && v.CnameCountsAsRecord && check.hasCNAME:
+		return true, ReasonNone, nil
+	case !*check.HasARecord && v.MxCountsAsRecord && check.mxErr != nil:
+		return false, ReasonNone, check.mxErr
+	case !*check.HasARecord && v.MxCountsAsRecord && check.hasMX:
+		return true, ReasonNone, nil
+	case !*check.HasARecord:
+		return false, ReasonNoARecord, nil
+	default:
+		return true, ReasonNone, nil
+	}
+}
@@ -0,0 +1,128 @@
+package validate
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// TestCheckUrlMatchesDecision checks the explained decision is the one submitted urls get
+func TestCheckUrlMatchesDecision(t *testing.T) {
+	tests := []struct {
+		name               string
+		url                string
+		rcode              dnsmessage.RCode
+		ips                []string
+		requiresProcessing bool
+		reason             SkipReason
+		transient          bool
+	}{
+		{name: "public domain", url: "http://phish.example/x", ips: []string{"93.184.216.34"}, requiresProcessing: true},
+		{name: "domain resolving to a local ip", url: "http://phish.example/x", ips: []string{"10.1.2.3"}, reason: ReasonLocalIP},
+		{name: "nxdomain", url: "http://phish.example/x", rcode: dnsmessage.RCodeNameError, reason: ReasonNoARecord},
+		{name: "whitelisted domain", url: "http://white.example/x", ips: []string{"93.184.216.34"}, reason: ReasonWhitelistedDomain},
+		{name: "blacklisted", url: "http://black.example/x", ips: []string{"93.184.216.34"}, reason: ReasonBlacklisted},
+		{name: "local ip", url: "http://10.0.0.1/x", reason: ReasonLocalIP},
+		{name: "whitelisted ip", url: "http://1.2.3.4/x", reason: ReasonWhitelistedIP},
+		{name: "ip", url: "http://5.6.7.8/x", requiresProcessing: true},
+		{name: "servfail", url: "http://phish.example/x", rcode: dnsmessage.RCodeServerFailure, transient: true},
+	}
+
+	wlApi, _ := newWhitelistServer(t, "1.2.3.4", "white.example")
+	blacklister, err := NewBlacklister([]string{`black\.example`}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestValidator(wlApi, false)
+			v.UrlBlacklister = blacklister
+			v.IpChecker.Resolver = fakeResolver(tt.rcode, tt.ips, false)
+
+			check, checkErr := v.CheckUrl(context.Background(), tt.url, "src")
+			requiresProcessing, reason, err := v.UrlRequiresProcessing(context.Background(), tt.url, "src", true)
+			if tt.transient {
+				if !errors.Is(checkErr, ErrTransient) || !errors.Is(err, ErrTransient) {
+					t.Fatalf("errors = %v / %v, want transient errors", checkErr, err)
+				}
+				return
+			}
+			if checkErr != nil || err != nil {
+				t.Fatalf("unexpected errors: %v / %v", checkErr, err)
+			}
+
+			if check.RequiresProcessing != tt.requiresProcessing || check.Reason != tt.reason {
+				t.Errorf("CheckUrl() = %v, %q, want %v, %q", check.RequiresProcessing, check.Reason, tt.requiresProcessing, tt.reason)
+			}
+			if requiresProcessing != tt.requiresProcessing || reason != tt.reason {
+				t.Errorf("UrlRequiresProcessing() = %v, %q, want %v, %q", requiresProcessing, reason, tt.requiresProcessing, tt.reason)
+			}
+		})
+	}
+}
+
+func TestCheckUrlIgnoresCachedDecision(t *testing.T) {
+	wlApi, _ := newWhitelistServer(t)
+	v := newTestValidator(wlApi, false)
+	v.IpChecker.Resolver = fakeResolver(dnsmessage.RCodeSuccess, []string{"93.184.216.34"}, false)
+	v.setDomainCache("phish.example", domainVerdict{requiresProcessing: false, reason: ReasonWhitelistedDomain})
+
+	check, err := v.CheckUrl(context.Background(), "http://phish.example/x", "src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !check.RequiresProcessing || check.Reason != ReasonNone || check.Whitelisted {
+		t.Errorf("CheckUrl() = %v, %q (whitelisted: %v), want the fresh decision", check.RequiresProcessing, check.Reason, check.Whitelisted)
+	}
+}
+
+func TestCheckUrlInvalid(t *testing.T) {
+	v := newTestValidator(WhitelisterApi{}, true)
+	for _, url := range []string{"", "http:///x", "http://exa mple.com/"} {
+		if _, err := v.CheckUrl(context.Background(), url, "src"); !errors.Is(err, ErrInvalidUrl) {
+			t.Errorf("CheckUrl(%q) error = %v, want an invalid url error", url, err)
+		}
+	}
+}
+
+// TestOtherRecordLookupFailure checks a failed mx lookup isn't taken for a missing mx record
+func TestOtherRecordLookupFailure(t *testing.T) {
+	tests := []struct {
+		name      string
+		mxRcode   dnsmessage.RCode
+		reason    SkipReason
+		transient bool
+	}{
+		{name: "no mx record", reason: ReasonNoARecord},
+		{name: "mx servfail", mxRcode: dnsmessage.RCodeServerFailure, transient: true},
+	}
+
+	wlApi, _ := newWhitelistServer(t)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			v := newTestValidator(wlApi, false)
+			v.MxCountsAsRecord = true
+			v.IpChecker.Resolver = typedResolver(map[dnsmessage.Type]dnsmessage.RCode{dnsmessage.TypeMX: tt.mxRcode}, nil)
+
+			check, checkErr := v.CheckUrl(context.Background(), "http://phish.example/x", "src")
+			requiresProcessing, reason, err := v.UrlRequiresProcessing(context.Background(), "http://phish.example/x", "src", true)
+			if tt.transient {
+				if !errors.Is(checkErr, ErrTransient) || !errors.Is(err, ErrTransient) {
+					t.Fatalf("errors = %v / %v, want transient errors", checkErr, err)
+				}
+				return
+			}
+			if checkErr != nil || err != nil {
+				t.Fatalf("unexpected errors: %v / %v", checkErr, err)
+			}
+			if check.RequiresProcessing || check.Reason != tt.reason {
+				t.Errorf("CheckUrl() = %v, %q, want false, %q", check.RequiresProcessing, check.Reason, tt.reason)
+			}
+			if requiresProcessing || reason != tt.reason {
+				t.Errorf("UrlRequiresProcessing() = %v, %q, want false, %q", requiresProcessing, reason, tt.reason)
+			}
+		})
+	}
+}
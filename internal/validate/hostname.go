@@ -0,0 +1,50 @@
+package validate
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"unicode"
+)
+
+// dns limits (rfc 1035), checked on the punycode form
+const (
+	maxHostnameLength = 253
+	maxLabelLength    = 63
+)
+
+// CheckHostname rejects hostnames with spaces / control characters, empty labels, labels over 63
+// or names over 253 characters; ips are accepted as is
+func CheckHostname(hostname string) error {
+	for _, r := range hostname {
+		if unicode.IsSpace(r) {
+			return fmt.Errorf("host contains a space: %q", hostname)
+		}
+		if unicode.IsControl(r) {
+			return fmt.Errorf("host contains a control character: %q", hostname)
+		}
+	}
+	if net.ParseIP(strings.Trim(hostname, "[]")) != nil {
+		return nil
+	}
+
+	ascii, err := NormalizeHostname(strings.TrimSuffix(hostname, "."))
+	if err != nil {
+		return fmt.Errorf("invalid host: %v", err)
+	}
+	if ascii == "" {
+		return fmt.Errorf("host is empty")
+	}
+	if len(ascii) > maxHostnameLength {
+		return fmt.Errorf("host is too long: %v chars (max: %v)", len(ascii), maxHostnameLength)
+	}
+	for _, label := range strings.Split(ascii, ".") {
+		if label == "" {
+			return fmt.Errorf("host has an empty label: %v", ascii)
+		}
+		if len(label) > maxLabelLength {
+			return fmt.Errorf("host label is too long: %v... (%v chars, max: %v)", label[:16], len(label), maxLabelLength)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package validate
+
+import (
+	"fmt"
+	"strings"
+
+	"golang.org/x/net/idna"
+)
+
+// idnaProfile is the lookup profile without std3 rules, as real-world (phishing) hosts may contain underscores
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.StrictDomainName(false))
+
+// NormalizeHostname lowercases the hostname and converts internationalized names to punycode,
+// so unicode and xn-- forms of the same domain share cache and whitelist entries
+func NormalizeHostname(hostname string) (string, error) {
+	ascii, err := idnaProfile.ToASCII(strings.ToLower(hostname))
+	if err != nil {
+		return "", fmt.Errorf("invalid idn domain %q: %v", hostname, err)
+	}
+	return ascii, nil
+}
@@ -1,18 +1,34 @@
 package validate
 
 import (
+	"context"
 	"errors"
 	"log"
 	"net"
+	"strings"
+	"time"
+
+	mt "phish-api/internal/metrics"
+)
+
+const (
+	defaultDnsTimeout = 5 * time.Second
 )
 
+var errNoARecords = errors.New("empty list of a-records received")
+
 type IpChecker struct {
 	LocalIPNets []*net.IPNet
+	Resolver    *net.Resolver
+	DnsTimeout  time.Duration
 }
 
-func NewIpChecker(localNets []string) *IpChecker {
+func NewIpChecker(localNets []string, dnsTimeout time.Duration) *IpChecker {
 	var nets []*net.IPNet
-	checker := &IpChecker{}
+	if dnsTimeout <= 0 {
+		dnsTimeout = defaultDnsTimeout
+	}
+	checker := &IpChecker{Resolver: net.DefaultResolver, DnsTimeout: dnsTimeout}
 	for _, localNet := range localNets {
 		_, net, err := net.ParseCIDR(localNet)
 		if err != nil {
@@ -24,8 +40,10 @@ func NewIpChecker(localNets []string) *IpChecker {
 	return checker
 }
 
+// IsLocalIP reports whether the ip is loopback, link-local, private (rfc1918 / ipv6 unique local fc00::/7),
+// unspecified or within one of the configured local nets (ipv4 and ipv6 cidrs are both supported)
 func (checker *IpChecker) IsLocalIP(ip net.IP) bool {
-	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsPrivate() || ip.IsUnspecified() {
 		return true
 	}
 
@@ -37,7 +55,12 @@ func (checker *IpChecker) IsLocalIP(ip net.IP) bool {
 	return false
 }
 
+// GetNetIP parses an ip literal; bracketed ([::1]) and zoned (fe80::1%eth0) ipv6 hosts are accepted
 func (checker *IpChecker) GetNetIP(domain string) net.IP {
+	domain = strings.TrimSuffix(strings.TrimPrefix(domain, "["), "]")
+	if zoneIndex := strings.LastIndex(domain, "%"); zoneIndex != -1 && strings.Contains(domain, ":") {
+		domain = domain[:zoneIndex]
+	}
 	return net.ParseIP(domain)
 }
 
@@ -45,22 +68,102 @@ func (checker *IpChecker) DomainIsIP(domain string) bool {
 	return checker.GetNetIP(domain) != nil
 }
 
-func (checker *IpChecker) GetDomainIP(domain string) (string, error) {
+// GetDomainIP resolves the domain's first a-record; the lookup is bound by ctx and the dns timeout
+func (checker *IpChecker) GetDomainIP(ctx context.Context, domain string) (string, error) {
+	ips, err := checker.GetDomainIPs(ctx, domain)
+	if err != nil {
+		return "", err
+	}
+	return ips[0], nil
+}
+
+// GetDomainIPs resolves all the domain's a (and aaaa) records, the list is never empty without an error;
+// the lookup is bound by ctx and the dns timeout
+func (checker *IpChecker) GetDomainIPs(ctx context.Context, domain string) ([]string, error) {
 	if checker.DomainIsIP(domain) {
-		return domain, nil
+		return []string{domain}, nil
 	}
 
-	ips, err := net.LookupHost(domain)
+	ctx, cancel := context.WithTimeout(ctx, checker.DnsTimeout)
+	defer cancel()
+
+	start := time.Now()
+	ips, err := checker.Resolver.LookupHost(ctx, domain)
+	mt.DnsLookupDuration.Observe(time.Since(start).Seconds())
 	if err != nil {
+		mt.DnsLookupFailures.Inc()
 		log.Printf("get a-record fail (net.LookupHost() error):%v > %v", domain, err)
-		return "", err
+		return nil, err
 	}
 	if len(ips) == 0 {
 		log.Printf("get a-record fail (empty list received): %v", domain)
-		return "", errors.New("empty list of a-records received")
+		return nil, errNoARecords
+
+	}
+	log.Printf("get a-record ok: %v > %v", domain, ips)
+	return ips, nil
+}
+
+// FirstLocalIP returns the first of the ips within the local nets, empty if none is
+func (checker *IpChecker) FirstLocalIP(ips []string) string {
+	for _, ip := range ips {
+		if netIP := checker.GetNetIP(ip); netIP != nil && checker.IsLocalIP(netIP) {
+			return ip
+		}
+	}
+	return ""
+}
+
+// isNotFound reports whether the lookup error means the name (or record) doesn't exist,
+// as opposed to a transient resolver failure
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
+
+// GetDomainCNAME resolves the domain's canonical name; found is false if the domain has no cname
+// (or doesn't exist), an error is returned on transient resolver failures only
+func (checker *IpChecker) GetDomainCNAME(ctx context.Context, domain string) (string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, checker.DnsTimeout)
+	defer cancel()
+
+	cname, err := checker.Resolver.LookupCNAME(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return "", false, nil
+		}
+		mt.DnsLookupFailures.Inc()
+		log.Printf("get cname fail (net.LookupCNAME() error): %v > %v", domain, err)
+		return "", false, err
+	}
+
+	// a domain without a cname resolves to itself
+	cname = strings.TrimSuffix(cname, ".")
+	if strings.EqualFold(cname, strings.TrimSuffix(domain, ".")) {
+		return "", false, nil
+	}
+	return cname, true, nil
+}
+
+// GetDomainMX resolves the domain's mail exchangers; found is false if the domain has none
+// (or doesn't exist), an error is returned on transient resolver failures only
+func (checker *IpChecker) GetDomainMX(ctx context.Context, domain string) ([]string, bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, checker.DnsTimeout)
+	defer cancel()
+
+	records, err := checker.Resolver.LookupMX(ctx, domain)
+	if err != nil {
+		if isNotFound(err) {
+			return nil, false, nil
+		}
+		mt.DnsLookupFailures.Inc()
+		log.Printf("get mx fail (net.LookupMX() error): %v > %v", domain, err)
+		return nil, false, err
+	}
 
+	hosts := make([]string, 0, len(records))
+	for _, mx := range records {
+		hosts = append(hosts, strings.TrimSuffix(mx.Host, "."))
 	}
-	ip := ips[0]
-	log.Printf("get a-record ok: %v > %v", domain, ip)
-	return ip, nil
+	return hosts, len(hosts) > 0, nil
 }
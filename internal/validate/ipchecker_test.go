@@ -0,0 +1,226 @@
+package validate
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestIsLocalIP(t *testing.T) {
+	checker := NewIpChecker([]string{"100.64.0.0/10", "2001:db8:1::/48"}, time.Second)
+
+	tests := []struct {
+		ip      string
+		isLocal bool
+	}{
+		{ip: "127.0.0.1", isLocal: true},
+		{ip: "10.1.2.3", isLocal: true},
+		{ip: "192.168.0.1", isLocal: true},
+		{ip: "169.254.1.1", isLocal: true},
+		{ip: "0.0.0.0", isLocal: true},
+		{ip: "100.64.1.1", isLocal: true}, // configured net
+		{ip: "8.8.8.8"},
+		{ip: "::1", isLocal: true},
+		{ip: "::", isLocal: true},
+		{ip: "fe80::1", isLocal: true},
+		{ip: "fc00::1", isLocal: true},
+		{ip: "fd12:3456::1", isLocal: true},
+		{ip: "2001:db8:1::5", isLocal: true}, // configured net
+		{ip: "2001:db8:2::5"},
+		{ip: "2606:4700::1111"},
+		{ip: "::ffff:10.0.0.1", isLocal: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			ip := net.ParseIP(tt.ip)
+			if ip == nil {
+				t.Fatalf("invalid test ip: %v", tt.ip)
+			}
+			if isLocal := checker.IsLocalIP(ip); isLocal != tt.isLocal {
+				t.Errorf("IsLocalIP(%v) = %v, want %v", tt.ip, isLocal, tt.isLocal)
+			}
+		})
+	}
+}
+
+func TestGetNetIP(t *testing.T) {
+	checker := NewIpChecker(nil, time.Second)
+
+	tests := []struct {
+		domain string
+		ip     string // empty if the domain isn't an ip literal
+	}{
+		{domain: "1.2.3.4", ip: "1.2.3.4"},
+		{domain: "[::1]", ip: "::1"},
+		{domain: "[fd00::1]", ip: "fd00::1"},
+		{domain: "fe80::1%eth0", ip: "fe80::1"},
+		{domain: "[fe80::1%25eth0]", ip: "fe80::1"},
+		{domain: "example.com"},
+		{domain: "[example.com]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			netIP := checker.GetNetIP(tt.domain)
+			if tt.ip == "" {
+				if netIP != nil {
+					t.Errorf("GetNetIP(%q) = %v, want nil", tt.domain, netIP)
+				}
+				return
+			}
+			if !netIP.Equal(net.ParseIP(tt.ip)) {
+				t.Errorf("GetNetIP(%q) = %v, want %v", tt.domain, netIP, tt.ip)
+			}
+		})
+	}
+}
+
+// fakeResolver answers every query over an in-memory (stream framed) connection: with the rcode
+// and, for a queries, the ips; hang never answers (the lookup times out)
+func fakeResolver(rcode dnsmessage.RCode, ips []string, hang bool) *net.Resolver {
+	return answeringResolver(rcode, func() []string { return ips }, hang)
+}
+
+// answeringResolver is fakeResolver with the a-records picked per query
+func answeringResolver(rcode dnsmessage.RCode, answer func() []string, hang bool) *net.Resolver {
+	return newFakeResolver(func(dnsmessage.Type) dnsmessage.RCode { return rcode }, answer, hang)
+}
+
+// typedResolver is fakeResolver with the rcode picked per query type (success if unlisted)
+func typedResolver(rcodes map[dnsmessage.Type]dnsmessage.RCode, ips []string) *net.Resolver {
+	return newFakeResolver(func(qtype dnsmessage.Type) dnsmessage.RCode { return rcodes[qtype] }, func() []string { return ips }, false)
+}
+
+func newFakeResolver(rcodeOf func(dnsmessage.Type) dnsmessage.RCode, answer func() []string, hang bool) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			client, server := net.Pipe()
+			go serveFakeDns(server, rcodeOf, answer, hang)
+			return client, nil
+		},
+	}
+}
+
+func serveFakeDns(conn net.Conn, rcodeOf func(dnsmessage.Type) dnsmessage.RCode, answer func() []string, hang bool) {
+	defer conn.Close()
+	for {
+		var size uint16
+		if err := binary.Read(conn, binary.BigEndian, &size); err != nil {
+			return
+		}
+		query := make([]byte, size)
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return
+		}
+		if hang {
+			continue
+		}
+
+		var msg dnsmessage.Message
+		if err := msg.Unpack(query); err != nil || len(msg.Questions) == 0 {
+			return
+		}
+		question := msg.Questions[0]
+		rcode := rcodeOf(question.Type)
+		msg.Header.Response, msg.Header.RCode, msg.Header.RecursionAvailable = true, rcode, true
+		if rcode == dnsmessage.RCodeSuccess && question.Type == dnsmessage.TypeA {
+			for _, ip := range answer() {
+				var a dnsmessage.AResource
+				copy(a.A[:], net.ParseIP(ip).To4())
+				msg.Answers = append(msg.Answers, dnsmessage.Resource{
+					Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+					Body:   &a,
+				})
+			}
+		}
+
+		resp, err := msg.Pack()
+		if err != nil {
+			return
+		}
+		if err := binary.Write(conn, binary.BigEndian, uint16(len(resp))); err != nil {
+			return
+		}
+		if _, err := conn.Write(resp); err != nil {
+			return
+		}
+	}
+}
+
+func TestDomainHasARecord(t *testing.T) {
+	tests := []struct {
+		name       string
+		rcode      dnsmessage.RCode
+		ips        []string
+		hang       bool
+		hasARecord bool
+		transient  bool
+	}{
+		{name: "resolves", rcode: dnsmessage.RCodeSuccess, ips: []string{"93.184.216.34"}, hasARecord: true},
+		{name: "nxdomain", rcode: dnsmessage.RCodeNameError},
+		{name: "no a-records", rcode: dnsmessage.RCodeSuccess},
+		{name: "servfail", rcode: dnsmessage.RCodeServerFailure, transient: true},
+		{name: "refused", rcode: dnsmessage.RCodeRefused, transient: true},
+		{name: "timeout", hang: true, transient: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := NewIpChecker(nil, 200*time.Millisecond)
+			checker.Resolver = fakeResolver(tt.rcode, tt.ips, tt.hang)
+			v := &Validator{IpChecker: checker}
+
+			hasARecord, err := v.DomainHasARecord(context.Background(), "phish.example.")
+			if tt.transient {
+				if !errors.Is(err, ErrTransient) {
+					t.Fatalf("error = %v, want a transient error", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if hasARecord != tt.hasARecord {
+				t.Errorf("hasARecord = %v, want %v", hasARecord, tt.hasARecord)
+			}
+		})
+	}
+}
+
+func TestGetDomainIPsFirstLocalIP(t *testing.T) {
+	tests := []struct {
+		name    string
+		ips     []string
+		localIP string
+	}{
+		{name: "public", ips: []string{"93.184.216.34"}},
+		{name: "loopback", ips: []string{"127.0.0.1"}, localIP: "127.0.0.1"},
+		{name: "local after public", ips: []string{"93.184.216.34", "10.1.2.3"}, localIP: "10.1.2.3"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			checker := NewIpChecker(nil, time.Second)
+			checker.Resolver = fakeResolver(dnsmessage.RCodeSuccess, tt.ips, false)
+
+			ips, err := checker.GetDomainIPs(context.Background(), "phish.example.")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(ips) != len(tt.ips) {
+				t.Fatalf("ips = %v, want %v", ips, tt.ips)
+			}
+			if localIP := checker.FirstLocalIP(ips); localIP != tt.localIP {
+				t.Errorf("FirstLocalIP = %q, want %q", localIP, tt.localIP)
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package validate
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	mt "phish-api/internal/metrics"
+
+	"github.com/patrickmn/go-cache"
+)
+
+// Cache is the domain/whitelister result cache: go-cache (unbounded, expired items are purged
+// periodically) or lruCache (bounded)
+type Cache interface {
+	Get(key string) (interface{}, bool)
+	Set(key string, val interface{}, ttl time.Duration)
+	Delete(key string)
+	ItemCount() int
+	Items() map[string]cache.Item // unexpired entries
+}
+
+// newCache returns a bounded lru cache if maxItems > 0, an unbounded go-cache otherwise;
+// go-cache expired items are purged until done is closed
+func newCache(name string, maxItems int, ttl, purgeInterval time.Duration, done <-chan struct{}) Cache {
+	if maxItems > 0 {
+		return newLruCache(name, maxItems)
+	}
+	// the go-cache janitor can't be stopped (only once the cache is garbage collected), purge here instead
+	c := cache.New(ttl, 0)
+	if purgeInterval > 0 {
+		go purgeExpired(c, purgeInterval, done)
+	}
+	return c
+}
+
+func purgeExpired(c *cache.Cache, interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			c.DeleteExpired()
+		case <-done:
+			return
+		}
+	}
+}
+
+type lruEntry struct {
+	key       string
+	val       interface{}
+	expiresAt time.Time
+}
+
+// lruCache keeps at most maxItems entries, evicting the least recently used one on overflow;
+// expired entries are dropped on access (or evicted like any other)
+type lruCache struct {
+	sync.Mutex
+	name     string // cache size gauge label
+	maxItems int
+	order    *list.List // front = most recently used
+	items    map[string]*list.Element
+}
+
+func newLruCache(name string, maxItems int) *lruCache {
+	return &lruCache{
+		name:     name,
+		maxItems: maxItems,
+		order:    list.New(),
+		items:    make(map[string]*list.Element, maxItems),
+	}
+}
+
+func (c *lruCache) Get(key string) (interface{}, bool) {
+	c.Lock()
+	defer c.Unlock()
+
+	elem, found := c.items[key]
+	if !found {
+		return nil, false
+	}
+	entry := elem.Value.(*lruEntry)
+	if time.Now().After(entry.expiresAt) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.order.MoveToFront(elem)
+	return entry.val, true
+}
+
+func (c *lruCache) Set(key string, val interface{}, ttl time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+
+	expiresAt := time.Now().Add(ttl)
+	if elem, found := c.items[key]; found {
+		entry := elem.Value.(*lruEntry)
+		entry.val, entry.expiresAt = val, expiresAt
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.items[key] = c.order.PushFront(&lruEntry{key: key, val: val, expiresAt: expiresAt})
+	if c.order.Len() > c.maxItems {
+		c.remove(c.order.Back())
+	}
+	mt.SetGaugeVec(mt.CacheItems, c.name, float64(len(c.items)))
+}
+
+func (c *lruCache) Delete(key string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if elem, found := c.items[key]; found {
+		c.remove(elem)
+	}
+}
+
+func (c *lruCache) ItemCount() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.items)
+}
+
+// Items returns the unexpired entries (go-cache compatible)
+func (c *lruCache) Items() map[string]cache.Item {
+	c.Lock()
+	defer c.Unlock()
+
+	now := time.Now()
+	items := make(map[string]cache.Item, len(c.items))
+	for key, elem := range c.items {
+		entry := elem.Value.(*lruEntry)
+		if now.After(entry.expiresAt) {
+			continue
+		}
+		items[key] = cache.Item{Object: entry.val, Expiration: entry.expiresAt.UnixNano()}
+	}
+	return items
+}
+
+func (c *lruCache) remove(elem *list.Element) {
+	c.order.Remove(elem)
+	delete(c.items, elem.Value.(*lruEntry).key)
+	mt.SetGaugeVec(mt.CacheItems, c.name, float64(len(c.items)))
+}
@@ -0,0 +1,118 @@
+package validate
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"strings"
+)
+
+var defaultPorts = map[string]string{
+	"http":  "80",
+	"https": "443",
+	"ftp":   "21",
+}
+
+// NormalizeURL returns the canonical form of the url: lowercased scheme and host (punycode for idn,
+// no trailing dot), no default port, dot-segments resolved and the given (tracking) query params removed.
+// The path is not unescaped or otherwise rewritten, so the normalized url fetches the same page
+func NormalizeURL(rawUrl string, stripParams []string) (string, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", errors.New("url has no host")
+	}
+
+	u.Scheme = strings.ToLower(u.Scheme)
+
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "" {
+		return "", errors.New("url has no host")
+	}
+	if ip := net.ParseIP(host); ip == nil {
+		host, err = NormalizeHostname(host)
+		if err != nil {
+			return "", err
+		}
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	if port := u.Port(); port != "" && port != defaultPorts[u.Scheme] {
+		host = host + ":" + port
+	}
+	u.Host = host
+
+	if escapedPath := removeDotSegments(u.EscapedPath()); escapedPath != u.EscapedPath() {
+		path, err := url.PathUnescape(escapedPath)
+		if err != nil {
+			return "", err
+		}
+		u.Path, u.RawPath = path, escapedPath
+	}
+
+	if len(stripParams) > 0 && u.RawQuery != "" {
+		u.RawQuery = stripQueryParams(u.RawQuery, stripParams)
+	}
+	return u.String(), nil
+}
+
+// removeDotSegments resolves "." and ".." path segments (rfc 3986, 5.2.4)
+func removeDotSegments(path string) string {
+	if !strings.Contains(path, ".") {
+		return path
+	}
+
+	segments := strings.Split(path, "/")
+	out := make([]string, 0, len(segments))
+	for i, seg := range segments {
+		last := i == len(segments)-1
+		switch seg {
+		case ".":
+		case "..":
+			// the leading empty segment (root) is never removed
+			if len(out) > 1 {
+				out = out[:len(out)-1]
+			}
+		default:
+			out = append(out, seg)
+			continue
+		}
+		// a trailing dot-segment leaves a directory path
+		if last {
+			out = append(out, "")
+		}
+	}
+	return strings.Join(out, "/")
+}
+
+// stripQueryParams removes the named params, keeping the order and encoding of the others
+func stripQueryParams(rawQuery string, names []string) string {
+	strip := make(map[string]bool, len(names))
+	for _, name := range names {
+		strip[name] = true
+	}
+
+	pairs := strings.Split(rawQuery, "&")
+	kept := pairs[:0]
+	for _, pair := range pairs {
+		name := pair
+		if idx := strings.Index(pair, "="); idx >= 0 {
+			name = pair[:idx]
+		}
+		if unescaped, err := url.QueryUnescape(name); err == nil {
+			name = unescaped
+		}
+		if !strip[name] {
+			kept = append(kept, pair)
+		}
+	}
+	return strings.Join(kept, "&")
+}
+
+// NormalizeURL normalizes the url, stripping the configured query params
+func (v *Validator) NormalizeURL(rawUrl string) (string, error) {
+	return NormalizeURL(rawUrl, v.StripQueryParams)
+}
@@ -0,0 +1,143 @@
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	lg "phish-api/internal/logging"
+)
+
+// CachePersistenceConfig saves the domain & whitelister caches on shutdown and reloads them
+// on startup (expired entries are dropped), so a restart doesn't re-check every domain
+type CachePersistenceConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Path    string `yaml:"path"` // cache file, e.g. /var/lib/phish-api/caches.json
+}
+
+const cacheSnapshotVersion = 1
+
+type cacheSnapshot struct {
+	Version     int                   `json:"version"`
+	SavedAt     time.Time             `json:"saved_at"`
+	Domain      []domainSnapshotEntry `json:"domain"`
+	Whitelister []wlSnapshotEntry     `json:"whitelister"`
+}
+
+type domainSnapshotEntry struct {
+	Key                string     `json:"key"`
+	RequiresProcessing bool       `json:"requires_processing"`
+	Reason             SkipReason `json:"reason,omitempty"`
+	ExpiresAt          time.Time  `json:"expires_at"`
+}
+
+type wlSnapshotEntry struct {
+	Key       string    `json:"key"`
+	White     bool      `json:"white"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// SaveCaches writes the cache entries to the persistence file (replaced atomically)
+func (v *Validator) SaveCaches() error {
+	if v.cachePath == "" {
+		return nil
+	}
+
+	snapshot := cacheSnapshot{Version: cacheSnapshotVersion, SavedAt: time.Now()}
+	v.Lock()
+	domainItems := v.DomainCache.Items()
+	v.Unlock()
+	for key, item := range domainItems {
+		verdict, ok := item.Object.(domainVerdict)
+		// entries without expiration are not persisted (always set with a ttl)
+		if !ok || item.Expiration <= 0 {
+			continue
+		}
+		snapshot.Domain = append(snapshot.Domain, domainSnapshotEntry{
+			Key:                key,
+			RequiresProcessing: verdict.requiresProcessing,
+			Reason:             verdict.reason,
+			ExpiresAt:          time.Unix(0, item.Expiration),
+		})
+	}
+	for key, item := range v.Whitelister.memcache.Items() {
+		isWhite, ok := item.Object.(bool)
+		if !ok || item.Expiration <= 0 {
+			continue
+		}
+		snapshot.Whitelister = append(snapshot.Whitelister, wlSnapshotEntry{
+			Key: key, White: isWhite, ExpiresAt: time.Unix(0, item.Expiration),
+		})
+	}
+
+	bytes, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to marshal the caches: %v", err)
+	}
+	tmpPath := v.cachePath + ".tmp"
+	if err := os.MkdirAll(filepath.Dir(v.cachePath), 0o755); err != nil {
+		return fmt.Errorf("failed to save the caches: %v", err)
+	}
+	if err := os.WriteFile(tmpPath, bytes, 0o600); err != nil {
+		return fmt.Errorf("failed to save the caches: %v", err)
+	}
+	if err := os.Rename(tmpPath, v.cachePath); err != nil {
+		return fmt.Errorf("failed to save the caches: %v", err)
+	}
+
+	lg.Info("caches saved", lg.Fields{
+		"path": v.cachePath, "domain": len(snapshot.Domain), "whitelister": len(snapshot.Whitelister),
+	})
+	return nil
+}
+
+// LoadCaches restores the unexpired entries of the persistence file, a missing file is not an error
+func (v *Validator) LoadCaches() error {
+	if v.cachePath == "" {
+		return nil
+	}
+
+	bytes, err := os.ReadFile(v.cachePath)
+	if os.IsNotExist(err) {
+		lg.Info("no saved caches found", lg.Fields{"path": v.cachePath})
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to read the saved caches: %v", err)
+	}
+
+	var snapshot cacheSnapshot
+	if err := json.Unmarshal(bytes, &snapshot); err != nil {
+		return fmt.Errorf("saved caches are corrupt (%v): %v", v.cachePath, err)
+	}
+	if snapshot.Version != cacheSnapshotVersion {
+		return fmt.Errorf("saved caches version is not supported: %v", snapshot.Version)
+	}
+
+	var domains, whitelisted int
+	for _, entry := range snapshot.Domain {
+		ttl := time.Until(entry.ExpiresAt)
+		if entry.Key == "" || ttl <= 0 {
+			continue
+		}
+		v.Lock()
+		v.DomainCache.Set(entry.Key, domainVerdict{requiresProcessing: entry.RequiresProcessing, reason: entry.Reason}, ttl)
+		v.Unlock()
+		domains++
+	}
+	for _, entry := range snapshot.Whitelister {
+		ttl := time.Until(entry.ExpiresAt)
+		if entry.Key == "" || ttl <= 0 {
+			continue
+		}
+		v.Whitelister.memcache.Set(entry.Key, entry.White, ttl)
+		whitelisted++
+	}
+
+	lg.Info("caches loaded", lg.Fields{
+		"path": v.cachePath, "saved_at": snapshot.SavedAt, "domain": domains, "whitelister": whitelisted,
+	})
+	return nil
+}
@@ -0,0 +1,121 @@
+package validate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"syscall"
+	"time"
+)
+
+type ProbeConfig struct {
+	Enabled         bool          `yaml:"enabled"`
+	Timeout         time.Duration `yaml:"timeout"`
+	FollowRedirects bool          `yaml:"follow_redirects"`
+	MaxRedirects    int           `yaml:"max_redirects"`
+}
+
+const (
+	defaultProbeTimeout      = 10 * time.Second
+	defaultProbeMaxRedirects = 10
+)
+
+// errDeniedAddress is returned for hosts that are (or resolve to) local ip addresses
+var errDeniedAddress = errors.New("denied address")
+
+// Prober checks whether a url is reachable and (optionally) where its redirect chain lands
+type Prober struct {
+	client    *http.Client
+	ipChecker *IpChecker
+}
+
+func NewProber(cfg ProbeConfig, ipChecker *IpChecker) *Prober {
+	timeout := cfg.Timeout
+	if timeout <= 0 {
+		timeout = defaultProbeTimeout
+	}
+
+	maxRedirects := cfg.MaxRedirects
+	if maxRedirects <= 0 {
+		maxRedirects = defaultProbeMaxRedirects
+	}
+
+	prober := &Prober{ipChecker: ipChecker}
+
+	// the address is checked right before connecting (every hop, every a-record tried), so a host
+	// re-resolving to a local ip after the checks below (dns rebinding) is still denied;
+	// no proxy, the dialed address must be the probed host
+	dialer := &net.Dialer{Timeout: timeout, Resolver: ipChecker.Resolver, Control: prober.denyLocalAddress}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	prober.client = &http.Client{
+		Transport: transport,
+		Timeout:   timeout,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if !cfg.FollowRedirects {
+				return http.ErrUseLastResponse
+			}
+			if len(via) > maxRedirects {
+				return fmt.Errorf("stopped after %v redirects", maxRedirects)
+			}
+			// a redirect may point to an internal host, re-check every hop
+			return prober.checkHost(req.Context(), req.URL.Hostname())
+		},
+	}
+	return prober
+}
+
+// Probe requests the url and returns the final landing url (the url itself if redirects are not followed);
+// the request (redirects included) is bound by ctx and the probe timeout
+func (p *Prober) Probe(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+
+	if err := p.checkHost(req.Context(), req.URL.Hostname()); err != nil {
+		return "", err
+	}
+
+	resp, err := p.client.Do(req)
+	if err != nil {
+		log.Printf("probe fail: %v > %v", url, err)
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	landingURL := resp.Request.URL.String()
+	log.Printf("probe ok (status = %v): %v > %v", resp.StatusCode, url, landingURL)
+	return landingURL, nil
+}
+
+// checkHost denies hosts that are (or have any a-record resolving to) local ip addresses
+func (p *Prober) checkHost(ctx context.Context, host string) error {
+	ips, err := p.ipChecker.GetDomainIPs(ctx, host)
+	if err != nil {
+		return fmt.Errorf("can't resolve host %v: %v", host, err)
+	}
+
+	if localIP := p.ipChecker.FirstLocalIP(ips); localIP != "" {
+		return fmt.Errorf("%w: host %v resolves to %v", errDeniedAddress, host, localIP)
+	}
+	return nil
+}
+
+// denyLocalAddress is the dialer control, it rejects local ip addresses about to be connected
+func (p *Prober) denyLocalAddress(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errDeniedAddress, address)
+	}
+	ip := p.ipChecker.GetNetIP(host)
+	if ip == nil || p.ipChecker.IsLocalIP(ip) {
+		return fmt.Errorf("%w: %v", errDeniedAddress, host)
+	}
+	return nil
+}
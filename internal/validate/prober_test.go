@@ -0,0 +1,104 @@
+package validate
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestProberDenyLocalAddress(t *testing.T) {
+	prober := NewProber(ProbeConfig{}, NewIpChecker([]string{"100.64.0.0/10"}, time.Second))
+
+	tests := []struct {
+		address string
+		denied  bool
+	}{
+		{address: "93.184.216.34:443"},
+		{address: "[2606:2800:220:1:248:1893:25c8:1946]:443"},
+		{address: "127.0.0.1:80", denied: true},
+		{address: "10.0.0.1:80", denied: true},
+		{address: "192.168.1.1:8080", denied: true},
+		{address: "169.254.169.254:80", denied: true},
+		{address: "0.0.0.0:80", denied: true},
+		{address: "[::1]:80", denied: true},
+		{address: "[fd00::1]:80", denied: true},
+		{address: "100.64.1.1:80", denied: true}, // configured local net
+		{address: "not-an-address", denied: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.address, func(t *testing.T) {
+			err := prober.denyLocalAddress("tcp", tt.address, nil)
+			if denied := errors.Is(err, errDeniedAddress); denied != tt.denied {
+				t.Errorf("denied = %v (%v), want %v", denied, err, tt.denied)
+			}
+		})
+	}
+}
+
+func TestProberDeniesLocalHosts(t *testing.T) {
+	var requests int32
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+	}))
+	defer target.Close()
+	_, port, _ := net.SplitHostPort(target.Listener.Addr().String())
+
+	tests := []struct {
+		name   string
+		answer func(query int32) []string // a-records of the n-th a query (1 based)
+	}{
+		{name: "local a-record", answer: func(int32) []string { return []string{"127.0.0.1"} }},
+		{name: "any local a-record", answer: func(int32) []string { return []string{"93.184.216.34", "127.0.0.1"} }},
+		{
+			// the check lookup gets a public ip, the dial one the local ip (dns rebinding)
+			name: "rebinding",
+			answer: func(query int32) []string {
+				if query == 1 {
+					return []string{"93.184.216.34"}
+				}
+				return []string{"127.0.0.1"}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var queries int32
+			checker := NewIpChecker(nil, time.Second)
+			checker.Resolver = answeringResolver(dnsmessage.RCodeSuccess, func() []string {
+				return tt.answer(atomic.AddInt32(&queries, 1))
+			}, false)
+			prober := NewProber(ProbeConfig{Timeout: 2 * time.Second}, checker)
+
+			probeURL := (&url.URL{Scheme: "http", Host: net.JoinHostPort("phish.example", port), Path: "/"}).String()
+			_, err := prober.Probe(context.Background(), probeURL)
+			if !errors.Is(err, errDeniedAddress) {
+				t.Fatalf("error = %v, want a denied address", err)
+			}
+			if n := atomic.LoadInt32(&requests); n != 0 {
+				t.Errorf("the local server got %v requests", n)
+			}
+		})
+	}
+}
+
+func TestProberDeniesLocalRedirects(t *testing.T) {
+	prober := NewProber(ProbeConfig{FollowRedirects: true}, NewIpChecker(nil, time.Second))
+
+	// a redirect to a local host is denied before the request is sent (the hop check),
+	// and again when dialing
+	via := []*http.Request{httptest.NewRequest(http.MethodGet, "http://93.184.216.34/", nil)}
+	hop := httptest.NewRequest(http.MethodGet, "http://127.0.0.1:8080/admin", nil)
+	if err := prober.client.CheckRedirect(hop, via); !errors.Is(err, errDeniedAddress) {
+		t.Errorf("redirect check error = %v, want a denied address", err)
+	}
+}
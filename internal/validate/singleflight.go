@@ -0,0 +1,81 @@
+package validate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// flightCall is an in-flight (or completed) lookup shared by concurrent callers
+type flightCall struct {
+	done    chan struct{} // closed once the result is set
+	dups    int           // callers sharing the call of another one
+	isWhite bool
+	err     error
+}
+
+// flightGroup coalesces concurrent lookups of the same key into a single call,
+// while lookups of different keys run in parallel
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+// Do runs fn once per key at a time, duplicate callers share its result. The call runs on a context
+// detached from the callers (their values are kept) bounded by timeout, so the first caller going away
+// doesn't fail the others; every caller waits for the result or its own ctx, whichever is done first
+func (g *flightGroup) Do(ctx context.Context, key string, timeout time.Duration, fn func(context.Context) (bool, error)) (bool, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	call, found := g.calls[key]
+	if !found {
+		call = &flightCall{done: make(chan struct{})}
+		g.calls[key] = call
+		go g.run(detach(ctx), key, timeout, call, fn)
+	} else {
+		call.dups++
+	}
+	g.mu.Unlock()
+
+	select {
+	case <-call.done:
+		return call.isWhite, call.err
+	case <-ctx.Done():
+		return false, ctx.Err()
+	}
+}
+
+func (g *flightGroup) run(ctx context.Context, key string, timeout time.Duration, call *flightCall, fn func(context.Context) (bool, error)) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	// a panicking lookup fails its callers instead of leaving them waiting (and the key blocked)
+	defer func() {
+		if r := recover(); r != nil {
+			call.isWhite, call.err = false, fmt.Errorf("lookup %v panicked: %v", key, r)
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		close(call.done)
+	}()
+
+	call.isWhite, call.err = fn(ctx)
+}
+
+// detachedContext keeps the parent values (e.g. the trace span), but not its deadline and cancellation
+type detachedContext struct {
+	parent context.Context
+}
+
+func detach(parent context.Context) context.Context {
+	return detachedContext{parent: parent}
+}
+
+func (detachedContext) Deadline() (time.Time, bool)         { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}               { return nil }
+func (detachedContext) Err() error                          { return nil }
+func (c detachedContext) Value(key interface{}) interface{} { return c.parent.Value(key) }
@@ -0,0 +1,156 @@
+package validate
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFlightGroupLeaderCancelDoesNotFailWaiters(t *testing.T) {
+	var g flightGroup
+	var calls int32
+	release := make(chan struct{})
+	fn := func(ctx context.Context) (bool, error) {
+		atomic.AddInt32(&calls, 1)
+		select {
+		case <-release:
+			return true, nil
+		case <-ctx.Done():
+			return false, ctx.Err()
+		}
+	}
+
+	leaderCtx, cancelLeader := context.WithCancel(context.Background())
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := g.Do(leaderCtx, "key", time.Second, fn)
+		leaderErr <- err
+	}()
+	waitForCall(t, &g, "key", 0)
+
+	waiter := make(chan error, 1)
+	go func() {
+		isWhite, err := g.Do(context.Background(), "key", time.Second, fn)
+		if err == nil && !isWhite {
+			err = errors.New("want the shared white result")
+		}
+		waiter <- err
+	}()
+	waitForCall(t, &g, "key", 1)
+
+	cancelLeader()
+	if err := <-leaderErr; !errors.Is(err, context.Canceled) {
+		t.Fatalf("leader error = %v, want context.Canceled", err)
+	}
+	close(release)
+	if err := <-waiter; err != nil {
+		t.Fatalf("waiter error = %v", err)
+	}
+	if n := atomic.LoadInt32(&calls); n != 1 {
+		t.Errorf("calls = %v, want 1", n)
+	}
+}
+
+func TestFlightGroupWaiterHonorsItsContext(t *testing.T) {
+	tests := []struct {
+		name string
+		ctx  func() (context.Context, context.CancelFunc)
+		err  error
+	}{
+		{name: "cancelled", ctx: func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			return ctx, func() {}
+		}, err: context.Canceled},
+		{name: "deadline", ctx: func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 20*time.Millisecond)
+		}, err: context.DeadlineExceeded},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var g flightGroup
+			release := make(chan struct{})
+			defer close(release)
+			fn := func(ctx context.Context) (bool, error) {
+				<-release
+				return true, nil
+			}
+
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			start := time.Now()
+			if _, err := g.Do(ctx, "key", time.Minute, fn); !errors.Is(err, tt.err) {
+				t.Fatalf("error = %v, want %v", err, tt.err)
+			}
+			if elapsed := time.Since(start); elapsed > time.Second {
+				t.Errorf("returned after %v, the call was still running", elapsed)
+			}
+		})
+	}
+}
+
+func TestFlightGroupCallTimeout(t *testing.T) {
+	var g flightGroup
+	_, err := g.Do(context.Background(), "key", 20*time.Millisecond, func(ctx context.Context) (bool, error) {
+		<-ctx.Done()
+		return false, ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("error = %v, want context.DeadlineExceeded", err)
+	}
+}
+
+func TestFlightGroupPanic(t *testing.T) {
+	var g flightGroup
+	for i := 0; i < 2; i++ {
+		_, err := g.Do(context.Background(), "key", time.Second, func(context.Context) (bool, error) {
+			panic("boom")
+		})
+		if err == nil || !strings.Contains(err.Error(), "boom") {
+			t.Fatalf("call %v error = %v, want the panic", i, err)
+		}
+	}
+
+	// the key isn't left blocked
+	isWhite, err := g.Do(context.Background(), "key", time.Second, func(context.Context) (bool, error) {
+		return true, nil
+	})
+	if err != nil || !isWhite {
+		t.Fatalf("after a panic = %v, %v, want true", isWhite, err)
+	}
+}
+
+func TestDetachedContextKeepsValues(t *testing.T) {
+	type key struct{}
+	parent, cancel := context.WithCancel(context.WithValue(context.Background(), key{}, "val"))
+	cancel()
+
+	ctx := detach(parent)
+	if ctx.Err() != nil || ctx.Done() != nil {
+		t.Error("the parent cancellation leaked into the detached context")
+	}
+	if ctx.Value(key{}) != "val" {
+		t.Error("the parent value is lost")
+	}
+}
+
+// waitForCall waits until a call of the key is in flight with the given number of duplicate callers
+func waitForCall(t *testing.T, g *flightGroup, key string, dups int) {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		g.mu.Lock()
+		call, found := g.calls[key]
+		joined := found && call.dups == dups
+		g.mu.Unlock()
+		if joined {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("no call of %v in flight with %v duplicate callers", key, dups)
+}
@@ -0,0 +1,67 @@
+package validate
+
+import (
+	"context"
+
+	mt "phish-api/internal/metrics"
+)
+
+// otherSources labels the sources not listed in the limits, they share the default semaphore
+const otherSources = mt.OverflowLabel
+
+// SourceThrottler limits concurrent whitelister lookups per task source,
+// so a single noisy source can't use up the whole whitelister budget.
+// Only the listed sources get a semaphore of their own, every other source shares the default one,
+// so unknown (client supplied) source names can't grow the throttler or the metric labels
+type SourceThrottler struct {
+	semaphores map[string]chan struct{} // nil value for a listed source without a limit
+	defaultSem chan struct{}            // nil if the default is unlimited
+}
+
+func NewSourceThrottler(defaultLimit int, limits map[string]int) *SourceThrottler {
+	t := &SourceThrottler{
+		semaphores: make(map[string]chan struct{}, len(limits)),
+	}
+	for source, limit := range limits {
+		t.semaphores[source] = newSemaphore(limit)
+	}
+	t.defaultSem = newSemaphore(defaultLimit)
+
+	return t
+}
+
+// Acquire blocks until the source has a free slot (or ctx is done) and returns a func releasing it
+func (t *SourceThrottler) Acquire(ctx context.Context, source string) (func(), error) {
+	sem, label := t.getSemaphore(source)
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	mt.IncGaugeVec(mt.WhitelisterInFlight, label)
+
+	return func() {
+		mt.DecGaugeVec(mt.WhitelisterInFlight, label)
+		if sem != nil {
+			<-sem
+		}
+	}, nil
+}
+
+// getSemaphore returns the semaphore of the source (nil if unlimited) and its metric label
+func (t *SourceThrottler) getSemaphore(source string) (chan struct{}, string) {
+	sem, found := t.semaphores[source]
+	if found {
+		return sem, source
+	}
+	return t.defaultSem, otherSources
+}
+
+func newSemaphore(limit int) chan struct{} {
+	if limit <= 0 {
+		return nil
+	}
+	return make(chan struct{}, limit)
+}
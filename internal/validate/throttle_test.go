@@ -0,0 +1,70 @@
+package validate
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSourceThrottler(t *testing.T) {
+	tests := []struct {
+		name         string
+		defaultLimit int
+		limits       map[string]int
+		held         []string // sources acquired (and held) first
+		source       string
+		blocked      bool
+		label        string
+	}{
+		{name: "listed source within its limit", limits: map[string]int{"src_1": 2}, held: []string{"src_1"}, source: "src_1", label: "src_1"},
+		{name: "listed source at its limit", limits: map[string]int{"src_1": 1}, held: []string{"src_1"}, source: "src_1", blocked: true, label: "src_1"},
+		{name: "listed source without a limit", defaultLimit: 1, limits: map[string]int{"src_1": 0}, held: []string{"src_1", "src_1"}, source: "src_1", label: "src_1"},
+		{name: "listed source ignores the default", defaultLimit: 1, limits: map[string]int{"src_1": 2}, held: []string{"a"}, source: "src_1", label: "src_1"},
+		{name: "unlisted sources share the default", defaultLimit: 2, held: []string{"a", "b"}, source: "c", blocked: true, label: otherSources},
+		{name: "unlisted source within the default", defaultLimit: 2, held: []string{"a"}, source: "b", label: otherSources},
+		{name: "listed sources don't use the default", defaultLimit: 1, limits: map[string]int{"src_1": 1}, held: []string{"src_1"}, source: "a", label: otherSources},
+		{name: "unlimited default", held: []string{"a", "b", "c"}, source: "d", label: otherSources},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			throttler := NewSourceThrottler(tt.defaultLimit, tt.limits)
+			for _, source := range tt.held {
+				release, err := throttler.Acquire(context.Background(), source)
+				if err != nil {
+					t.Fatalf("acquire %v: %v", source, err)
+				}
+				defer release()
+			}
+
+			if _, label := throttler.getSemaphore(tt.source); label != tt.label {
+				t.Errorf("label = %v, want %v", label, tt.label)
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+			defer cancel()
+			release, err := throttler.Acquire(ctx, tt.source)
+			if blocked := errors.Is(err, context.DeadlineExceeded); blocked != tt.blocked {
+				t.Fatalf("blocked = %v (%v), want %v", blocked, err, tt.blocked)
+			}
+			if err == nil {
+				release()
+			}
+		})
+	}
+}
+
+func TestSourceThrottlerUnlistedSourcesDontGrow(t *testing.T) {
+	throttler := NewSourceThrottler(1, map[string]int{"src_1": 1})
+	for _, source := range []string{"a", "b", "c"} {
+		release, err := throttler.Acquire(context.Background(), source)
+		if err != nil {
+			t.Fatal(err)
+		}
+		release()
+	}
+	if n := len(throttler.semaphores); n != 1 {
+		t.Errorf("semaphores = %v, want only the listed one", n)
+	}
+}
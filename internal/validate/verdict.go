@@ -0,0 +1,153 @@
+package validate
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+)
+
+const (
+	DecisionQueue = "queue"
+	DecisionSkip  = "skip"
+
+	SignalBlacklisted     = "blacklisted"
+	SignalWhitelisted     = "whitelisted"
+	SignalLocalIP         = "local_ip"
+	SignalNoARecord       = "no_a_record"
+	SignalNeedsProcessing = "needs_processing"
+	SignalReachable       = "reachable"
+	SignalUnreachable     = "unreachable"
+)
+
+var defaultSignalWeights = map[string]float64{
+	SignalBlacklisted:     -1,
+	SignalWhitelisted:     -1,
+	SignalLocalIP:         -1,
+	SignalNoARecord:       -0.5,
+	SignalNeedsProcessing: 1,
+	SignalReachable:       0.2,
+	SignalUnreachable:     -0.3,
+}
+
+type VerdictConfig struct {
+	Enabled   bool               `yaml:"enabled"`
+	Threshold float64            `yaml:"threshold"` // urls scoring at least this much are queued
+	Weights   map[string]float64 `yaml:"weights"`   // overrides default signal weights
+}
+
+// hardSkipReasons are never queued, whatever the other signals score
+var hardSkipReasons = map[SkipReason]string{
+	ReasonLocalIP:     SignalLocalIP,
+	ReasonBlacklisted: SignalBlacklisted,
+}
+
+// Errors lists the problems of the config: a NaN / infinite threshold or weight,
+// or no positive weight (no url could ever be queued)
+func (cfg VerdictConfig) Errors() []string {
+	var errs []string
+	if math.IsNaN(cfg.Threshold) || math.IsInf(cfg.Threshold, 0) {
+		errs = append(errs, fmt.Sprintf("threshold is invalid: %v", cfg.Threshold))
+	}
+
+	positive := false
+	for name, weight := range cfg.weights() {
+		if math.IsNaN(weight) || math.IsInf(weight, 0) {
+			errs = append(errs, fmt.Sprintf("weight of '%v' is invalid: %v", name, weight))
+			continue
+		}
+		if weight > 0 {
+			positive = true
+		}
+	}
+	if !positive {
+		errs = append(errs, "no signal has a positive weight")
+	}
+	return errs
+}
+
+// weights returns the default signal weights with the configured overrides
+func (cfg VerdictConfig) weights() map[string]float64 {
+	weights := make(map[string]float64, len(defaultSignalWeights))
+	for name, weight := range defaultSignalWeights {
+		weights[name] = weight
+	}
+	for name, weight := range cfg.Weights {
+		weights[name] = weight
+	}
+	return weights
+}
+
+type Signal struct {
+	Name   string  `json:"name"`
+	Weight float64 `json:"weight"`
+}
+
+// Verdict is a graded processing decision aggregated from the available signals
+type Verdict struct {
+	Score    float64  `json:"score"`
+	Signals  []Signal `json:"signals"`
+	Decision string   `json:"decision"`
+}
+
+// ProbeResult is the reachability signal input, nil when the url was not probed
+type ProbeResult struct {
+	LandingURL string
+	Err        error
+}
+
+type VerdictScorer struct {
+	threshold float64
+	weights   map[string]float64
+}
+
+func NewVerdictScorer(cfg VerdictConfig) (*VerdictScorer, error) {
+	if errs := cfg.Errors(); len(errs) > 0 {
+		return nil, errors.New(strings.Join(errs, ", "))
+	}
+	return &VerdictScorer{threshold: cfg.Threshold, weights: cfg.weights()}, nil
+}
+
+// Score aggregates the processing check outcome and the probe result into a verdict.
+// Local ips and blacklisted urls are skipped without scoring the other signals
+func (s *VerdictScorer) Score(requiresProcessing bool, reason SkipReason, probe *ProbeResult) *Verdict {
+	if name, found := hardSkipReasons[reason]; found {
+		weight := s.weights[name]
+		log.Printf("verdict: %v (hard skip: %v)", DecisionSkip, name)
+		return &Verdict{Score: weight, Signals: []Signal{{Name: name, Weight: weight}}, Decision: DecisionSkip}
+	}
+
+	var names []string
+	switch reason {
+	case ReasonWhitelistedDomain, ReasonWhitelistedIP:
+		names = append(names, SignalWhitelisted)
+	case ReasonNoARecord:
+		names = append(names, SignalNoARecord)
+	}
+
+	if requiresProcessing {
+		names = append(names, SignalNeedsProcessing)
+	}
+
+	if probe != nil {
+		if probe.Err != nil {
+			names = append(names, SignalUnreachable)
+		} else {
+			names = append(names, SignalReachable)
+		}
+	}
+
+	verdict := &Verdict{Decision: DecisionSkip}
+	for _, name := range names {
+		weight := s.weights[name]
+		verdict.Score += weight
+		verdict.Signals = append(verdict.Signals, Signal{Name: name, Weight: weight})
+	}
+
+	if verdict.Score >= s.threshold {
+		verdict.Decision = DecisionQueue
+	}
+	log.Printf("verdict: %v (score = %v, signals = %v)", verdict.Decision, verdict.Score, names)
+	return verdict
+}
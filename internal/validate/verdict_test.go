@@ -0,0 +1,85 @@
+package validate
+
+import (
+	"errors"
+	"math"
+	"testing"
+)
+
+func TestVerdictScore(t *testing.T) {
+	// a reachable url would outweigh any skip signal
+	scorer, err := NewVerdictScorer(VerdictConfig{Threshold: 0.5, Weights: map[string]float64{SignalReachable: 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	reachable := &ProbeResult{LandingURL: "http://example.com/"}
+
+	tests := []struct {
+		name               string
+		requiresProcessing bool
+		reason             SkipReason
+		probe              *ProbeResult
+		decision           string
+		signals            []string
+	}{
+		{name: "needs processing", requiresProcessing: true, decision: DecisionQueue, signals: []string{SignalNeedsProcessing}},
+		{name: "reachable", requiresProcessing: true, probe: reachable, decision: DecisionQueue, signals: []string{SignalNeedsProcessing, SignalReachable}},
+		{name: "unreachable", requiresProcessing: true, probe: &ProbeResult{Err: errors.New("timeout")}, decision: DecisionQueue, signals: []string{SignalNeedsProcessing, SignalUnreachable}},
+		{name: "whitelisted but reachable", reason: ReasonWhitelistedDomain, probe: reachable, decision: DecisionQueue, signals: []string{SignalWhitelisted, SignalReachable}},
+		{name: "no a-record", reason: ReasonNoARecord, decision: DecisionSkip, signals: []string{SignalNoARecord}},
+		{name: "local ip is a hard skip", reason: ReasonLocalIP, probe: reachable, decision: DecisionSkip, signals: []string{SignalLocalIP}},
+		{name: "blacklisted is a hard skip", reason: ReasonBlacklisted, probe: reachable, decision: DecisionSkip, signals: []string{SignalBlacklisted}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			verdict := scorer.Score(tt.requiresProcessing, tt.reason, tt.probe)
+			if verdict.Decision != tt.decision {
+				t.Errorf("decision = %v (score = %v), want %v", verdict.Decision, verdict.Score, tt.decision)
+			}
+			var signals []string
+			for _, signal := range verdict.Signals {
+				signals = append(signals, signal.Name)
+			}
+			if len(signals) != len(tt.signals) {
+				t.Fatalf("signals = %v, want %v", signals, tt.signals)
+			}
+			for i := range signals {
+				if signals[i] != tt.signals[i] {
+					t.Errorf("signals = %v, want %v", signals, tt.signals)
+				}
+			}
+		})
+	}
+}
+
+func TestNewVerdictScorerValidation(t *testing.T) {
+	allNonPositive := map[string]float64{}
+	for name := range defaultSignalWeights {
+		allNonPositive[name] = 0
+	}
+
+	tests := []struct {
+		name    string
+		cfg     VerdictConfig
+		wantErr bool
+	}{
+		{name: "defaults", cfg: VerdictConfig{Threshold: 0.5}},
+		{name: "nan threshold", cfg: VerdictConfig{Threshold: math.NaN()}, wantErr: true},
+		{name: "infinite threshold", cfg: VerdictConfig{Threshold: math.Inf(-1)}, wantErr: true},
+		{name: "nan weight", cfg: VerdictConfig{Weights: map[string]float64{SignalReachable: math.NaN()}}, wantErr: true},
+		{name: "no positive weight", cfg: VerdictConfig{Weights: allNonPositive}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scorer, err := NewVerdictScorer(tt.cfg)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("NewVerdictScorer() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && scorer == nil {
+				t.Fatal("NewVerdictScorer() = nil")
+			}
+		})
+	}
+}
@@ -1,25 +1,98 @@
 package validate
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"math/rand"
 	"net"
 	"net/http"
+	"net/url"
+	"strings"
 	"sync"
 	"time"
 
-	cache "github.com/patrickmn/go-cache"
+	lg "phish-api/internal/logging"
+	mt "phish-api/internal/metrics"
+	"phish-api/internal/tracing"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 )
 
 type WhitelisterApi struct {
-	CheckIpApiUrl     string        `yaml:"check_ip_api_url"`
-	CheckDomainApiUrl string        `yaml:"check_domain_api_url"`
-	MaxTries          int           `yaml:"max_tries"`
-	SleepTime         time.Duration `yaml:"sleep_time"`
+	CheckIpApiUrl     string `yaml:"check_ip_api_url"`
+	CheckDomainApiUrl string `yaml:"check_domain_api_url"`
+	// optional, checks many domains in one request: POST {"domains": [...]},
+	// response {"status", "results": [{"domain", "result"}, ...]}
+	BulkCheckDomainApiUrl string        `yaml:"bulk_check_domain_api_url"`
+	MaxTries              int           `yaml:"max_tries"`
+	SleepTime             time.Duration `yaml:"sleep_time"`
+	// retries sleep a random time up to sleep_time * 2^(retry-1), capped at max_sleep_time (default 30s)
+	MaxSleepTime time.Duration `yaml:"max_sleep_time"`
+
+	// per request timeout (connect, headers and body)
+	Timeout time.Duration `yaml:"timeout"`
+
+	// connection reuse tuning (defaults are used when unset)
+	MaxIdleConnsPerHost int           `yaml:"max_idle_conns_per_host"`
+	IdleConnTimeout     time.Duration `yaml:"idle_conn_timeout"`
+
+	// concurrent lookups of each listed task source, the unlisted sources share the default limit (0 = unlimited)
+	DefaultSourceConcurrency int            `yaml:"default_source_concurrency"`
+	SourceConcurrency        map[string]int `yaml:"source_concurrency"`
+
+	// cache ttl of white (positive) and non-white (negative) results
+	PositiveTTL time.Duration `yaml:"positive_ttl"`
+	NegativeTTL time.Duration `yaml:"negative_ttl"`
+	// bounds the cache (lru eviction), 0 = unbounded
+	CacheMaxItems int `yaml:"cache_max_items"`
+
+	// dot separated json path of the bool result (e.g. "whitelisted" or "data.result") for providers
+	// with another response schema, default: {"status", "domain"/"ip", "result"}
+	ResultField string `yaml:"result_field"`
+
+	// what a check results in once all tries failed (api outage): fail_open (default) - not whitelisted,
+	// the url is processed; fail_closed - whitelisted, the url is skipped; error - the check fails
+	// (add url responds 503, the client may retry later)
+	OnFailure string `yaml:"on_failure"`
+
+	Breaker BreakerConfig `yaml:"breaker"`
+
+	// sent with every api request (default: the go http client user agent)
+	UserAgent string `yaml:"user_agent"`
+	// extra request headers, values are redacted in logs
+	Headers map[string]string `yaml:"headers"`
+	// api key sent in the api_key_header (default: X-Api-Key), redacted in logs
+	ApiKey       string `yaml:"api_key"`
+	ApiKeyHeader string `yaml:"api_key_header"`
 }
 
+const defaultApiKeyHeader = "X-Api-Key"
+
+const (
+	FailOpen   = "fail_open"
+	FailClosed = "fail_closed"
+	FailError  = "error"
+)
+
+func validFailurePolicy(policy string) bool {
+	switch policy {
+	case "", FailOpen, FailClosed, FailError:
+		return true
+	}
+	return false
+}
+
+const (
+	defaultCacheTTL            = time.Hour
+	defaultMaxSleepTime        = 30 * time.Second
+	defaultTimeout             = 10 * time.Second
+	defaultMaxIdleConnsPerHost = 32
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
 type IpWhiteListResponse struct {
 	Status string `json:"status"`
 	IP     string `json:"ip"`
@@ -33,162 +106,533 @@ type DomainWhiteListResponse struct {
 }
 
 type Whitelister struct {
-	sync.Mutex
-	checkDomainApiUrl string
-	checkIpApiUrl     string
-	maxTries          int
-	sleepTime         time.Duration
-	memcache          *cache.Cache
+	checkDomainApiUrl     string
+	bulkCheckDomainApiUrl string
+	checkIpApiUrl         string
+	maxTries              int
+	sleepTime             time.Duration
+	maxSleepTime          time.Duration
+	memcache              Cache
+	positiveTTL           time.Duration
+	negativeTTL           time.Duration
+	client                *http.Client
+	timeout               time.Duration
+	decodeDomain          resultDecoder
+	decodeIp              resultDecoder
+	onFailure             string
+	breaker               *breaker // nil when disabled
+	headers               http.Header
+	secrets               []string // header values redacted in logged errors
+	cacheHits             hitCounter
+	// coalesces duplicate in-flight lookups, memcache itself is goroutine safe
+	inflight flightGroup
+	closing  chan struct{}
+	closed   sync.Once
 }
 
 func NewWhitelister(cfg WhitelisterApi) *Whitelister {
+	return NewWhitelisterWithClient(cfg, nil)
+}
+
+// NewWhitelisterWithClient uses the given http client for the api calls (e.g. a stub round tripper
+// in tests), a nil client is replaced with a keep-alive client built from the config
+func NewWhitelisterWithClient(cfg WhitelisterApi, client *http.Client) *Whitelister {
+	closing := make(chan struct{})
 	wl := &Whitelister{
-		checkDomainApiUrl: cfg.CheckDomainApiUrl,
-		checkIpApiUrl:     cfg.CheckIpApiUrl,
-		maxTries:          cfg.MaxTries,
-		sleepTime:         cfg.SleepTime,
-		memcache:          cache.New(time.Hour, time.Minute),
+		checkDomainApiUrl:     cfg.CheckDomainApiUrl,
+		bulkCheckDomainApiUrl: cfg.BulkCheckDomainApiUrl,
+		checkIpApiUrl:         cfg.CheckIpApiUrl,
+		maxTries:              cfg.MaxTries,
+		sleepTime:             cfg.SleepTime,
+		maxSleepTime:          cfg.MaxSleepTime,
+		memcache:              newCache("whitelister", cfg.CacheMaxItems, defaultCacheTTL, time.Minute, closing),
+		positiveTTL:           cfg.PositiveTTL,
+		negativeTTL:           cfg.NegativeTTL,
+		client:                client,
+		timeout:               cfg.Timeout,
+		decodeDomain:          decodeDomainResponse,
+		decodeIp:              decodeIpResponse,
+		onFailure:             cfg.OnFailure,
+		breaker:               newBreaker(cfg.Breaker),
+		closing:               closing,
+	}
+	if wl.onFailure == "" {
+		wl.onFailure = FailOpen
+	}
+	wl.headers, wl.secrets = requestHeaders(cfg)
+	if cfg.ResultField != "" {
+		wl.decodeDomain = fieldDecoder(cfg.ResultField)
+		wl.decodeIp = wl.decodeDomain
+	}
+	if wl.maxSleepTime <= 0 {
+		wl.maxSleepTime = defaultMaxSleepTime
+	}
+	if wl.timeout <= 0 {
+		wl.timeout = defaultTimeout
+	}
+	if wl.client == nil {
+		wl.client = newWhitelisterClient(cfg)
+		wl.client.Timeout = wl.timeout
+	}
+	if wl.positiveTTL <= 0 {
+		wl.positiveTTL = defaultCacheTTL
+	}
+	if wl.negativeTTL <= 0 {
+		wl.negativeTTL = defaultCacheTTL
 	}
 	return wl
 }
 
-func (checker *Whitelister) DomainIsWhite(domain string) (bool, error) {
-	checker.Lock()
-	defer checker.Unlock()
+// Close stops the cache purging and closes the idle api connections
+func (checker *Whitelister) Close() {
+	checker.closed.Do(func() {
+		close(checker.closing)
+		checker.client.CloseIdleConnections()
+	})
+}
+
+func (checker *Whitelister) getCache(key string) (interface{}, bool) {
+	itf, cached := checker.memcache.Get(key)
+	checker.cacheHits.record(cached)
+	if cached {
+		mt.IncVec(mt.WhitelisterCache, "hit")
+	} else {
+		mt.IncVec(mt.WhitelisterCache, "miss")
+	}
+	return itf, cached
+}
 
-	var msg string
-	var isWhite bool
-	fnc := "wl check domain"
-	maxTries := checker.maxTries
-	url := fmt.Sprintf(checker.checkDomainApiUrl, domain)
+// setCache caches the result, non-white results may expire sooner so newly whitelisted domains are picked up
+func (checker *Whitelister) setCache(key string, isWhite bool) {
+	ttl := checker.negativeTTL
+	if isWhite {
+		ttl = checker.positiveTTL
+	}
+	checker.memcache.Set(key, isWhite, ttl)
+}
+
+// newWhitelisterClient keeps connections to the whitelister api alive, so repeated checks
+// don't re-dial (and re-resolve) the api host on every call
+func newWhitelisterClient(cfg WhitelisterApi) *http.Client {
+	maxIdleConnsPerHost := cfg.MaxIdleConnsPerHost
+	if maxIdleConnsPerHost <= 0 {
+		maxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+
+	idleConnTimeout := cfg.IdleConnTimeout
+	if idleConnTimeout <= 0 {
+		idleConnTimeout = defaultIdleConnTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DisableKeepAlives = false
+	transport.MaxIdleConns = maxIdleConnsPerHost
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.IdleConnTimeout = idleConnTimeout
+
+	return &http.Client{Transport: transport}
+}
+
+// requestHeaders builds the api request headers, secrets are the values to keep out of logs
+func requestHeaders(cfg WhitelisterApi) (http.Header, []string) {
+	headers := make(http.Header)
+	var secrets []string
+	for key, val := range cfg.Headers {
+		headers.Set(key, val)
+		if val != "" {
+			secrets = append(secrets, val)
+		}
+	}
+	if cfg.UserAgent != "" {
+		headers.Set("User-Agent", cfg.UserAgent)
+	}
+	if cfg.ApiKey != "" {
+		keyHeader := cfg.ApiKeyHeader
+		if keyHeader == "" {
+			keyHeader = defaultApiKeyHeader
+		}
+		headers.Set(keyHeader, cfg.ApiKey)
+		secrets = append(secrets, cfg.ApiKey)
+	}
+	return headers, secrets
+}
+
+// do sends the api request with the configured headers, errors are redacted
+func (checker *Whitelister) do(req *http.Request) (*http.Response, error) {
+	for key, vals := range checker.headers {
+		req.Header[key] = vals
+	}
+	resp, err := checker.client.Do(req)
+	if err != nil {
+		return nil, checker.redact(err)
+	}
+	return resp, nil
+}
+
+// redact masks the secret header values (e.g. echoed by a proxy / in the url) in an error
+func (checker *Whitelister) redact(err error) error {
+	msg := err.Error()
+	redacted := msg
+	for _, secret := range checker.secrets {
+		redacted = strings.ReplaceAll(redacted, secret, "[redacted]")
+	}
+	if redacted == msg {
+		return err
+	}
+	return &redactedError{msg: redacted, err: err}
+}
+
+// redactedError is an error with the secrets masked in its message, the wrapped error is kept
+// for errors.Is / errors.As (e.g. a timeout)
+type redactedError struct {
+	msg string
+	err error
+}
+
+func (e *redactedError) Error() string {
+	return e.msg
+}
+
+func (e *redactedError) Unwrap() error {
+	return e.err
+}
+
+// fetch requests the api url and reads the response body, giving up after the timeout
+// or once ctx is done
+func (checker *Whitelister) fetch(ctx context.Context, check, url string) (status int, body []byte, err error) {
+	ctx, cancel := context.WithTimeout(ctx, checker.timeout)
+	defer cancel()
+	defer observeApiCall(check, time.Now())
+
+	ctx, span := tracer.Start(ctx, "whitelister api call", trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(attribute.String("whitelister.check", check)))
+	defer func() {
+		span.SetAttributes(attribute.Int("http.status_code", status))
+		tracing.End(span, err)
+	}()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	resp, err := checker.do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err = io.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
+
+// apiUrl substitutes the escaped domain/ip into the api url template, so a crafted value
+// (`?`, `#`, `/`, `&`, `%`) can't change the api path or add query params
+func apiUrl(tmpl, val string) string {
+	return fmt.Sprintf(tmpl, url.QueryEscape(val))
+}
+
+// readyProbeDomain is looked up (bypassing the cache) to check the api is reachable
+const readyProbeDomain = "example.com"
+
+// Ping checks the whitelister api responds
+func (checker *Whitelister) Ping(ctx context.Context) error {
+	status, _, err := checker.fetch(ctx, checkPing, apiUrl(checker.checkDomainApiUrl, readyProbeDomain))
+	if err != nil {
+		return err
+	}
+	if status != http.StatusOK {
+		return fmt.Errorf("whitelister api status: %v", status)
+	}
+	return nil
+}
+
+// backoff returns the sleep before the given retry (1 based): exponential with full jitter,
+// a random duration in [0, min(max, base * 2^(retry-1))), so concurrent failing checks don't retry in lockstep
+func backoff(base, max time.Duration, retry int) time.Duration {
+	ceiling := max
+	if retry <= 31 && base < max>>uint(retry-1) {
+		ceiling = base << uint(retry-1)
+	}
+	if ceiling <= 0 {
+		return 0
+	}
+	jitterMu.Lock()
+	defer jitterMu.Unlock()
+	return time.Duration(jitter.Int63n(int64(ceiling)))
+}
+
+// jitter is seeded per process, so instances don't share the retry schedule
+var (
+	jitterMu sync.Mutex
+	jitter   = rand.New(rand.NewSource(time.Now().UnixNano()))
+)
+
+// lookupTimeout bounds a whole (shared) lookup: every try timing out plus the longest retry sleeps
+func (checker *Whitelister) lookupTimeout() time.Duration {
+	tries := checker.maxTries
+	if tries < 1 {
+		tries = 1
+	}
+	return time.Duration(tries)*checker.timeout + time.Duration(tries-1)*checker.maxSleepTime
+}
+
+// sleep waits for the given duration, returning early with an error once ctx is done
+func sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
 
+// DomainIsWhite checks the domain against the whitelister api, duplicate in-flight lookups share
+// a single api call (see flightGroup.Do), each caller still gives up once its own ctx is done
+func (checker *Whitelister) DomainIsWhite(ctx context.Context, domain string) (isWhite bool, err error) {
 	if net.ParseIP(domain) != nil {
 		return false, nil
 	}
-	isWhiteItf, cached := checker.memcache.Get(domain)
+	ctx, span := startCheckSpan(ctx, checkDomain, domain)
+	defer func() { endCheckSpan(span, isWhite, err) }()
+
+	isWhiteItf, cached := checker.getCache(domain)
+	span.SetAttributes(attribute.Bool("whitelister.cached", cached))
 	if cached {
+		mt.IncVec(mt.WhitelisterChecks, outcomeCacheHit)
 		return isWhiteItf.(bool), nil
 	}
 
+	isWhite, err = checker.inflight.Do(ctx, "domain:"+domain, checker.lookupTimeout(), func(ctx context.Context) (bool, error) {
+		return checker.breaker.run(func() (bool, error) {
+			return checker.checkDomain(ctx, domain)
+		})
+	})
+	countCheck(isWhite, err)
+	return isWhite, err
+}
+
+func (checker *Whitelister) checkDomain(ctx context.Context, domain string) (bool, error) {
+	var lastErr error
+	var isWhite bool
+	fnc := "wl check domain"
+	maxTries := checker.maxTries
+	url := apiUrl(checker.checkDomainApiUrl, domain)
+
 	for try := 1; try <= maxTries; try++ {
 
 		if try > 1 {
-			// mt.IncVec(mt.Errors, fnc)
-			sleepDuration := checker.sleepTime * time.Duration(try)
+			mt.IncVec(mt.WhitelisterChecks, outcomeRetry)
+			sleepDuration := backoff(checker.sleepTime, checker.maxSleepTime, try-1)
 			if sleepDuration > 0 {
-				log.Printf("%v (%v / sleep for %v)", fnc, try, sleepDuration)
-				time.Sleep(sleepDuration)
+				lg.Debug(fnc+": sleep before retry", lg.Fields{"try": try, "sleep": sleepDuration.String()})
+				if err := sleep(ctx, sleepDuration); err != nil {
+					return false, err
+				}
 			}
 		}
 
-		resp, err := http.Get(url)
-		if err != nil {
-			msg = fmt.Sprintf("%v (%v / can't execute request), domain: %v, err: %v",
-				fnc, try, domain, err)
-			log.Print(msg)
+		status, body, err := checker.fetch(ctx, checkDomain, url)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return false, ctxErr
+		}
+		if err != nil && status == 0 {
+			lastErr = fmt.Errorf("can't execute request: %w", err)
+			lg.Warn(fnc, lg.Fields{"try": try, "domain": domain, "error": lastErr})
 			continue
 		}
-		defer resp.Body.Close()
 
-		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			msg = fmt.Sprintf("%v (%v / can't read response body), domain: %v, status: %v, err: %v",
-				fnc, try, domain, resp.StatusCode, err)
-			log.Print(msg)
+			lastErr = fmt.Errorf("can't read response body: %w", err)
+			lg.Warn(fnc, lg.Fields{"try": try, "domain": domain, "status": status, "error": lastErr})
 			continue
 		}
 
-		if resp.StatusCode != http.StatusOK {
-			msg = fmt.Sprintf("%v (%v / status = %v), domain: %v, err: %v",
-				fnc, try, domain, resp.StatusCode, err)
-			log.Print(msg)
+		if status != http.StatusOK {
+			lastErr = fmt.Errorf("status = %v", status)
+			lg.Warn(fnc, lg.Fields{"try": try, "domain": domain, "status": status, "error": lastErr})
 			continue
 		}
 
-		var response DomainWhiteListResponse
-		if err := json.Unmarshal(body, &response); err != nil {
-			msg = fmt.Sprintf("%v (%v / can't parse json from response), domain: %v, status: %v, body: %v, err: %v",
-				fnc, try, domain, resp.StatusCode, TrimBytes(body), err)
-			log.Print(msg)
+		isWhite, err = checker.decodeDomain(body)
+		if err != nil {
+			lastErr = fmt.Errorf("can't decode response: %w", err)
+			lg.Warn(fnc, lg.Fields{"try": try, "domain": domain, "status": status, "body": TrimBytes(body), "error": lastErr})
 			continue
 		}
 
-		isWhite = response.Result
-		checker.memcache.Set(domain, isWhite, cache.DefaultExpiration)
+		checker.setCache(domain, isWhite)
 		return isWhite, nil
 	}
 
-	msg = fmt.Sprintf("%v - no result after %d tries, error: %v", fnc, maxTries, msg)
-	log.Print(msg)
-	// mt.IncVec(mt.CapturedFatalsErrors, fnc)
-	return false, nil
+	lg.Error(fnc+": no result", lg.Fields{"tries": maxTries, "domain": domain, "error": lastErr})
+	mt.IncVec(mt.Errors, fnc)
+	return false, &NoResultError{Tries: maxTries, Err: lastErr}
 }
 
-func (checker *Whitelister) IpIsWhite(ip string) (bool, error) {
-	checker.Lock()
-	defer checker.Unlock()
+// IpIsWhite checks the ip against the whitelister api, duplicate in-flight lookups share
+// a single api call (see flightGroup.Do), each caller still gives up once its own ctx is done
+func (checker *Whitelister) IpIsWhite(ctx context.Context, ip string) (isWhite bool, err error) {
+	ctx, span := startCheckSpan(ctx, checkIp, ip)
+	defer func() { endCheckSpan(span, isWhite, err) }()
 
-	var msg string
-	var isWhite bool
-	fnc := "wl check ip"
-	maxTries := checker.maxTries
-	url := fmt.Sprintf(checker.checkIpApiUrl, ip)
-
-	isWhiteItf, cached := checker.memcache.Get(ip)
+	isWhiteItf, cached := checker.getCache(ip)
+	span.SetAttributes(attribute.Bool("whitelister.cached", cached))
 	if cached {
+		mt.IncVec(mt.WhitelisterChecks, outcomeCacheHit)
 		return isWhiteItf.(bool), nil
 	}
 
+	isWhite, err = checker.inflight.Do(ctx, "ip:"+ip, checker.lookupTimeout(), func(ctx context.Context) (bool, error) {
+		return checker.breaker.run(func() (bool, error) {
+			return checker.checkIp(ctx, ip)
+		})
+	})
+	countCheck(isWhite, err)
+	return isWhite, err
+}
+
+func (checker *Whitelister) checkIp(ctx context.Context, ip string) (bool, error) {
+	var lastErr error
+	var isWhite bool
+	fnc := "wl check ip"
+	maxTries := checker.maxTries
+	url := apiUrl(checker.checkIpApiUrl, ip)
+
 	for try := 1; try <= maxTries; try++ {
 
 		if try > 1 {
-			// mt.IncVec(mt.Errors, fnc)
-			sleepDuration := checker.sleepTime * time.Duration(try)
+			mt.IncVec(mt.WhitelisterChecks, outcomeRetry)
+			sleepDuration := backoff(checker.sleepTime, checker.maxSleepTime, try-1)
 			if sleepDuration > 0 {
-				log.Printf("%v (%v / sleep for %v)", fnc, try, sleepDuration)
-				time.Sleep(sleepDuration)
+				lg.Debug(fnc+": sleep before retry", lg.Fields{"try": try, "sleep": sleepDuration.String()})
+				if err := sleep(ctx, sleepDuration); err != nil {
+					return false, err
+				}
 			}
 		}
 
-		resp, err := http.Get(url)
-		if err != nil {
-			msg = fmt.Sprintf("%v (%v / can't execute request), ip: %v, err: %v",
-				fnc, try, ip, err)
-			log.Print(msg)
+		status, body, err := checker.fetch(ctx, checkIp, url)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return false, ctxErr
+		}
+		if err != nil && status == 0 {
+			lastErr = fmt.Errorf("can't execute request: %w", err)
+			lg.Warn(fnc, lg.Fields{"try": try, "ip": ip, "error": lastErr})
 			continue
 		}
-		defer resp.Body.Close()
 
-		body, err := io.ReadAll(resp.Body)
 		if err != nil {
-			msg = fmt.Sprintf("%v (%v / can't read response body), ip: %v, status: %v, err: %v",
-				fnc, try, ip, resp.StatusCode, err)
-			log.Print(msg)
+			lastErr = fmt.Errorf("can't read response body: %w", err)
+			lg.Warn(fnc, lg.Fields{"try": try, "ip": ip, "status": status, "error": lastErr})
 			continue
 		}
 
-		if resp.StatusCode != http.StatusOK {
-			msg = fmt.Sprintf("%v (%v / status = %v), ip: %v",
-				fnc, try, resp.StatusCode, ip)
-			log.Print(msg)
+		if status != http.StatusOK {
+			lastErr = fmt.Errorf("status = %v", status)
+			lg.Warn(fnc, lg.Fields{"try": try, "ip": ip, "status": status, "error": lastErr})
 			continue
 		}
 
-		var response IpWhiteListResponse
-		if err := json.Unmarshal(body, &response); err != nil {
-			msg = fmt.Sprintf("%v (%v / can't parse json from response), ip: %v, status: %v, body: %v, err: %v",
-				fnc, try, ip, resp.StatusCode, TrimBytes(body), err)
-			log.Print(msg)
+		isWhite, err = checker.decodeIp(body)
+		if err != nil {
+			lastErr = fmt.Errorf("can't decode response: %w", err)
+			lg.Warn(fnc, lg.Fields{"try": try, "ip": ip, "status": status, "body": TrimBytes(body), "error": lastErr})
 			continue
 		}
 
-		isWhite = response.Result
-		checker.memcache.Set(ip, isWhite, cache.DefaultExpiration)
+		checker.setCache(ip, isWhite)
 		return isWhite, nil
 	}
 
-	msg = fmt.Sprintf("%v - no result after %d tries, error: %v", fnc, maxTries, msg)
-	log.Print(msg)
-	// mt.IncVec(mt.CapturedFatalsErrors, fnc)
+	lg.Error(fnc+": no result", lg.Fields{"tries": maxTries, "ip": ip, "error": lastErr})
+	mt.IncVec(mt.Errors, fnc)
+	return false, &NoResultError{Tries: maxTries, Err: lastErr}
+}
+
+// whitelister api calls (request duration label)
+const (
+	checkDomain = "domain"
+	checkIp     = "ip"
+	checkBulk   = "bulk"
+	checkPing   = "ping"
+)
+
+// lookup outcomes (whitelister checks label)
+const (
+	outcomeWhite    = "white"
+	outcomeNotWhite = "not_white"
+	outcomeCacheHit = "cache_hit"
+	outcomeError    = "error"
+	outcomeRetry    = "retry"
+)
+
+func observeApiCall(check string, start time.Time) {
+	mt.ObserveVec(mt.WhitelisterRequestDuration, check, time.Since(start).Seconds())
+}
+
+// startCheckSpan starts the span of a domain / ip check, the api calls (if not cached) are its children
+func startCheckSpan(ctx context.Context, check, val string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "whitelister check", trace.WithAttributes(
+		attribute.String("whitelister.check", check),
+		attribute.String(check, val),
+	))
+}
+
+func endCheckSpan(span trace.Span, isWhite bool, err error) {
+	span.SetAttributes(attribute.Bool("whitelister.white", isWhite))
+	tracing.End(span, err)
+}
+
+// countCheck counts the outcome of a (non cached) lookup
+func countCheck(isWhite bool, err error) {
+	switch {
+	case err != nil:
+		mt.IncVec(mt.WhitelisterChecks, outcomeError)
+	case isWhite:
+		mt.IncVec(mt.WhitelisterChecks, outcomeWhite)
+	default:
+		mt.IncVec(mt.WhitelisterChecks, outcomeNotWhite)
+	}
+}
+
+// NoResultError is returned once all tries to get an answer from the whitelister api failed,
+// it's a transient failure (errors.Is(err, ErrTransient))
+type NoResultError struct {
+	Tries int
+	Err   error // the last try error
+}
+
+func (e *NoResultError) Error() string {
+	if e.Tries == 0 {
+		return fmt.Sprintf("whitelister api gave no result: %v", e.Err)
+	}
+	return fmt.Sprintf("whitelister api gave no result (%v tries): %v", e.Tries, e.Err)
+}
+
+func (e *NoResultError) Unwrap() error {
+	return e.Err
+}
+
+func (e *NoResultError) Is(target error) bool {
+	return target == ErrTransient
+}
+
+// applyFailurePolicy turns a failed check (no result) into the configured outcome,
+// other errors (e.g. a cancelled request) are returned as is
+func (checker *Whitelister) applyFailurePolicy(isWhite bool, err error) (bool, error) {
+	var noResult *NoResultError
+	if err == nil || !errors.As(err, &noResult) {
+		return isWhite, err
+	}
+
+	switch checker.onFailure {
+	case FailClosed:
+		return true, nil
+	case FailError:
+		return false, err
+	}
 	return false, nil
 }
@@ -0,0 +1,287 @@
+package validate
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// stubResponse is a canned api reply, an empty body with status 0 is a transport error
+type stubResponse struct {
+	status int
+	body   string
+}
+
+// stubTransport replies with the responses in order (repeating the last one) and records the requested urls
+type stubTransport struct {
+	mu        sync.Mutex
+	responses []stubResponse
+	urls      []string
+}
+
+func (t *stubTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	resp := t.responses[len(t.responses)-1]
+	if len(t.urls) < len(t.responses) {
+		resp = t.responses[len(t.urls)]
+	}
+	t.urls = append(t.urls, req.URL.String())
+	if resp.status == 0 {
+		return nil, errors.New("connection refused")
+	}
+	return &http.Response{
+		StatusCode: resp.status,
+		Body:       io.NopCloser(strings.NewReader(resp.body)),
+		Header:     make(http.Header),
+		Request:    req,
+	}, nil
+}
+
+func (t *stubTransport) calls() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.urls)
+}
+
+func newStubWhitelister(t *testing.T, maxTries int, responses ...stubResponse) (*Whitelister, *stubTransport) {
+	t.Helper()
+	transport := &stubTransport{responses: responses}
+	wl := NewWhitelisterWithClient(WhitelisterApi{
+		CheckDomainApiUrl: "http://wl.test/check?domain=%v",
+		CheckIpApiUrl:     "http://wl.test/check?ip=%v",
+		MaxTries:          maxTries,
+		SleepTime:         time.Millisecond,
+		MaxSleepTime:      time.Millisecond,
+	}, &http.Client{Transport: transport})
+	t.Cleanup(wl.Close)
+	return wl, transport
+}
+
+func TestWhitelisterDomainIsWhite(t *testing.T) {
+	white := stubResponse{http.StatusOK, `{"status": "ok", "domain": "example.com", "result": true}`}
+	notWhite := stubResponse{http.StatusOK, `{"status": "ok", "domain": "example.com", "result": false}`}
+
+	tests := []struct {
+		name      string
+		maxTries  int
+		responses []stubResponse
+		isWhite   bool
+		calls     int
+		errMsg    string // the NoResultError (last try) error, empty if none is expected
+	}{
+		{name: "white", maxTries: 3, responses: []stubResponse{white}, isWhite: true, calls: 1},
+		{name: "not white", maxTries: 3, responses: []stubResponse{notWhite}, isWhite: false, calls: 1},
+		{name: "retry on 500", maxTries: 3, responses: []stubResponse{{http.StatusInternalServerError, ""}, white}, isWhite: true, calls: 2},
+		{name: "retry on transport error", maxTries: 3, responses: []stubResponse{{0, ""}, notWhite}, isWhite: false, calls: 2},
+		{name: "malformed json", maxTries: 2, responses: []stubResponse{{http.StatusOK, `{"result": tru`}}, calls: 2, errMsg: "can't decode response"},
+		{
+			name:      "exhausted retries return the last error",
+			maxTries:  3,
+			responses: []stubResponse{{http.StatusInternalServerError, ""}, {http.StatusBadGateway, ""}, {http.StatusServiceUnavailable, ""}},
+			calls:     3,
+			errMsg:    "status = 503",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wl, transport := newStubWhitelister(t, tt.maxTries, tt.responses...)
+
+			isWhite, err := wl.DomainIsWhite(context.Background(), "example.com")
+			if calls := transport.calls(); calls != tt.calls {
+				t.Errorf("api calls = %v, want %v", calls, tt.calls)
+			}
+
+			if tt.errMsg == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if isWhite != tt.isWhite {
+					t.Errorf("isWhite = %v, want %v", isWhite, tt.isWhite)
+				}
+				return
+			}
+
+			var noResult *NoResultError
+			if !errors.As(err, &noResult) {
+				t.Fatalf("error = %v, want a NoResultError", err)
+			}
+			if noResult.Tries != tt.maxTries {
+				t.Errorf("tries = %v, want %v", noResult.Tries, tt.maxTries)
+			}
+			if !strings.Contains(noResult.Err.Error(), tt.errMsg) {
+				t.Errorf("last error = %v, want %q", noResult.Err, tt.errMsg)
+			}
+			if !errors.Is(err, ErrTransient) {
+				t.Errorf("error %v is not transient", err)
+			}
+		})
+	}
+}
+
+func TestWhitelisterCachedHit(t *testing.T) {
+	tests := []struct {
+		name    string
+		body    string
+		isWhite bool
+	}{
+		{name: "white", body: `{"result": true}`, isWhite: true},
+		{name: "not white", body: `{"result": false}`, isWhite: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			wl, transport := newStubWhitelister(t, 1, stubResponse{http.StatusOK, tt.body})
+
+			for i := 0; i < 3; i++ {
+				isWhite, err := wl.DomainIsWhite(context.Background(), "example.com")
+				if err != nil || isWhite != tt.isWhite {
+					t.Fatalf("lookup %v = %v, %v, want %v", i, isWhite, err, tt.isWhite)
+				}
+			}
+			if calls := transport.calls(); calls != 1 {
+				t.Errorf("api calls = %v, want 1 (cached)", calls)
+			}
+		})
+	}
+}
+
+func TestWhitelisterFailedLookupIsNotCached(t *testing.T) {
+	wl, transport := newStubWhitelister(t, 1,
+		stubResponse{http.StatusInternalServerError, ""}, stubResponse{http.StatusOK, `{"result": true}`})
+
+	if _, err := wl.DomainIsWhite(context.Background(), "example.com"); err == nil {
+		t.Fatal("expected an error")
+	}
+	isWhite, err := wl.DomainIsWhite(context.Background(), "example.com")
+	if err != nil || !isWhite {
+		t.Fatalf("second lookup = %v, %v, want true", isWhite, err)
+	}
+	if calls := transport.calls(); calls != 2 {
+		t.Errorf("api calls = %v, want 2", calls)
+	}
+}
+
+func TestWhitelisterIpIsWhite(t *testing.T) {
+	wl, transport := newStubWhitelister(t, 2,
+		stubResponse{http.StatusInternalServerError, ""}, stubResponse{http.StatusOK, `{"status": "ok", "ip": "1.2.3.4", "result": true}`})
+
+	isWhite, err := wl.IpIsWhite(context.Background(), "1.2.3.4")
+	if err != nil || !isWhite {
+		t.Fatalf("IpIsWhite = %v, %v, want true", isWhite, err)
+	}
+	if calls := transport.calls(); calls != 2 {
+		t.Errorf("api calls = %v, want 2", calls)
+	}
+}
+
+func TestBackoffBounds(t *testing.T) {
+	tests := []struct {
+		name    string
+		base    time.Duration
+		max     time.Duration
+		retry   int
+		ceiling time.Duration // delays are in [0, ceiling)
+	}{
+		{name: "first retry", base: 100 * time.Millisecond, max: 30 * time.Second, retry: 1, ceiling: 100 * time.Millisecond},
+		{name: "doubles", base: 100 * time.Millisecond, max: 30 * time.Second, retry: 4, ceiling: 800 * time.Millisecond},
+		{name: "capped", base: 100 * time.Millisecond, max: time.Second, retry: 5, ceiling: time.Second},
+		{name: "no overflow on many retries", base: time.Second, max: 30 * time.Second, retry: 100, ceiling: 30 * time.Second},
+		{name: "base above the cap", base: time.Minute, max: 30 * time.Second, retry: 1, ceiling: 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var longest time.Duration
+			for i := 0; i < 1000; i++ {
+				d := backoff(tt.base, tt.max, tt.retry)
+				if d < 0 || d >= tt.ceiling {
+					t.Fatalf("backoff = %v, want [0, %v)", d, tt.ceiling)
+				}
+				if d > longest {
+					longest = d
+				}
+			}
+			// full jitter spreads the delays over the whole range
+			if longest < tt.ceiling/2 {
+				t.Errorf("longest of 1000 delays = %v, want at least %v", longest, tt.ceiling/2)
+			}
+		})
+	}
+
+	if d := backoff(0, time.Second, 3); d != 0 {
+		t.Errorf("backoff without a base = %v, want 0", d)
+	}
+}
+
+func TestApiUrlEscaping(t *testing.T) {
+	tests := []struct {
+		name string
+		tmpl string
+		val  string
+	}{
+		{name: "plain domain", tmpl: "http://wl.test/check?domain=%v", val: "example.com"},
+		{name: "query", tmpl: "http://wl.test/check?domain=%v", val: "a.com?admin=1"},
+		{name: "extra param", tmpl: "http://wl.test/check?domain=%v", val: "a.com&ip=127.0.0.1"},
+		{name: "fragment", tmpl: "http://wl.test/check?domain=%v", val: "a.com#frag"},
+		{name: "path", tmpl: "http://wl.test/check?domain=%v", val: "a.com/../../admin"},
+		{name: "encoded chars", tmpl: "http://wl.test/check?domain=%v", val: "a%2Fb.com%3F%23"},
+		{name: "ipv6", tmpl: "http://wl.test/check?ip=%v", val: "::1"},
+		{name: "path template", tmpl: "http://wl.test/domains/%v/check", val: "a.com/../x?y#z"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			want, err := url.Parse(fmt.Sprintf(tt.tmpl, "placeholder"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := url.Parse(apiUrl(tt.tmpl, tt.val))
+			if err != nil {
+				t.Fatalf("apiUrl result doesn't parse: %v", err)
+			}
+
+			if got.Host != want.Host || got.Fragment != "" || len(got.Query()) != len(want.Query()) {
+				t.Fatalf("apiUrl(%q) = %v, the url structure changed", tt.val, got)
+			}
+			if strings.Contains(tt.tmpl, "?") {
+				key := strings.TrimSuffix(strings.SplitN(tt.tmpl, "?", 2)[1], "=%v")
+				if got.Path != want.Path || got.Query().Get(key) != tt.val {
+					t.Errorf("apiUrl(%q) = %v, want path %v and %v=%q", tt.val, got, want.Path, key, tt.val)
+				}
+				return
+			}
+			// path templates: the value is a single (escaped) segment
+			if got.RawQuery != "" || strings.Count(got.EscapedPath(), "/") != strings.Count(want.EscapedPath(), "/") {
+				t.Errorf("apiUrl(%q) = %v, the value escaped its path segment", tt.val, got)
+			}
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	checker := &Whitelister{secrets: []string{"s3cret"}}
+	cause := fmt.Errorf("proxy echoed key s3cret: %w", context.DeadlineExceeded)
+
+	err := checker.redact(cause)
+	if strings.Contains(err.Error(), "s3cret") || !strings.Contains(err.Error(), "[redacted]") {
+		t.Errorf("redact() = %q, want the secret masked", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("redact() = %v, want it to wrap the cause", err)
+	}
+
+	clean := errors.New("connection refused")
+	if err := checker.redact(clean); err != clean {
+		t.Errorf("redact() = %v, want the error without secrets as is", err)
+	}
+}
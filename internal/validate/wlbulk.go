@@ -0,0 +1,146 @@
+package validate
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+
+	lg "phish-api/internal/logging"
+	mt "phish-api/internal/metrics"
+)
+
+// BulkDomainWhiteListRequest is posted to the bulk check endpoint
+type BulkDomainWhiteListRequest struct {
+	Domains []string `json:"domains"`
+}
+
+// BulkDomainWhiteListResponse lists a result per requested domain
+type BulkDomainWhiteListResponse struct {
+	Status  string                    `json:"status"`
+	Results []DomainWhiteListResponse `json:"results"`
+}
+
+// DomainsAreWhite checks many domains at once: cached results are reused, the others are posted
+// to the bulk endpoint in one request (or checked one by one without a bulk endpoint) and cached;
+// ips are checked one by one against the ip whitelist
+func (checker *Whitelister) DomainsAreWhite(ctx context.Context, domains []string) (map[string]bool, error) {
+	results := make(map[string]bool, len(domains))
+	var missing []string
+	for _, domain := range domains {
+		if _, seen := results[domain]; seen {
+			continue
+		}
+		if net.ParseIP(domain) != nil {
+			isWhite, err := checker.IpIsWhite(ctx, domain)
+			if err != nil {
+				return nil, err
+			}
+			results[domain] = isWhite
+			continue
+		}
+		if isWhiteItf, cached := checker.getCache(domain); cached {
+			results[domain] = isWhiteItf.(bool)
+			continue
+		}
+		results[domain] = false
+		missing = append(missing, domain)
+	}
+
+	if len(missing) == 0 {
+		return results, nil
+	}
+
+	if checker.bulkCheckDomainApiUrl == "" {
+		for _, domain := range missing {
+			isWhite, err := checker.DomainIsWhite(ctx, domain)
+			if err != nil {
+				return nil, err
+			}
+			results[domain] = isWhite
+		}
+		return results, nil
+	}
+
+	_, err := checker.breaker.run(func() (bool, error) {
+		return false, checker.bulkCheck(ctx, missing, results)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// bulkCheck posts the domains to the bulk endpoint (with the check retries), caching every result;
+// domains missing in the response are left as not white (and not cached)
+func (checker *Whitelister) bulkCheck(ctx context.Context, domains []string, results map[string]bool) error {
+	fnc := "wl bulk check domains"
+	payload, err := json.Marshal(BulkDomainWhiteListRequest{Domains: domains})
+	if err != nil {
+		return err
+	}
+
+	var lastErr error
+	for try := 1; try <= checker.maxTries; try++ {
+		if try > 1 {
+			mt.IncVec(mt.WhitelisterChecks, outcomeRetry)
+			if err := sleep(ctx, backoff(checker.sleepTime, checker.maxSleepTime, try-1)); err != nil {
+				return err
+			}
+		}
+
+		status, body, err := checker.post(ctx, checker.bulkCheckDomainApiUrl, payload)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			lastErr = fmt.Errorf("can't execute request: %w", err)
+		} else if status != http.StatusOK {
+			lastErr = fmt.Errorf("status = %v", status)
+		} else {
+			var response BulkDomainWhiteListResponse
+			if err := json.Unmarshal(body, &response); err != nil {
+				lastErr = fmt.Errorf("can't decode response: %w", err)
+			} else {
+				for _, item := range response.Results {
+					if _, requested := results[item.Domain]; requested {
+						results[item.Domain] = item.Result
+						checker.setCache(item.Domain, item.Result)
+					}
+				}
+				return nil
+			}
+		}
+		lg.Warn(fnc, lg.Fields{"try": try, "domains": len(domains), "status": status, "error": lastErr})
+	}
+
+	lg.Error(fnc+": no result", lg.Fields{"tries": checker.maxTries, "domains": len(domains), "error": lastErr})
+	mt.IncVec(mt.Errors, fnc)
+	return &NoResultError{Tries: checker.maxTries, Err: lastErr}
+}
+
+// post sends the json payload to the api url and reads the response body
+func (checker *Whitelister) post(ctx context.Context, url string, payload []byte) (int, []byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, checker.timeout)
+	defer cancel()
+	defer observeApiCall(checkBulk, time.Now())
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return 0, nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := checker.do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	return resp.StatusCode, body, err
+}
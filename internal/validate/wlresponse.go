@@ -0,0 +1,65 @@
+package validate
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// resultDecoder extracts the whitelisted flag from a whitelister api response body
+type resultDecoder func(body []byte) (bool, error)
+
+// decodeDomainResponse is the default domain decoder: {"status", "domain", "result"}
+func decodeDomainResponse(body []byte) (bool, error) {
+	var response DomainWhiteListResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return false, err
+	}
+	return response.Result, nil
+}
+
+// decodeIpResponse is the default ip decoder: {"status", "ip", "result"}
+func decodeIpResponse(body []byte) (bool, error) {
+	var response IpWhiteListResponse
+	if err := json.Unmarshal(body, &response); err != nil {
+		return false, err
+	}
+	return response.Result, nil
+}
+
+// fieldDecoder reads the bool at the dot separated json field path (e.g. "whitelisted", "data.result")
+func fieldDecoder(path string) resultDecoder {
+	keys := strings.Split(path, ".")
+
+	return func(body []byte) (bool, error) {
+		var val interface{}
+		if err := json.Unmarshal(body, &val); err != nil {
+			return false, err
+		}
+
+		for _, key := range keys {
+			obj, isObj := val.(map[string]interface{})
+			if !isObj {
+				return false, fmt.Errorf("field '%v' not found (not an object)", path)
+			}
+			if val, isObj = obj[key]; !isObj {
+				return false, fmt.Errorf("field '%v' not found", path)
+			}
+		}
+
+		result, isBool := val.(bool)
+		if !isBool {
+			return false, fmt.Errorf("field '%v' is not a bool: %v", path, val)
+		}
+		return result, nil
+	}
+}
+
+func validResultField(path string) bool {
+	for _, key := range strings.Split(path, ".") {
+		if key == "" {
+			return false
+		}
+	}
+	return true
+}